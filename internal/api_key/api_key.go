@@ -1,12 +1,163 @@
 package api_key
 
-import "time"
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"authfish/internal/policy"
+	"authfish/internal/utils"
+)
+
+// Number of characters at the start of a key which are stored in plaintext,
+// to find the key in the database and to tell keys apart.
+const PrefixLength = 8
+
+// Keys with this scope may only be used for requests which don't change
+// anything. Every other scope is a host, optionally followed by a path prefix,
+// e.g. wiki.example.com/api.
+const ReadOnlyScope = "read-only"
 
 type ApiKey struct {
 	Id        int64      `db:"id"`
 	UserId    int64      `db:"user_id"`
 	Memo      string     `db:"memo"`
-	Key       string     `db:"key"`
+	Prefix    string     `db:"prefix"`
+	HashedKey string     `db:"hashed_key"`
 	CreatedAt time.Time  `db:"created_at"`
 	LastSeen  *time.Time `db:"last_seen"`
+	UseCount  int64      `db:"use_count"`
+	LastIp    string     `db:"last_ip"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	Scopes    string     `db:"scopes"` // Space separated
+
+	// Only known right after the key is created
+	Key string `db:"-"`
+}
+
+// Returns the prefix of key, or an empty string if key is too short to be
+// valid.
+func Prefix(key string) string {
+	if len(key) <= PrefixLength {
+		return ""
+	}
+
+	return key[:PrefixLength]
+}
+
+func (k ApiKey) Matches(key string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.HashedKey), []byte(utils.HashToken(key))) == 1
+}
+
+func (k ApiKey) IsExpired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+func (k ApiKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Whether k has host scopes, and so can only be used for requests to those
+// hosts.
+func (k ApiKey) IsRestrictedToHosts() bool {
+	for _, scope := range k.ScopeList() {
+		if scope != ReadOnlyScope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decide whether the scopes of k allow a request to host and path with method.
+// A key without host scopes may be used for any host.
+func (k ApiKey) Allows(host string, path string, method string) bool {
+	hostScopes := []string{}
+
+	for _, scope := range k.ScopeList() {
+		if scope == ReadOnlyScope {
+			if !utils.IsSafeMethod(method) {
+				return false
+			}
+		} else {
+			hostScopes = append(hostScopes, scope)
+		}
+	}
+
+	if len(hostScopes) == 0 {
+		return true
+	}
+
+	for _, scope := range hostScopes {
+		scopeHost, scopePath := splitScope(scope)
+
+		if scopeHost == host && policy.MatchesPathPrefix(path, "/"+scopePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits a host scope into its host and path prefix, without leading slash.
+func splitScope(scope string) (string, string) {
+	parts := strings.SplitN(scope, "/", 2)
+
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// Validates and normalizes scopes given on the command line.
+func NormalizeScopes(scopes []string) ([]string, error) {
+	normalized := make([]string, 0, len(scopes))
+
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+
+		if len(scope) == 0 {
+			continue
+		}
+
+		if strings.ContainsAny(scope, " \t\n") {
+			return nil, fmt.Errorf("scope must not contain whitespace: %q", scope)
+		}
+
+		if scope != ReadOnlyScope {
+			host, path := splitScope(scope)
+
+			if len(host) == 0 {
+				return nil, fmt.Errorf("scope must be %s or start with a host: %q", ReadOnlyScope, scope)
+			}
+
+			scope = policy.NormalizeHost(host)
+
+			if len(path) > 0 {
+				scope += "/" + strings.TrimSuffix(path, "/")
+			}
+		}
+
+		normalized = append(normalized, scope)
+	}
+
+	return normalized, nil
+}
+
+// Parses an expiry given on the command line, either as a date (2006-01-02)
+// or as a duration from now (720h).
+func ParseExpiry(value string, now time.Time) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil || duration <= 0 {
+		return time.Time{}, fmt.Errorf("expiry must be a date like 2006-01-02 or a duration like 720h: %q", value)
+	}
+
+	return now.Add(duration), nil
 }
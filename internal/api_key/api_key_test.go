@@ -0,0 +1,171 @@
+package api_key
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"authfish/internal/utils"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		host   string
+		path   string
+		method string
+		want   bool
+	}{
+		{name: "no scopes", host: "wiki.example.com", path: "/", method: http.MethodPost, want: true},
+		{name: "host", scopes: "wiki.example.com", host: "wiki.example.com", path: "/edit", method: http.MethodPost, want: true},
+		{name: "another host", scopes: "wiki.example.com", host: "git.example.com", path: "/", method: http.MethodGet},
+		{name: "subdomain of the host", scopes: "example.com", host: "wiki.example.com", path: "/", method: http.MethodGet},
+		{name: "path prefix", scopes: "wiki.example.com/admin", host: "wiki.example.com", path: "/admin", method: http.MethodGet, want: true},
+		{name: "below the path prefix", scopes: "wiki.example.com/admin", host: "wiki.example.com", path: "/admin/users", method: http.MethodGet, want: true},
+		{name: "path sharing the prefix", scopes: "wiki.example.com/admin", host: "wiki.example.com", path: "/administrator", method: http.MethodGet},
+		{name: "outside the path prefix", scopes: "wiki.example.com/admin", host: "wiki.example.com", path: "/", method: http.MethodGet},
+		{name: "path prefix of another host", scopes: "wiki.example.com/admin", host: "git.example.com", path: "/admin", method: http.MethodGet},
+		{name: "second host", scopes: "wiki.example.com git.example.com", host: "git.example.com", path: "/", method: http.MethodGet, want: true},
+		{name: "read-only GET", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodGet, want: true},
+		{name: "read-only HEAD", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodHead, want: true},
+		{name: "read-only OPTIONS", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodOptions, want: true},
+		{name: "read-only POST", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodPost},
+		{name: "read-only PUT", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodPut},
+		{name: "read-only PATCH", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodPatch},
+		{name: "read-only DELETE", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodDelete},
+		{name: "read-only lower case get", scopes: ReadOnlyScope, host: "wiki.example.com", path: "/", method: "get"},
+		{name: "read-only host GET", scopes: ReadOnlyScope + " wiki.example.com", host: "wiki.example.com", path: "/", method: http.MethodGet, want: true},
+		{name: "read-only host POST", scopes: "wiki.example.com " + ReadOnlyScope, host: "wiki.example.com", path: "/", method: http.MethodPost},
+		{name: "read-only host GET to another host", scopes: ReadOnlyScope + " wiki.example.com", host: "git.example.com", path: "/", method: http.MethodGet},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := ApiKey{Scopes: test.scopes}
+
+			if got := k.Allows(test.host, test.path, test.method); got != test.want {
+				t.Errorf("got %v for %s %s%s, want %v", got, test.method, test.host, test.path, test.want)
+			}
+		})
+	}
+}
+
+func TestIsRestrictedToHosts(t *testing.T) {
+	tests := []struct {
+		scopes string
+		want   bool
+	}{
+		{scopes: ""},
+		{scopes: ReadOnlyScope},
+		{scopes: "wiki.example.com", want: true},
+		{scopes: ReadOnlyScope + " wiki.example.com/api", want: true},
+	}
+
+	for _, test := range tests {
+		if got := (ApiKey{Scopes: test.scopes}).IsRestrictedToHosts(); got != test.want {
+			t.Errorf("got %v for scopes %q, want %v", got, test.scopes, test.want)
+		}
+	}
+}
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []string
+		wantErr string
+	}{
+		{name: "none", scopes: nil, want: []string{}},
+		{name: "read-only", scopes: []string{ReadOnlyScope}, want: []string{ReadOnlyScope}},
+		{name: "host", scopes: []string{" Wiki.Example.com "}, want: []string{"wiki.example.com"}},
+		{name: "host and path", scopes: []string{"Wiki.example.com/API/"}, want: []string{"wiki.example.com/API"}},
+		{name: "empty scopes are skipped", scopes: []string{"", "  ", "wiki.example.com"}, want: []string{"wiki.example.com"}},
+		{name: "whitespace", scopes: []string{"wiki.example.com git.example.com"}, wantErr: "must not contain whitespace"},
+		{name: "tab", scopes: []string{"wiki.example.com\t/api"}, wantErr: "must not contain whitespace"},
+		{name: "path without host", scopes: []string{"/api"}, wantErr: "start with a host"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeScopes(test.scopes)
+
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2023, 1, 9, 2, 3, 50, 0, time.UTC)
+
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2023-02-01", want: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "720h", want: now.Add(720 * time.Hour)},
+		{value: "90m", want: now.Add(90 * time.Minute)},
+		{value: "0s", wantErr: true},
+		{value: "-1h", wantErr: true},
+		{value: "2023-02-30", wantErr: true},
+		{value: "01/02/2023", wantErr: true},
+		{value: "never", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseExpiry(test.value, now)
+
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	key := "abcdefgh-the-rest-of-the-key"
+	k := ApiKey{Prefix: Prefix(key), HashedKey: utils.HashToken(key)}
+
+	if !k.Matches(key) {
+		t.Error("key does not match its hash")
+	}
+
+	if k.Matches(key+"x") || k.Matches(k.HashedKey) {
+		t.Error("another key matches")
+	}
+
+	if Prefix("abcdefgh") != "" || Prefix(key) != "abcdefgh" {
+		t.Errorf("got prefixes %q and %q", Prefix("abcdefgh"), Prefix(key))
+	}
+}
@@ -0,0 +1,35 @@
+package authenticator
+
+import (
+	"errors"
+	"fmt"
+
+	"authfish/internal/user"
+)
+
+// Returned by authenticators for usernames which are not theirs to check, so
+// that the next one in a Chain gets a chance.
+var ErrUnknownUser = errors.New("username not registered")
+
+// Checks the password of a user logging in.
+type Authenticator interface {
+	// Returns the local user username belongs to if password is correct.
+	Authenticate(username string, password string) (*user.User, error)
+}
+
+// Tries each authenticator in turn, until one of them knows the username.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(username string, password string) (*user.User, error) {
+	for _, authenticator := range c {
+		u, err := authenticator.Authenticate(username, password)
+
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+
+		return u, err
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownUser, username)
+}
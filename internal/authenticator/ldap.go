@@ -0,0 +1,267 @@
+package authenticator
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jmoiron/sqlx"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// Where to find users in an LDAP directory. Filters can contain {username},
+// and the group filter also {dn}, the DN of the user.
+type LdapConfig struct {
+	Url          string
+	StartTls     bool
+	BindDn       string // Empty to search anonymously
+	BindPassword string
+	BaseDn       string
+	UserFilter   string
+	GroupBaseDn  string // Defaults to BaseDn
+	GroupFilter  string // Empty to not sync groups
+}
+
+func (c LdapConfig) Validate() error {
+	parsedUrl, err := url.Parse(c.Url)
+
+	if err != nil || (parsedUrl.Scheme != "ldap" && parsedUrl.Scheme != "ldaps") || len(parsedUrl.Host) == 0 {
+		return fmt.Errorf("URL must start with ldap:// or ldaps://: %q", c.Url)
+	}
+
+	if len(c.BaseDn) == 0 {
+		return fmt.Errorf("a base DN is required")
+	}
+
+	if !strings.Contains(c.UserFilter, "{username}") {
+		return fmt.Errorf("user filter must contain {username}: %q", c.UserFilter)
+	}
+
+	if _, err := ldap.CompileFilter(c.userFilter("x")); err != nil {
+		return fmt.Errorf("invalid user filter: %w", err)
+	}
+
+	if len(c.GroupFilter) > 0 {
+		if _, err := ldap.CompileFilter(c.groupFilter("x", "cn=x")); err != nil {
+			return fmt.Errorf("invalid group filter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c LdapConfig) userFilter(username string) string {
+	return strings.ReplaceAll(c.UserFilter, "{username}", ldap.EscapeFilter(username))
+}
+
+func (c LdapConfig) groupFilter(username string, dn string) string {
+	return strings.NewReplacer(
+		"{username}", ldap.EscapeFilter(username),
+		"{dn}", ldap.EscapeFilter(dn),
+	).Replace(c.GroupFilter)
+}
+
+// Checks passwords by binding to an LDAP directory as the user. Users are
+// created locally on their first login, and their groups are replaced with
+// their groups in the directory on every login.
+type Ldap struct {
+	db     *sqlx.DB
+	config LdapConfig
+}
+
+func NewLdap(db *sqlx.DB, config LdapConfig) *Ldap {
+	if len(config.GroupBaseDn) == 0 {
+		config.GroupBaseDn = config.BaseDn
+	}
+
+	return &Ldap{db: db, config: config}
+}
+
+func (l *Ldap) Authenticate(username string, password string) (*user.User, error) {
+	username = utils.NormalizeUsername(username)
+
+	u, err := database.FindUserByUsername(l.db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error running database query: %w", err)
+	}
+
+	// Local users can't be taken over by someone with the same name in LDAP
+	if u != nil && u.Source != user.SourceLdap {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+
+	// An empty password would be an unauthenticated bind, which succeeds
+	if len(password) == 0 {
+		return nil, fmt.Errorf("invalid password for %s", username)
+	}
+
+	conn, err := l.dial()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LDAP server: %w", err)
+	}
+
+	defer conn.Close()
+
+	userDn, err := l.findUserDn(conn, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(userDn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("invalid password for %s", username)
+		}
+
+		return nil, fmt.Errorf("could not check password with LDAP server: %w", err)
+	}
+
+	var groups []string
+
+	if len(l.config.GroupFilter) > 0 {
+		// Search with the service account again, users might not be allowed to
+		// read groups.
+		if err := l.bindServiceAccount(conn); err != nil {
+			return nil, err
+		}
+
+		groups, err = l.findGroups(conn, username, userDn)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if u == nil {
+		u, err = database.CreateLdapUser(l.db, username)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.config.GroupFilter) > 0 {
+		if err := database.SetGroupsForUser(l.db, *u, groups); err != nil {
+			return nil, fmt.Errorf("could not sync groups of %s: %w", username, err)
+		}
+	}
+
+	return u, nil
+}
+
+func (l *Ldap) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.config.Url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(ldapTimeout)
+
+	if l.config.StartTls {
+		parsedUrl, _ := url.Parse(l.config.Url)
+
+		if err := conn.StartTLS(&tls.Config{ServerName: parsedUrl.Hostname()}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start TLS: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *Ldap) bindServiceAccount(conn *ldap.Conn) error {
+	var err error
+
+	if len(l.config.BindDn) > 0 {
+		err = conn.Bind(l.config.BindDn, l.config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not bind to LDAP server as %q: %w", l.config.BindDn, err)
+	}
+
+	return nil
+}
+
+func (l *Ldap) findUserDn(conn *ldap.Conn, username string) (string, error) {
+	if err := l.bindServiceAccount(conn); err != nil {
+		return "", err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.config.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(ldapTimeout.Seconds()),
+		false,
+		l.config.userFilter(username),
+		[]string{"dn"},
+		nil,
+	))
+
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf("could not search LDAP server: %w", err)
+	}
+
+	if result == nil || len(result.Entries) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+
+	if len(result.Entries) > 1 {
+		return "", errors.New("more than one LDAP entry matches the username")
+	}
+
+	return result.Entries[0].DN, nil
+}
+
+// Returns the common names of the groups of the user, skipping names which
+// can't be used as group names in authfish.
+func (l *Ldap) findGroups(conn *ldap.Conn, username string, userDn string) ([]string, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.config.GroupBaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		int(ldapTimeout.Seconds()),
+		false,
+		l.config.groupFilter(username, userDn),
+		[]string{"cn"},
+		nil,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not search LDAP server for groups: %w", err)
+	}
+
+	groups := []string{}
+
+	for _, entry := range result.Entries {
+		name := utils.NormalizeGroupName(entry.GetAttributeValue("cn"))
+
+		if len(name) == 0 || strings.ContainsAny(name, ", ") {
+			log.Printf("Not syncing LDAP group %q of %s, group names can't be empty or contain commas or spaces", entry.DN, username)
+			continue
+		}
+
+		groups = append(groups, name)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,240 @@
+package authenticator_test
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"authfish/internal/authenticator"
+	"authfish/internal/database"
+	"authfish/internal/group"
+	"authfish/internal/ldap_server"
+	"authfish/internal/user"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	testBaseDn          = "dc=example,dc=com"
+	testServicePassword = "service-password"
+)
+
+// A directory served by another authfish over LDAP, and the database of the
+// authfish logging users in against it.
+type testDirectory struct {
+	db      *sqlx.DB
+	localDb *sqlx.DB
+	ldap    *authenticator.Ldap
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	d := &testDirectory{
+		db:      database.OpenTestDB(t),
+		localDb: database.OpenTestDB(t),
+	}
+
+	server, err := ldap_server.New(d.db, authenticator.NewLocal(d.db), testBaseDn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+
+	d.addUser(t, "service", testServicePassword)
+
+	config := authenticator.LdapConfig{
+		Url:          "ldap://" + listener.Addr().String(),
+		BindDn:       "uid=service,ou=people," + testBaseDn,
+		BindPassword: testServicePassword,
+		BaseDn:       testBaseDn,
+		UserFilter:   "(&(objectClass=inetOrgPerson)(uid={username}))",
+		GroupFilter:  "(&(objectClass=groupOfNames)(member={dn}))",
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.ldap = authenticator.NewLdap(d.localDb, config)
+
+	return d
+}
+
+func (d *testDirectory) addUser(t *testing.T, username string, password string) *user.User {
+	return database.CreateTestUser(t, d.db, username, password)
+}
+
+func createGroup(t *testing.T, db *sqlx.DB, name string, members ...*user.User) *group.Group {
+	g, err := database.CreateGroup(db, name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range members {
+		if err := database.AddGroupMember(db, *g, *member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return g
+}
+
+func groupNames(t *testing.T, db *sqlx.DB, u user.User) []string {
+	groups, err := database.ListGroupsForUser(db, u)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	d := newTestDirectory(t)
+	d.addUser(t, "carol", "carol-password")
+
+	u, err := d.ldap.Authenticate("carol", "carol-password")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if u.Username != "carol" || u.Source != user.SourceLdap || u.HasLocalPassword() {
+		t.Errorf("got user %+v, want a new LDAP user carol", u)
+	}
+
+	// The second login finds the same user
+	again, err := d.ldap.Authenticate("carol", "carol-password")
+
+	if err != nil || again.Id != u.Id {
+		t.Errorf("second login got user %+v and error %v", again, err)
+	}
+}
+
+func TestLdapAuthenticateRefuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		// Whether the next authenticator in a chain gets a chance
+		wantUnknown bool
+	}{
+		{name: "wrong password", username: "carol", password: "wrong"},
+		{name: "empty password", username: "carol", password: ""},
+		{name: "unknown user", username: "dave", password: "carol-password", wantUnknown: true},
+		{name: "wildcard username", username: "*", password: "carol-password", wantUnknown: true},
+		{name: "filter injection", username: "*)(uid=*", password: "carol-password", wantUnknown: true},
+		{name: "filter injection matching carol", username: "car*", password: "carol-password", wantUnknown: true},
+		{name: "filter injection with or", username: "x)(|(uid=carol)", password: "carol-password", wantUnknown: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDirectory(t)
+			d.addUser(t, "carol", "carol-password")
+
+			u, err := d.ldap.Authenticate(test.username, test.password)
+
+			if err == nil {
+				t.Fatalf("logged in as %+v", u)
+			}
+
+			if errors.Is(err, authenticator.ErrUnknownUser) != test.wantUnknown {
+				t.Errorf("got error %v, want unknown user %v", err, test.wantUnknown)
+			}
+
+			users, err := database.ListUsers(d.localDb)
+
+			if err != nil || len(users) > 0 {
+				t.Errorf("refused login created users %v (%v)", users, err)
+			}
+		})
+	}
+}
+
+func TestLdapAuthenticateDoesNotTakeOverLocalUsers(t *testing.T) {
+	d := newTestDirectory(t)
+	d.addUser(t, "bob", "ldap-password")
+	local := database.CreateTestUser(t, d.localDb, "bob", "local-password")
+	createGroup(t, d.localDb, "admins", local)
+
+	u, err := d.ldap.Authenticate("bob", "ldap-password")
+
+	if !errors.Is(err, authenticator.ErrUnknownUser) {
+		t.Fatalf("got user %+v and error %v, want unknown user", u, err)
+	}
+
+	// The local password still works, and nothing about bob changed
+	chain := authenticator.Chain{d.ldap, authenticator.NewLocal(d.localDb)}
+
+	if _, err := chain.Authenticate("bob", "ldap-password"); err == nil {
+		t.Error("logged in as the local bob with the LDAP password")
+	}
+
+	u, err = chain.Authenticate("bob", "local-password")
+
+	if err != nil || u.Id != local.Id || u.Source == user.SourceLdap {
+		t.Fatalf("got user %+v and error %v, want the local bob", u, err)
+	}
+
+	if names := groupNames(t, d.localDb, *u); strings.Join(names, ",") != "admins" {
+		t.Errorf("local bob is in groups %v, want admins", names)
+	}
+}
+
+func TestLdapAuthenticateReplacesGroups(t *testing.T) {
+	d := newTestDirectory(t)
+	carol := d.addUser(t, "carol", "carol-password")
+	createGroup(t, d.db, "developers", carol)
+	staff := createGroup(t, d.db, "staff", carol)
+	createGroup(t, d.db, "admins")
+
+	u, err := d.ldap.Authenticate("carol", "carol-password")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Groups carol is in locally are replaced by the directory's
+	createGroup(t, d.localDb, "local-only", u)
+
+	if _, err := d.ldap.Authenticate("carol", "carol-password"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if names := groupNames(t, d.localDb, *u); strings.Join(names, ",") != "developers,staff" {
+		t.Errorf("carol is in groups %v, want developers and staff", names)
+	}
+
+	// Removing carol from a group in the directory removes them locally on
+	// the next login
+	if err := database.RemoveGroupMember(d.db, *staff, *carol); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ldap.Authenticate("carol", "carol-password"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if names := groupNames(t, d.localDb, *u); strings.Join(names, ",") != "developers" {
+		t.Errorf("carol is in groups %v, want developers", names)
+	}
+}
@@ -0,0 +1,38 @@
+package authenticator
+
+import (
+	"fmt"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Checks passwords against the bcrypt hashes in the users table.
+type Local struct {
+	db *sqlx.DB
+}
+
+func NewLocal(db *sqlx.DB) *Local {
+	return &Local{db: db}
+}
+
+func (l *Local) Authenticate(username string, password string) (*user.User, error) {
+	u, err := database.FindUserByUsername(l.db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error running database query: %w", err)
+	}
+
+	if u == nil || !u.HasLocalPassword() {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid password for %s", username)
+	}
+
+	return u, nil
+}
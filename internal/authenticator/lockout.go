@@ -0,0 +1,48 @@
+package authenticator
+
+import (
+	"log"
+
+	"authfish/internal/database"
+	"authfish/internal/lockout"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Returns the lockout of username or ip which prevents logging in, if any.
+func FindActiveLockout(db *sqlx.DB, username string, ip string) (*lockout.Lockout, error) {
+	for kind, subject := range map[lockout.Kind]string{lockout.KindUsername: username, lockout.KindIp: ip} {
+		l, err := database.FindLockout(db, kind, subject)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if l != nil && l.IsLocked() {
+			return l, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Count a failed login against both username and ip. Returns the resulting
+// lockout, if the failure caused one.
+func RecordFailure(db *sqlx.DB, username string, ip string) *lockout.Lockout {
+	var result *lockout.Lockout
+
+	for kind, subject := range map[lockout.Kind]string{lockout.KindUsername: username, lockout.KindIp: ip} {
+		l, err := database.RecordLoginFailure(db, kind, subject)
+
+		if err != nil {
+			log.Printf("Error recording failed login for %s %s: %v", kind, subject, err)
+			continue
+		}
+
+		if l.IsLocked() && (result == nil || l.Remaining() > result.Remaining()) {
+			result = l
+		}
+	}
+
+	return result
+}
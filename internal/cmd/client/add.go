@@ -0,0 +1,31 @@
+package client
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type AddCmd struct {
+	Name        string   `arg:""`
+	RedirectUri []string `help:"URI the app receives the authorization code at. Repeat for more URIs." required:""`
+	Public      bool     `help:"For apps which can't keep a secret, like single page apps and mobile apps. They must use PKCE instead."`
+}
+
+func (r *AddCmd) Run(ctx *context.AppContext) error {
+	client, err := database.CreateOidcClient(ctx.Db, r.Name, r.RedirectUri, r.Public)
+
+	if err != nil {
+		fmt.Printf("Error adding client: %v\n", err)
+		os.Exit(1)
+	}
+
+	if client.IsPublic() {
+		_, err = fmt.Printf("Client ID: %s\n", client.ClientId)
+		return err
+	}
+
+	_, err = fmt.Printf("Client ID: %s\nClient secret: %s\nThe secret is only shown once, store it somewhere safe.\n", client.ClientId, client.Secret)
+	return err
+}
@@ -0,0 +1,8 @@
+package client
+
+// OpenID Connect clients, i.e. apps which log users in with authfish.
+type ClientCmd struct {
+	List   ListCmd   `cmd:"" default:""`
+	Add    AddCmd    `cmd:"" aliases:"create"`
+	Remove RemoveCmd `cmd:"" aliases:"rm,del,delete"`
+}
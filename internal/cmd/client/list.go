@@ -0,0 +1,36 @@
+package client
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	clients, err := database.ListOidcClients(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Client ID", "Name", "Type", "Redirect URIs", "Created At")
+
+	for _, c := range clients {
+		clientType := "confidential"
+		if c.IsPublic() {
+			clientType = "public"
+		}
+
+		table.AddRow(c.ClientId, c.Name, clientType, c.RedirectUris, c.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
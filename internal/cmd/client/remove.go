@@ -0,0 +1,24 @@
+package client
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RemoveCmd struct {
+	ClientId string `arg:""`
+}
+
+func (r *RemoveCmd) Run(ctx *context.AppContext) error {
+	err := database.DeleteOidcClient(ctx.Db, r.ClientId)
+
+	if err != nil {
+		fmt.Printf("Error deleting client %s: %v\n", r.ClientId, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Deleted client %s\n", r.ClientId)
+	return err
+}
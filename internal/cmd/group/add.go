@@ -0,0 +1,24 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type AddCmd struct {
+	Name string `arg:""`
+}
+
+func (r *AddCmd) Run(ctx *context.AppContext) error {
+	g, err := database.CreateGroup(ctx.Db, r.Name)
+
+	if err != nil {
+		fmt.Printf("Error adding new group: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Added group %s\n", g.Name)
+	return err
+}
@@ -0,0 +1,32 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type AddMemberCmd struct {
+	Group    string `arg:""`
+	Username string `arg:""`
+}
+
+func (r *AddMemberCmd) Run(ctx *context.AppContext) error {
+	g, u, err := findGroupAndUser(ctx, r.Group, r.Username)
+
+	if err != nil {
+		fmt.Printf("Error adding group member: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = database.AddGroupMember(ctx.Db, *g, *u)
+
+	if err != nil {
+		fmt.Printf("Error adding group member: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Added %s to %s\n", u.Username, g.Name)
+	return err
+}
@@ -0,0 +1,42 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/group"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+	"fmt"
+)
+
+type GroupCmd struct {
+	List         ListCmd         `cmd:"" default:""`
+	Add          AddCmd          `cmd:"" aliases:"create"`
+	Remove       RemoveCmd       `cmd:"" aliases:"rm,del,delete"`
+	AddMember    AddMemberCmd    `cmd:""`
+	RemoveMember RemoveMemberCmd `cmd:""`
+}
+
+func findGroupAndUser(ctx *context.AppContext, groupName string, username string) (*group.Group, *user.User, error) {
+	g, err := database.FindGroupByName(ctx.Db, groupName)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if g == nil {
+		return nil, nil, fmt.Errorf("group does not exist: %s", groupName)
+	}
+
+	u, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(username))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u == nil {
+		return nil, nil, fmt.Errorf("user does not exist: %s", username)
+	}
+
+	return g, u, nil
+}
@@ -0,0 +1,42 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"strings"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	groups, err := database.ListGroups(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Id", "Name", "Members", "Created At")
+
+	for _, g := range groups {
+		members, err := database.ListGroupMembers(ctx.Db, g)
+		if err != nil {
+			return err
+		}
+
+		usernames := make([]string, 0, len(members))
+		for _, member := range members {
+			usernames = append(usernames, member.Username)
+		}
+
+		table.AddRow(g.Id, g.Name, strings.Join(usernames, ","), g.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
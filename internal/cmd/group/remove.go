@@ -0,0 +1,26 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type RemoveCmd struct {
+	Name string `arg:""`
+}
+
+func (r *RemoveCmd) Run(ctx *context.AppContext) error {
+	name := utils.NormalizeGroupName(r.Name)
+	err := database.DeleteGroup(ctx.Db, name)
+
+	if err != nil {
+		fmt.Printf("Error deleting group %s: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Deleted group %s\n", name)
+	return err
+}
@@ -0,0 +1,32 @@
+package group
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RemoveMemberCmd struct {
+	Group    string `arg:""`
+	Username string `arg:""`
+}
+
+func (r *RemoveMemberCmd) Run(ctx *context.AppContext) error {
+	g, u, err := findGroupAndUser(ctx, r.Group, r.Username)
+
+	if err != nil {
+		fmt.Printf("Error removing group member: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = database.RemoveGroupMember(ctx.Db, *g, *u)
+
+	if err != nil {
+		fmt.Printf("Error removing group member: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Removed %s from %s\n", u.Username, g.Name)
+	return err
+}
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/policy"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type AddCmd struct {
+	Host    string `arg:"" help:"Host the policy applies to, e.g. app.example.com"`
+	Kind    string `arg:"" enum:"allow-user,allow-group,deny-user,allow-anonymous" help:"One of allow-user,allow-group,deny-user,allow-anonymous"`
+	Subject string `arg:"" optional:"" help:"Username or group name the policy applies to. Not used by allow-anonymous."`
+	Path    string `help:"Only apply the policy to paths starting with this prefix" default:"/"`
+}
+
+func (r *AddCmd) Run(ctx *context.AppContext) error {
+	kind := policy.Kind(r.Kind)
+
+	subject, err := r.validateSubject(ctx, kind)
+
+	if err != nil {
+		fmt.Printf("Error adding policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	newPolicy, err := database.CreatePolicy(ctx.Db, r.Host, r.Path, kind, subject)
+
+	if err != nil {
+		fmt.Printf("Error adding policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Added policy %d\n", newPolicy.Id)
+	return err
+}
+
+func (r *AddCmd) validateSubject(ctx *context.AppContext, kind policy.Kind) (*string, error) {
+	if kind == policy.AllowAnonymous {
+		if len(r.Subject) != 0 {
+			return nil, fmt.Errorf("%s policies do not take a subject", kind)
+		}
+		return nil, nil
+	}
+
+	if kind == policy.AllowGroup {
+		return r.validateGroup(ctx)
+	}
+
+	username := utils.NormalizeUsername(r.Subject)
+
+	if len(username) == 0 {
+		return nil, fmt.Errorf("%s policies require a username", kind)
+	}
+
+	user, err := database.FindUserByUsername(ctx.Db, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, fmt.Errorf("user does not exist: %s", username)
+	}
+
+	return &user.Username, nil
+}
+
+func (r *AddCmd) validateGroup(ctx *context.AppContext) (*string, error) {
+	name := utils.NormalizeGroupName(r.Subject)
+
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%s policies require a group name", policy.AllowGroup)
+	}
+
+	g, err := database.FindGroupByName(ctx.Db, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if g == nil {
+		return nil, fmt.Errorf("group does not exist: %s", name)
+	}
+
+	return &g.Name, nil
+}
@@ -0,0 +1,36 @@
+package policy
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	policies, err := database.ListPolicies(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Id", "Host", "Path Prefix", "Kind", "Subject", "Created At")
+
+	for _, p := range policies {
+		subject := ""
+		if p.Subject != nil {
+			subject = *p.Subject
+		}
+
+		table.AddRow(p.Id, p.Host, p.PathPrefix, p.Kind, subject, p.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
@@ -0,0 +1,7 @@
+package policy
+
+type PolicyCmd struct {
+	List   ListCmd   `cmd:"" default:""`
+	Add    AddCmd    `cmd:"" aliases:"create"`
+	Remove RemoveCmd `cmd:"" aliases:"rm,del,delete"`
+}
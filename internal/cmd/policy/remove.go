@@ -0,0 +1,24 @@
+package policy
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RemoveCmd struct {
+	Id int64 `arg:""`
+}
+
+func (r *RemoveCmd) Run(ctx *context.AppContext) error {
+	err := database.DeletePolicy(ctx.Db, r.Id)
+
+	if err != nil {
+		fmt.Printf("Error deleting policy %d: %v\n", r.Id, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Deleted policy %d\n", r.Id)
+	return err
+}
@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/federated"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type AddCmd struct {
+	Name             string   `arg:"" help:"Shown on the login page as \"Sign in with <name>\"."`
+	Issuer           string   `help:"OpenID Connect issuer URL. Endpoints are discovered from it."`
+	ClientId         string   `help:"Client ID registered with the provider." required:""`
+	ClientSecret     string   `help:"Client secret registered with the provider." required:""`
+	AuthorizationUrl string   `help:"Authorization endpoint, for providers without discovery."`
+	TokenUrl         string   `help:"Token endpoint, for providers without discovery."`
+	UserinfoUrl      string   `help:"Userinfo endpoint, for providers without discovery."`
+	JwksUrl          string   `help:"JWKS endpoint, for providers without discovery."`
+	Scope            []string `help:"Scope to request. Repeat for more scopes. Defaults to openid and profile."`
+	SubjectClaim     string   `help:"Claim which identifies the user at the provider." default:"sub"`
+	UsernameClaim    string   `help:"Claim with the username at the provider." default:"preferred_username"`
+	Mapping          string   `help:"What to do when an unlinked identity logs in: link (refuse, users link accounts from /me), username (use the user with the same username) or create (create a user awaiting approval)." default:"link" enum:"link,username,create"`
+}
+
+func (r *AddCmd) Run(ctx *context.AppContext) error {
+	provider := federated.Provider{
+		Name:             r.Name,
+		Issuer:           r.Issuer,
+		ClientId:         r.ClientId,
+		ClientSecret:     r.ClientSecret,
+		AuthorizationUrl: r.AuthorizationUrl,
+		TokenUrl:         r.TokenUrl,
+		UserinfoUrl:      r.UserinfoUrl,
+		JwksUrl:          r.JwksUrl,
+		Scopes:           strings.Join(r.Scope, " "),
+		SubjectClaim:     r.SubjectClaim,
+		UsernameClaim:    r.UsernameClaim,
+		Mapping:          r.Mapping,
+	}
+
+	if len(r.Issuer) > 0 {
+		discovery, err := federated.Discover(r.Issuer)
+
+		if err != nil {
+			fmt.Printf("Error discovering endpoints of %s: %v\n", r.Issuer, err)
+			os.Exit(1)
+		}
+
+		if len(provider.AuthorizationUrl) == 0 {
+			provider.AuthorizationUrl = discovery.AuthorizationEndpoint
+		}
+
+		if len(provider.TokenUrl) == 0 {
+			provider.TokenUrl = discovery.TokenEndpoint
+		}
+
+		if len(provider.UserinfoUrl) == 0 {
+			provider.UserinfoUrl = discovery.UserinfoEndpoint
+		}
+
+		if len(provider.JwksUrl) == 0 {
+			provider.JwksUrl = discovery.JwksUri
+		}
+	}
+
+	_, err := database.CreateIdentityProvider(ctx.Db, provider)
+
+	if err != nil {
+		fmt.Printf("Error adding provider: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Added provider %s\n", provider.Name)
+	return err
+}
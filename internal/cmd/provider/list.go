@@ -0,0 +1,36 @@
+package provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	providers, err := database.ListIdentityProviders(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Name", "Type", "Issuer", "Client ID", "Scopes", "Mapping", "Created At")
+
+	for _, p := range providers {
+		providerType := "oauth2"
+		if p.IsOidc() {
+			providerType = "oidc"
+		}
+
+		table.AddRow(p.Name, providerType, p.Issuer, p.ClientId, p.Scopes, p.Mapping, p.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
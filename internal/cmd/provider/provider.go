@@ -0,0 +1,8 @@
+package provider
+
+// External identity providers users can log in with.
+type ProviderCmd struct {
+	List   ListCmd   `cmd:"" default:""`
+	Add    AddCmd    `cmd:"" aliases:"create"`
+	Remove RemoveCmd `cmd:"" aliases:"rm,del,delete"`
+}
@@ -0,0 +1,24 @@
+package provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RemoveCmd struct {
+	Name string `arg:""`
+}
+
+func (r *RemoveCmd) Run(ctx *context.AppContext) error {
+	err := database.DeleteIdentityProvider(ctx.Db, r.Name)
+
+	if err != nil {
+		fmt.Printf("Error deleting provider %s: %v\n", r.Name, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Deleted provider %s and its linked accounts\n", r.Name)
+	return err
+}
@@ -2,21 +2,40 @@ package server
 
 import (
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"authfish/internal/authenticator"
 	"authfish/internal/context"
+	"authfish/internal/ldap_server"
+	"authfish/internal/oidc"
+	"authfish/internal/saml"
+	"authfish/internal/web/admin"
+	"authfish/internal/web/api_keys"
 	"authfish/internal/web/check"
+	"authfish/internal/web/csrf"
 	"authfish/internal/web/current_user"
+	"authfish/internal/web/federated_login"
+	"authfish/internal/web/key_usage"
 	"authfish/internal/web/login"
 	"authfish/internal/web/me"
+	"authfish/internal/web/oidc_provider"
+	"authfish/internal/web/passkey"
+	"authfish/internal/web/password"
 	"authfish/internal/web/register"
+	"authfish/internal/web/saml_provider"
 	"authfish/internal/web/session"
+	"authfish/internal/web/two_factor"
+	"authfish/internal/web/user_sessions"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -24,15 +43,118 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+const (
+	keyUsageFlushInterval = 10 * time.Second
+)
+
 type ServerCmd struct {
 	Host     string   `help:"Hostname or IP address to listen on, or path to socket if --protocol=unix" default:"127.0.0.1"`
 	Port     int      `help:"Port to listen on. Only applies when --protocol=tcp (the default)" default:"8080"`
 	Protocol string   `help:"One of tcp,unix" default:"tcp" enum:"tcp,unix"`
-	Domain   []string `help:"One or more domains to set cookies for. Must set X-Original-URL header when proxying. First domain which is a substring of the request host will be chosen."`
+	Domain   []string `help:"One or more domains to set cookies for. Must set X-Original-URL header when proxying. The first domain which is the request host or one of its parent domains will be chosen."`
 	Secure   bool     `help:"Set cookie to be secure (HTTPS) only. Defaults to secure." default:"true" negatable:""`
+
+	SessionLifetime    time.Duration `help:"How long a login lasts, regardless of activity." default:"720h"`
+	SessionIdleTimeout time.Duration `help:"How long a login lasts without any requests to /check." default:"168h"`
+	TrustedProxyHeader string        `help:"Request header set by the reverse proxy containing the client IP address, e.g. X-Real-IP. Only set this if the proxy always overwrites or appends to the header."`
+
+	OpenRegistration bool `help:"Let anyone sign up on /register without a registration token. New accounts can't log in until approved with 'authfish user approve'."`
+
+	OidcIssuer string `help:"Act as an OpenID Connect provider for clients added with 'authfish client add'. Set to the public URL of authfish, e.g. https://auth.example.com."`
+
+	SamlIdpUrl string `help:"Act as a SAML 2.0 identity provider for service providers added with 'authfish service-provider add'. Set to the public URL of authfish, e.g. https://auth.example.com. The metadata is served on /saml/metadata."`
+
+	LdapUrl          string `help:"Check passwords of users who are not in the local database against this LDAP server, e.g. ldaps://ldap.example.com. Users are created locally on their first login."`
+	LdapStartTls     bool   `help:"Upgrade ldap:// connections to TLS with StartTLS."`
+	LdapBindDn       string `help:"DN to bind as when searching for users. Searches anonymously if not set."`
+	LdapBindPassword string `help:"Password of --ldap-bind-dn." env:"AUTHFISH_LDAP_BIND_PASSWORD"`
+	LdapBaseDn       string `help:"Where to search for users, e.g. ou=people,dc=example,dc=com."`
+	LdapUserFilter   string `help:"Filter which finds a user by username." default:"(uid={username})"`
+	LdapGroupBaseDn  string `help:"Where to search for groups. Defaults to --ldap-base-dn."`
+	LdapGroupFilter  string `help:"Filter which finds the groups of a user, by {username} or {dn}. Local group memberships of LDAP users are replaced with the common names of these groups on every login. Set to an empty string to not sync groups." default:"(|(member={dn})(uniqueMember={dn})(memberUid={username}))"`
+
+	LdapServerAddress string `help:"Also serve users and groups read-only over LDAP on this address, e.g. 127.0.0.1:3890. Apps bind as uid=<username>,ou=people,<base DN> with a password or an API key."`
+	LdapServerBaseDn  string `help:"Base DN of the LDAP directory served on --ldap-server-address." default:"dc=authfish"`
+	LdapServerTlsCert string `help:"Certificate file to serve LDAPS with. Serves plain LDAP if not set."`
+	LdapServerTlsKey  string `help:"Private key file of --ldap-server-tls-cert."`
+
+	UserHeader       string `help:"Response header on /check containing the username of the authenticated user. Set to an empty string to disable." default:"X-Authfish-User"`
+	UserIdHeader     string `help:"Response header on /check containing the ID of the authenticated user. Set to an empty string to disable." default:"X-Authfish-User-Id"`
+	GroupsHeader     string `help:"Response header on /check containing a comma separated list of the authenticated user's groups. Set to an empty string to disable." default:"X-Authfish-Groups"`
+	AuthMethodHeader string `help:"Response header on /check containing how the user authenticated (session, basic or bearer). Set to an empty string to disable." default:"X-Authfish-Auth-Method"`
 }
 
 func (r *ServerCmd) Run(ctx *context.AppContext) error {
+	for i, domain := range r.Domain {
+		validDomain, err := session.ValidateDomain(domain)
+
+		if err != nil {
+			return fmt.Errorf("invalid --domain: %w", err)
+		}
+
+		r.Domain[i] = validDomain
+	}
+
+	r.warnAboutUncoveredHosts(ctx.BaseUrl)
+
+	var oidcSigningKey *oidc.SigningKey
+
+	if len(r.OidcIssuer) > 0 {
+		if err := validateBaseUrl("--oidc-issuer", r.OidcIssuer); err != nil {
+			return err
+		}
+
+		// Kept next to secret_key, so that tokens stay valid across restarts
+		var err error
+		oidcSigningKey, err = oidc.LoadOrCreateSigningKey(filepath.Join(ctx.DataDir, "oidc_signing_key.pem"))
+
+		if err != nil {
+			return fmt.Errorf("could not load OpenID Connect signing key: %w", err)
+		}
+	}
+
+	var samlKeyPair *saml.KeyPair
+
+	if len(r.SamlIdpUrl) > 0 {
+		if err := validateBaseUrl("--saml-idp-url", r.SamlIdpUrl); err != nil {
+			return err
+		}
+
+		var err error
+		samlKeyPair, err = saml.LoadOrCreateKeyPair(filepath.Join(ctx.DataDir, "saml_signing_key.pem"), filepath.Join(ctx.DataDir, "saml_certificate.pem"))
+
+		if err != nil {
+			return fmt.Errorf("could not load SAML signing key: %w", err)
+		}
+	}
+
+	authenticators := authenticator.Chain{authenticator.NewLocal(ctx.Db)}
+
+	if len(r.LdapUrl) > 0 {
+		ldapConfig := authenticator.LdapConfig{
+			Url:          r.LdapUrl,
+			StartTls:     r.LdapStartTls,
+			BindDn:       r.LdapBindDn,
+			BindPassword: r.LdapBindPassword,
+			BaseDn:       r.LdapBaseDn,
+			UserFilter:   r.LdapUserFilter,
+			GroupBaseDn:  r.LdapGroupBaseDn,
+			GroupFilter:  r.LdapGroupFilter,
+		}
+
+		if err := ldapConfig.Validate(); err != nil {
+			return fmt.Errorf("invalid LDAP options: %w", err)
+		}
+
+		authenticators = append(authenticators, authenticator.NewLdap(ctx.Db, ldapConfig))
+	}
+
+	if len(r.LdapServerAddress) > 0 {
+		if err := r.startLdapServer(ctx, authenticators); err != nil {
+			return fmt.Errorf("could not start LDAP server: %w", err)
+		}
+	}
+
 	listenAddress := buildListenAddress(r.Host, r.Port, r.Protocol)
 	listener, err := net.Listen(r.Protocol, listenAddress)
 
@@ -46,10 +168,22 @@ func (r *ServerCmd) Run(ctx *context.AppContext) error {
 	if err != nil {
 		panic(err)
 	}
-	var sessionStore = sessions.NewCookieStore(sk.authToken[:], sk.encryptionToken[:])
+	var sessionStore = session.NewSqliteStore(ctx.Db, sk.authToken[:], sk.encryptionToken[:])
 	sessionStore.Options.SameSite = http.SameSiteStrictMode
 	sessionStore.Options.Secure = r.Secure
 	sessionStore.Options.HttpOnly = true
+	sessionStore.BrowserSessionMaxAge = int(r.SessionIdleTimeout.Seconds())
+	sessionStore.TrustedProxyHeader = r.TrustedProxyHeader
+
+	// Only holds the state of logins with external identity providers, which
+	// must survive the redirect back from the provider.
+	federatedStateStore := sessions.NewCookieStore(sk.authToken[:], sk.encryptionToken[:])
+	federatedStateStore.MaxAge(federated_login.StateLifetime)
+	federatedStateStore.Options.SameSite = http.SameSiteLaxMode
+	federatedStateStore.Options.Secure = r.Secure
+	federatedStateStore.Options.HttpOnly = true
+
+	lifetime := r.sessionLifetime()
 
 	handler := handlers.RecoveryHandler()(
 		handlers.CombinedLoggingHandler(
@@ -57,7 +191,25 @@ func (r *ServerCmd) Run(ctx *context.AppContext) error {
 			current_user.AddCurrentUserToRequestContext(
 				ctx.Db,
 				sessionStore,
-				buildRoutes(ctx.Db, sessionStore, r.Domain),
+				lifetime,
+				key_usage.New(ctx.Db, r.TrustedProxyHeader, keyUsageFlushInterval),
+				buildRoutes(routesConfig{
+					Db:                  ctx.Db,
+					Store:               sessionStore,
+					FederatedStateStore: federatedStateStore,
+					BaseUrl:             ctx.BaseUrl,
+					Authenticator:       authenticators,
+					Domains:             r.Domain,
+					Secure:              r.Secure,
+					Lifetime:            lifetime,
+					TrustedProxyHeader:  r.TrustedProxyHeader,
+					OpenRegistration:    r.OpenRegistration,
+					OidcIssuer:          r.OidcIssuer,
+					OidcSigningKey:      oidcSigningKey,
+					SamlIdpUrl:          r.SamlIdpUrl,
+					SamlKeyPair:         samlKeyPair,
+					IdentityHeaders:     r.identityHeaders(),
+				}),
 			),
 		),
 	)
@@ -65,6 +217,45 @@ func (r *ServerCmd) Run(ctx *context.AppContext) error {
 	return http.Serve(listener, handler)
 }
 
+func (r *ServerCmd) startLdapServer(ctx *context.AppContext, authenticator authenticator.Authenticator) error {
+	ldapServer, err := ldap_server.New(ctx.Db, authenticator, r.LdapServerBaseDn)
+
+	if err != nil {
+		return fmt.Errorf("invalid base DN: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", r.LdapServerAddress)
+
+	if err != nil {
+		return err
+	}
+
+	scheme := "ldap"
+
+	if len(r.LdapServerTlsCert) > 0 || len(r.LdapServerTlsKey) > 0 {
+		certificate, err := tls.LoadX509KeyPair(r.LdapServerTlsCert, r.LdapServerTlsKey)
+
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("could not load TLS certificate: %w", err)
+		}
+
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{certificate}})
+		scheme = "ldaps"
+	}
+
+	log.Printf("Authfish LDAP server listening on %s://%s", scheme, r.LdapServerAddress)
+
+	// The web server keeps running if the LDAP server stops
+	go func() {
+		if err := ldapServer.Serve(listener); err != nil {
+			log.Printf("LDAP server stopped: %v", err)
+		}
+	}()
+
+	return nil
+}
+
 type secretKey struct {
 	authToken       [64]byte // As per the gorilla session docs, use 32 or 64 bytes. Going with 64.
 	encryptionToken [32]byte // As per the gorilla session docs, 32 bytes selects AES-256
@@ -103,30 +294,175 @@ func generateSecretKey(dataDir string) (secretKey, error) {
 	return sk, nil
 }
 
-func buildRoutes(db *sqlx.DB, store sessions.Store, domains []string) *mux.Router {
+func (r *ServerCmd) identityHeaders() check.IdentityHeaders {
+	return check.IdentityHeaders{
+		User:       r.UserHeader,
+		UserId:     r.UserIdHeader,
+		Groups:     r.GroupsHeader,
+		AuthMethod: r.AuthMethodHeader,
+	}
+}
+
+// Hosts outside every --domain only get a cookie for themselves, so users have
+// to log in to each of them separately. That is easy to miss, so the URLs
+// authfish knows about are checked once here.
+func (r *ServerCmd) warnAboutUncoveredHosts(baseUrl *url.URL) {
+	if len(r.Domain) == 0 {
+		return
+	}
+
+	urls := []string{r.OidcIssuer, r.SamlIdpUrl}
+
+	if baseUrl != nil {
+		urls = append(urls, baseUrl.String())
+	}
+
+	for _, rawUrl := range urls {
+		parsedUrl, err := url.Parse(rawUrl)
+
+		if err != nil || len(parsedUrl.Hostname()) == 0 {
+			continue
+		}
+
+		if session.MatchingDomain(r.Domain, parsedUrl.Hostname()) == nil {
+			log.Printf(
+				"Warning: %s is not covered by any configured domain (%s), its cookie will only be sent to that host",
+				parsedUrl.Hostname(),
+				strings.Join(r.Domain, ","),
+			)
+		}
+	}
+}
+
+func (r *ServerCmd) sessionLifetime() session.Lifetime {
+	return session.Lifetime{
+		Absolute: r.SessionLifetime,
+		Idle:     r.SessionIdleTimeout,
+	}
+}
+
+// Everything the routes of the web server depend on.
+type routesConfig struct {
+	Db                  *sqlx.DB
+	Store               sessions.Store
+	FederatedStateStore sessions.Store
+	BaseUrl             *url.URL
+	Authenticator       authenticator.Authenticator
+	Domains             []string
+	Secure              bool
+	Lifetime            session.Lifetime
+	TrustedProxyHeader  string
+	OpenRegistration    bool
+	OidcIssuer          string
+	OidcSigningKey      *oidc.SigningKey // Nil if the OpenID Connect provider is disabled
+	SamlIdpUrl          string
+	SamlKeyPair         *saml.KeyPair // Nil if the SAML identity provider is disabled
+	IdentityHeaders     check.IdentityHeaders
+}
+
+func buildRoutes(c routesConfig) *mux.Router {
 	r := mux.NewRouter()
 
-	registrationHandler := register.New(store, db, domains)
+	// /check is exempt because nginx forwards the method of the request it is
+	// checking, and does not change anything. The OpenID Connect endpoints
+	// used by clients directly authenticate with client secrets and tokens
+	// instead of cookies. The federated login callback is protected by its
+	// state parameter, and must not touch the session cookie, which the browser
+	// does not send along with the redirect from the provider. SAML service
+	// providers post requests from their own sites, and only get a response
+	// for users who are already logged in.
+	r.Use(csrf.Middleware(
+		c.Store,
+		c.Domains,
+		"/check",
+		federated_login.CallbackPath,
+		oidc_provider.DiscoveryPath,
+		oidc_provider.JwksPath,
+		oidc_provider.TokenPath,
+		oidc_provider.UserinfoPath,
+		saml_provider.MetadataPath,
+		saml_provider.SingleSignOnPath,
+	))
+
+	registrationHandler := register.New(c.Store, c.Db, c.Domains, c.OpenRegistration)
 	r.Handle("/register", registrationHandler)
 
-	loginHandler := login.New(store, db, domains)
+	loginHandler := login.New(c.Store, c.Db, c.Domains, c.Lifetime, c.TrustedProxyHeader, c.BaseUrl, c.Authenticator)
 	r.Handle("/login", loginHandler)
 
-	checkHandler := check.New(store, db)
+	federatedLoginHandler := federated_login.New(c.Store, c.FederatedStateStore, c.Db, c.Domains, c.Lifetime, c.BaseUrl, c.Secure)
+	r.HandleFunc(federated_login.StartPath, federatedLoginHandler.Start).Methods(http.MethodGet)
+	r.HandleFunc(federated_login.CallbackPath, federatedLoginHandler.Callback).Methods(http.MethodGet)
+	r.HandleFunc(federated_login.IdentitiesPath, federatedLoginHandler.HandleIdentities)
+
+	checkHandler := check.New(c.Store, c.Db, c.Domains, c.Lifetime, c.IdentityHeaders)
 	r.Handle("/check", checkHandler)
 
-	meHandler := me.New(store, db)
+	meHandler := me.New(c.Store, c.Db)
 	r.Handle("/me", meHandler)
 
+	passwordHandler := password.New(c.Store, c.Db, c.TrustedProxyHeader)
+	r.Handle("/me/password", passwordHandler)
+
+	twoFactorHandler := two_factor.New(c.Store, c.Db)
+	r.Handle("/me/two-factor", twoFactorHandler)
+
+	// The login endpoints live under /login so that they are reachable through
+	// the same proxied path as the login form on protected hosts.
+	passkeyHandler := passkey.New(c.Store, c.Db, c.Domains, c.Secure, c.Lifetime)
+	r.Handle("/me/passkeys", passkeyHandler)
+	r.HandleFunc("/me/passkeys/register/begin", passkeyHandler.BeginRegistration).Methods(http.MethodPost)
+	r.HandleFunc("/me/passkeys/register/finish", passkeyHandler.FinishRegistration).Methods(http.MethodPost)
+	r.HandleFunc("/login/passkey/begin", passkeyHandler.BeginLogin).Methods(http.MethodPost)
+	r.HandleFunc("/login/passkey/finish", passkeyHandler.FinishLogin).Methods(http.MethodPost)
+
+	apiKeysHandler := api_keys.New(c.Store, c.Db)
+	r.Handle("/me/api-keys", apiKeysHandler)
+
+	userSessionsHandler := user_sessions.New(c.Store, c.Db)
+	r.Handle("/me/sessions", userSessionsHandler)
+
+	adminHandler := admin.New(c.Store, c.Db)
+	r.HandleFunc("/admin", adminHandler.ShowUsers).Methods(http.MethodGet)
+	r.HandleFunc("/admin", adminHandler.HandleAction).Methods(http.MethodPost)
+	r.HandleFunc("/admin/user", adminHandler.ShowUser).Methods(http.MethodGet)
+
+	if c.OidcSigningKey != nil {
+		oidcHandler := oidc_provider.New(c.Store, c.Db, c.OidcIssuer, c.OidcSigningKey)
+		r.HandleFunc(oidc_provider.DiscoveryPath, oidcHandler.Discovery).Methods(http.MethodGet)
+		r.HandleFunc(oidc_provider.JwksPath, oidcHandler.Jwks).Methods(http.MethodGet)
+		r.HandleFunc(oidc_provider.AuthorizationPath, oidcHandler.Authorize).Methods(http.MethodGet)
+		r.HandleFunc(oidc_provider.TokenPath, oidcHandler.Token)
+		r.HandleFunc(oidc_provider.UserinfoPath, oidcHandler.Userinfo).Methods(http.MethodGet, http.MethodPost)
+	}
+
+	if c.SamlKeyPair != nil {
+		samlHandler := saml_provider.New(c.Store, c.Db, c.SamlIdpUrl, c.SamlKeyPair)
+		r.HandleFunc(saml_provider.MetadataPath, samlHandler.Metadata).Methods(http.MethodGet)
+		r.HandleFunc(saml_provider.SingleSignOnPath, samlHandler.SingleSignOn).Methods(http.MethodGet, http.MethodPost)
+	}
+
 	r.Handle("/", meHandler)
 
 	r.HandleFunc("/logout", func(rw http.ResponseWriter, r *http.Request) {
-		session.DeleteSessionAndRedirectToLogin(rw, r, store)
+		session.DeleteSessionAndRedirectToLogin(rw, r, c.Store)
 	})
 
 	return r
 }
 
+// URLs which other parts of authfish's URLs are appended to, like the OpenID
+// Connect issuer, must not have a query or fragment.
+func validateBaseUrl(flag string, rawUrl string) error {
+	parsedUrl, err := url.Parse(rawUrl)
+
+	if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || len(parsedUrl.Host) == 0 || len(parsedUrl.RawQuery) > 0 || len(parsedUrl.Fragment) > 0 {
+		return fmt.Errorf("invalid %s: must be a http(s) URL without query or fragment: %s", flag, rawUrl)
+	}
+
+	return nil
+}
+
 func buildListenAddress(host string, port int, protocol string) string {
 	switch protocol {
 	case "tcp":
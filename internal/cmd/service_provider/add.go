@@ -0,0 +1,27 @@
+package service_provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type AddCmd struct {
+	EntityId  string   `arg:"" help:"Entity ID of the app, as sent in the Issuer of its requests."`
+	AcsUrl    []string `help:"Assertion consumer service URL the app receives responses at. Repeat for more URLs. Requests without a URL get the first one." required:""`
+	NameId    string   `help:"User field sent as the NameID. One of id, username, is_admin, source or created_at." default:"username"`
+	Attribute []string `help:"Attribute to send, as <name>=<field>. Fields are id, username, is_admin, source, created_at and groups, which has one value per group. Repeat for more attributes." default:"uid=username,groups=groups"`
+}
+
+func (r *AddCmd) Run(ctx *context.AppContext) error {
+	sp, err := database.CreateSamlServiceProvider(ctx.Db, r.EntityId, r.AcsUrl, r.NameId, r.Attribute)
+
+	if err != nil {
+		fmt.Printf("Error adding service provider: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Added service provider %s\n", sp.EntityId)
+	return err
+}
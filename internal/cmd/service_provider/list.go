@@ -0,0 +1,31 @@
+package service_provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	serviceProviders, err := database.ListSamlServiceProviders(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Entity ID", "ACS URLs", "NameID", "Attributes", "Created At")
+
+	for _, sp := range serviceProviders {
+		table.AddRow(sp.EntityId, sp.AcsUrls, sp.NameIdField, sp.Attributes, sp.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
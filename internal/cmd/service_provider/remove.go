@@ -0,0 +1,24 @@
+package service_provider
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RemoveCmd struct {
+	EntityId string `arg:""`
+}
+
+func (r *RemoveCmd) Run(ctx *context.AppContext) error {
+	err := database.DeleteSamlServiceProvider(ctx.Db, r.EntityId)
+
+	if err != nil {
+		fmt.Printf("Error deleting service provider %s: %v\n", r.EntityId, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Deleted service provider %s\n", r.EntityId)
+	return err
+}
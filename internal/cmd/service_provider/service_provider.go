@@ -0,0 +1,8 @@
+package service_provider
+
+// SAML service providers, i.e. apps which log users in with authfish over SAML.
+type ServiceProviderCmd struct {
+	List   ListCmd   `cmd:"" default:""`
+	Add    AddCmd    `cmd:"" aliases:"create"`
+	Remove RemoveCmd `cmd:"" aliases:"rm,del,delete"`
+}
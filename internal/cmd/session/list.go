@@ -0,0 +1,42 @@
+package session
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListCmd struct {
+}
+
+func (r *ListCmd) Run(ctx *context.AppContext) error {
+	userSessions, err := database.ListUserSessions(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	users, err := database.ListUsers(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	usernames := map[int64]string{}
+	for _, u := range users {
+		usernames[u.Id] = u.Username
+	}
+
+	table := uitable.New()
+	table.MaxColWidth = 60
+
+	table.AddRow("Id", "Username", "IP Address", "User Agent", "Created At", "Last Seen", "Expires At")
+
+	for _, s := range userSessions {
+		table.AddRow(s.Id, usernames[*s.UserId], s.IpAddress, s.UserAgent, s.CreatedAt, s.LastSeenAt, s.ExpiresAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
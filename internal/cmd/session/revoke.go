@@ -0,0 +1,24 @@
+package session
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+	"os"
+)
+
+type RevokeCmd struct {
+	Id int64 `arg:""`
+}
+
+func (r *RevokeCmd) Run(ctx *context.AppContext) error {
+	err := database.RevokeUserSession(ctx.Db, r.Id)
+
+	if err != nil {
+		fmt.Printf("Error revoking session %d: %v\n", r.Id, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Revoked session %d\n", r.Id)
+	return err
+}
@@ -0,0 +1,38 @@
+package session
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+// Log a user out everywhere, e.g. after their password may have leaked.
+type RevokeAllCmd struct {
+	Username string `arg:""`
+}
+
+func (r *RevokeAllCmd) Run(ctx *context.AppContext) error {
+	username := utils.NormalizeUsername(r.Username)
+	u, err := database.FindUserByUsername(ctx.Db, username)
+
+	if err == nil && u == nil {
+		err = fmt.Errorf("user does not exist: %s", username)
+	}
+
+	if err != nil {
+		fmt.Printf("Error revoking sessions for %s: %v\n", username, err)
+		os.Exit(1)
+	}
+
+	count, err := database.RevokeAllUserSessionsForUser(ctx.Db, *u)
+
+	if err != nil {
+		fmt.Printf("Error revoking sessions for %s: %v\n", username, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Revoked %d sessions for %s\n", count, username)
+	return err
+}
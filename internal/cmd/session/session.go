@@ -0,0 +1,7 @@
+package session
+
+type SessionCmd struct {
+	List      ListCmd      `cmd:"" default:""`
+	Revoke    RevokeCmd    `cmd:"" aliases:"rm,del,delete"`
+	RevokeAll RevokeAllCmd `cmd:""`
+}
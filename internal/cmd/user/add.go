@@ -10,11 +10,19 @@ import (
 
 type AddCmd struct {
 	Username string `arg:""`
+	Expires  string `help:"Date (2006-01-02) or duration from now (48h) after which the link stops working, or never." default:"never"`
 }
 
 func (r *AddCmd) Run(ctx *context.AppContext) error {
+	expiresAt, err := parseInviteExpiry(r.Expires)
+
+	if err != nil {
+		fmt.Printf("Error adding new user: %v\n", err)
+		os.Exit(1)
+	}
+
 	username := utils.NormalizeUsername(r.Username)
-	user, err := database.RegisterNewUser(ctx.Db, username)
+	user, err := database.RegisterNewUser(ctx.Db, username, expiresAt)
 
 	if err != nil {
 		fmt.Printf("Error adding new user: %v\n", err)
@@ -1,16 +1,20 @@
 package user
 
 import (
+	"authfish/internal/api_key"
 	"authfish/internal/context"
 	"authfish/internal/database"
 	"authfish/internal/utils"
 	"fmt"
 	"os"
+	"time"
 )
 
 type AddKeyCmd struct {
-	Username string `arg:""`
-	Memo     string `arg:""`
+	Username string   `arg:""`
+	Memo     string   `arg:""`
+	Expires  string   `help:"Date (2006-01-02) or duration from now (720h) after which the key stops working. Default: never."`
+	Scope    []string `help:"Restrict the key to a host, optionally with a path prefix (e.g. wiki.example.com/api), or to read-only requests with read-only. Repeat for more scopes."`
 }
 
 func (r *AddKeyCmd) Run(ctx *context.AppContext) error {
@@ -26,7 +30,28 @@ func (r *AddKeyCmd) Run(ctx *context.AppContext) error {
 		os.Exit(1)
 	}
 
-	apiKey, err := database.CreateApiKey(ctx.Db, *user, r.Memo)
+	var expiresAt *time.Time
+
+	if len(r.Expires) > 0 {
+		parsed, err := api_key.ParseExpiry(r.Expires, time.Now())
+
+		if err != nil {
+			fmt.Printf("Error adding api key: %v\n", err)
+			os.Exit(1)
+		}
+
+		parsed = parsed.UTC().Truncate(time.Second)
+		expiresAt = &parsed
+	}
+
+	scopes, err := api_key.NormalizeScopes(r.Scope)
+
+	if err != nil {
+		fmt.Printf("Error adding api key: %v\n", err)
+		os.Exit(1)
+	}
+
+	apiKey, err := database.CreateApiKey(ctx.Db, *user, r.Memo, expiresAt, scopes)
 
 	if err != nil {
 		fmt.Printf("Error adding api key: %v\n", err)
@@ -38,7 +63,7 @@ func (r *AddKeyCmd) Run(ctx *context.AppContext) error {
 		os.Exit(1)
 	}
 
-	_, err = fmt.Printf("Key: %s", apiKey.Key)
+	_, err = fmt.Printf("Key: %s\nThis key is only shown once, store it somewhere safe.\n", apiKey.Key)
 
 	return err
 }
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type ApproveCmd struct {
+	Username string `arg:""`
+}
+
+func (r *ApproveCmd) Run(ctx *context.AppContext) error {
+	u := findPendingUser(ctx, r.Username)
+
+	if err := database.ApproveUser(ctx.Db, *u); err != nil {
+		fmt.Printf("Error approving user %s: %v\n", u.Username, err)
+		os.Exit(1)
+	}
+
+	_, err := fmt.Printf("Approved user %s\n", u.Username)
+	return err
+}
+
+type RejectCmd struct {
+	Username string `arg:""`
+}
+
+// Rejecting a sign up deletes the account, so the username can be used again.
+func (r *RejectCmd) Run(ctx *context.AppContext) error {
+	u := findPendingUser(ctx, r.Username)
+
+	if err := database.DeleteUser(ctx.Db, u.Username); err != nil {
+		fmt.Printf("Error rejecting user %s: %v\n", u.Username, err)
+		os.Exit(1)
+	}
+
+	_, err := fmt.Printf("Rejected user %s\n", u.Username)
+	return err
+}
+
+func findPendingUser(ctx *context.AppContext, username string) *user.User {
+	u, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(username))
+
+	if err != nil {
+		fmt.Printf("Error finding user %s: %v\n", username, err)
+		os.Exit(1)
+	}
+
+	if u == nil {
+		fmt.Printf("User does not exist: %s\n", username)
+		os.Exit(1)
+	}
+
+	if u.Status != user.StatusPending {
+		fmt.Printf("User %s is not waiting for approval\n", u.Username)
+		os.Exit(1)
+	}
+
+	return u
+}
@@ -0,0 +1,62 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type DisableCmd struct {
+	Username string `arg:""`
+}
+
+// Unlike remove, this keeps the user's API keys, groups and passkeys around.
+func (r *DisableCmd) Run(ctx *context.AppContext) error {
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(r.Username))
+
+	if err != nil {
+		fmt.Printf("Error disabling user %s: %v\n", r.Username, err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", r.Username)
+		os.Exit(1)
+	}
+
+	if err := database.DisableUser(ctx.Db, *user); err != nil {
+		fmt.Printf("Error disabling user %s: %v\n", user.Username, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Disabled user %s\n", user.Username)
+	return err
+}
+
+type EnableCmd struct {
+	Username string `arg:""`
+}
+
+func (r *EnableCmd) Run(ctx *context.AppContext) error {
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(r.Username))
+
+	if err != nil {
+		fmt.Printf("Error enabling user %s: %v\n", r.Username, err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", r.Username)
+		os.Exit(1)
+	}
+
+	if err := database.EnableUser(ctx.Db, *user); err != nil {
+		fmt.Printf("Error enabling user %s: %v\n", user.Username, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Enabled user %s\n", user.Username)
+	return err
+}
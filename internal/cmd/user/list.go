@@ -19,10 +19,27 @@ func (r *ListCmd) Run(ctx *context.AppContext) error {
 
 	table := uitable.New()
 
-	table.AddRow("Id", "Username", "Registration URL", "Created At", "Updated At")
+	table.AddRow("Id", "Username", "Source", "Status", "Admin", "Disabled", "Registration URL", "Registration Expires At", "Created At", "Updated At")
 
 	for _, user := range users {
-		table.AddRow(user.Id, user.Username, buildRegistrationURL(ctx.BaseUrl, user.RegistrationToken), user.CreatedAt, user.UpdatedAt)
+		registrationUrl := buildRegistrationURL(ctx.BaseUrl, user.RegistrationToken)
+		if user.RegistrationToken != nil && user.RegistrationTokenExpired() {
+			registrationUrl = "<expired>"
+		}
+
+		expiresAt := "never"
+		if user.RegistrationToken == nil {
+			expiresAt = ""
+		} else if user.RegistrationTokenExpiresAt != nil {
+			expiresAt = user.RegistrationTokenExpiresAt.String()
+		}
+
+		disabledAt := ""
+		if user.DisabledAt != nil {
+			disabledAt = user.DisabledAt.String()
+		}
+
+		table.AddRow(user.Id, user.Username, user.Source, user.Status, user.IsAdmin, disabledAt, registrationUrl, expiresAt, user.CreatedAt, user.UpdatedAt)
 	}
 
 	_, err = fmt.Println(table)
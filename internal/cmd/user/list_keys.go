@@ -0,0 +1,56 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+
+	"github.com/gosuri/uitable"
+)
+
+type ListKeysCmd struct {
+	Username string `arg:""`
+}
+
+func (r *ListKeysCmd) Run(ctx *context.AppContext) error {
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(r.Username))
+
+	if err != nil {
+		fmt.Printf("Error listing api keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", r.Username)
+		os.Exit(1)
+	}
+
+	apiKeys, err := database.ListApiKeys(ctx.Db, *user)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Id", "Memo", "Prefix", "Scopes", "Created At", "Expires At", "Last Seen", "Uses", "Last IP Address")
+
+	for _, k := range apiKeys {
+		lastSeen := "never"
+		if k.LastSeen != nil {
+			lastSeen = k.LastSeen.String()
+		}
+
+		expiresAt := "never"
+		if k.ExpiresAt != nil {
+			expiresAt = k.ExpiresAt.String()
+		}
+
+		table.AddRow(k.Id, k.Memo, k.Prefix, k.Scopes, k.CreatedAt, expiresAt, lastSeen, k.UseCount, k.LastIp)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"fmt"
+
+	"github.com/gosuri/uitable"
+)
+
+type PendingCmd struct {
+}
+
+func (r *PendingCmd) Run(ctx *context.AppContext) error {
+	users, err := database.ListPendingUsers(ctx.Db)
+	if err != nil {
+		return err
+	}
+
+	table := uitable.New()
+
+	table.AddRow("Id", "Username", "Signed Up At")
+
+	for _, user := range users {
+		table.AddRow(user.Id, user.Username, user.CreatedAt)
+	}
+
+	_, err = fmt.Println(table)
+
+	return err
+}
@@ -0,0 +1,53 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type PromoteCmd struct {
+	Username string `arg:""`
+}
+
+// Give a user access to the admin pages at /admin.
+func (r *PromoteCmd) Run(ctx *context.AppContext) error {
+	return setAdmin(ctx, r.Username, true)
+}
+
+type DemoteCmd struct {
+	Username string `arg:""`
+}
+
+func (r *DemoteCmd) Run(ctx *context.AppContext) error {
+	return setAdmin(ctx, r.Username, false)
+}
+
+func setAdmin(ctx *context.AppContext, username string, isAdmin bool) error {
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(username))
+
+	if err != nil {
+		fmt.Printf("Error finding user %s: %v\n", username, err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", username)
+		os.Exit(1)
+	}
+
+	if err := database.SetUserAdmin(ctx.Db, *user, isAdmin); err != nil {
+		fmt.Printf("Error updating user %s: %v\n", user.Username, err)
+		os.Exit(1)
+	}
+
+	if isAdmin {
+		_, err = fmt.Printf("%s is now an admin\n", user.Username)
+	} else {
+		_, err = fmt.Printf("%s is no longer an admin\n", user.Username)
+	}
+
+	return err
+}
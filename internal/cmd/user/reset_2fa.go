@@ -0,0 +1,37 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type Reset2faCmd struct {
+	Username string `arg:""`
+}
+
+func (r *Reset2faCmd) Run(ctx *context.AppContext) error {
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(r.Username))
+
+	if err != nil {
+		fmt.Printf("Error resetting two-factor authentication: %v\n", err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", r.Username)
+		os.Exit(1)
+	}
+
+	err = database.DeleteTotpCredential(ctx.Db, *user)
+
+	if err != nil {
+		fmt.Printf("Error resetting two-factor authentication: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Reset two-factor authentication for %s\n", user.Username)
+	return err
+}
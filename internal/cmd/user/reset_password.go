@@ -0,0 +1,45 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+type ResetPasswordCmd struct {
+	Username string `arg:""`
+	Expires  string `help:"Date (2006-01-02) or duration from now (48h) after which the link stops working, or never." default:"48h"`
+}
+
+func (r *ResetPasswordCmd) Run(ctx *context.AppContext) error {
+	expiresAt, err := parseInviteExpiry(r.Expires)
+
+	if err != nil {
+		fmt.Printf("Error resetting password: %v\n", err)
+		os.Exit(1)
+	}
+
+	user, err := database.FindUserByUsername(ctx.Db, utils.NormalizeUsername(r.Username))
+
+	if err != nil {
+		fmt.Printf("Error resetting password: %v\n", err)
+		os.Exit(1)
+	}
+
+	if user == nil {
+		fmt.Printf("User does not exist: %s\n", r.Username)
+		os.Exit(1)
+	}
+
+	token, err := database.ReissueRegistrationToken(ctx.Db, *user, expiresAt)
+
+	if err != nil {
+		fmt.Printf("Error resetting password: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Println(buildRegistrationURL(ctx.BaseUrl, &token))
+	return err
+}
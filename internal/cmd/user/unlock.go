@@ -0,0 +1,40 @@
+package user
+
+import (
+	"authfish/internal/context"
+	"authfish/internal/database"
+	"authfish/internal/lockout"
+	"authfish/internal/utils"
+	"fmt"
+	"os"
+)
+
+// Clear failed login attempts, so a locked out user can log in again right
+// away. With --ip, clears the failed attempts of a client IP address instead.
+type UnlockCmd struct {
+	Username string `arg:"" optional:""`
+	Ip       string `help:"Unlock this client IP address instead of a user."`
+}
+
+func (r *UnlockCmd) Run(ctx *context.AppContext) error {
+	kind, subject := lockout.KindUsername, utils.NormalizeUsername(r.Username)
+
+	if len(r.Ip) > 0 {
+		kind, subject = lockout.KindIp, r.Ip
+	}
+
+	if len(subject) == 0 {
+		fmt.Println("Either a username or --ip is required")
+		os.Exit(1)
+	}
+
+	err := database.ClearLockout(ctx.Db, kind, subject)
+
+	if err != nil {
+		fmt.Printf("Error unlocking %s: %v\n", subject, err)
+		os.Exit(1)
+	}
+
+	_, err = fmt.Printf("Unlocked %s\n", subject)
+	return err
+}
@@ -1,15 +1,44 @@
 package user
 
 import (
+	"authfish/internal/api_key"
 	"net/url"
 	"path"
+	"time"
 )
 
 type UserCmd struct {
-	List   ListCmd   `cmd:"" default:""`
-	Add    AddCmd    `cmd:"" aliases:"create,register"`
-	AddKey AddKeyCmd `cmd:""`
-	Remove RemoveCmd `cmd:"" aliases:"rm,del,delete"`
+	List             ListCmd             `cmd:"" default:""`
+	Add              AddCmd              `cmd:"" aliases:"create,register"`
+	AddKey           AddKeyCmd           `cmd:""`
+	ListKeys         ListKeysCmd         `cmd:""`
+	Remove           RemoveCmd           `cmd:"" aliases:"rm,del,delete"`
+	Disable          DisableCmd          `cmd:""`
+	Enable           EnableCmd           `cmd:""`
+	Reset2fa         Reset2faCmd         `cmd:"" name:"reset-2fa"`
+	ResetPassword    ResetPasswordCmd    `cmd:""`
+	Pending          PendingCmd          `cmd:""`
+	Approve          ApproveCmd          `cmd:""`
+	Reject           RejectCmd           `cmd:""`
+	Promote          PromoteCmd          `cmd:""`
+	Demote           DemoteCmd           `cmd:""`
+	RegenerateInvite RegenerateInviteCmd `cmd:""`
+	Unlock           UnlockCmd           `cmd:""`
+}
+
+func parseInviteExpiry(value string) (*time.Time, error) {
+	if value == "never" {
+		return nil, nil
+	}
+
+	expiresAt, err := api_key.ParseExpiry(value, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt = expiresAt.UTC().Truncate(time.Second)
+	return &expiresAt, nil
 }
 
 func buildRegistrationURL(base *url.URL, token *string) string {
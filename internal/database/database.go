@@ -4,8 +4,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 
 	"authfish/internal/api_key"
+	"authfish/internal/lockout"
 	"authfish/internal/user"
 	"authfish/internal/utils"
 
@@ -49,10 +52,264 @@ var migrations []string = []string{
 	`
 	  create index if not exists api_keys_user_id_idx ON api_keys (user_id);
 	`,
+
+	`
+	  create table if not exists policies (
+			id          integer   not null primary key,
+			host        text      not null,
+			path_prefix text      not null default '/',
+			kind        text      not null,
+			subject     text,
+			created_at  timestamp default current_timestamp not null
+		);
+	`,
+
+	`
+	  create index if not exists policies_host_idx ON policies (host);
+	`,
+
+	`
+	  create table if not exists groups (
+			id         integer   not null primary key,
+			name       text      not null unique,
+			created_at timestamp default current_timestamp not null
+		);
+	`,
+
+	`
+	  create table if not exists group_memberships (
+			group_id   integer   not null,
+			user_id    integer   not null,
+			created_at timestamp default current_timestamp not null,
+
+			PRIMARY KEY(group_id, user_id),
+			FOREIGN KEY(group_id) REFERENCES groups(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create index if not exists group_memberships_user_id_idx ON group_memberships (user_id);
+	`,
+
+	`
+	  create table if not exists totp_credentials (
+			user_id        integer   not null primary key,
+			secret         text      not null,
+			confirmed_at   timestamp,
+			last_used_step integer   not null default 0,
+			created_at     timestamp default current_timestamp not null,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create table if not exists recovery_codes (
+			id          integer   not null primary key,
+			user_id     integer   not null,
+			hashed_code text      not null,
+			used_at     timestamp,
+			created_at  timestamp default current_timestamp not null,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create index if not exists recovery_codes_user_id_idx ON recovery_codes (user_id);
+	`,
+
+	`
+	  create table if not exists webauthn_credentials (
+			id            integer   not null primary key,
+			user_id       integer   not null,
+			name          text      not null,
+			credential_id blob      not null unique,
+			public_key    blob      not null,
+			sign_count    integer   not null default 0,
+			created_at    timestamp default current_timestamp not null,
+			last_used_at  timestamp,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create index if not exists webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+	`,
+
+	`
+	  create table if not exists webauthn_challenges (
+			challenge  blob      not null primary key,
+			user_id    integer,
+			created_at timestamp default current_timestamp not null,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create table if not exists sessions (
+			id           integer   not null primary key,
+			token_hash   text      not null unique,
+			user_id      integer,
+			data         blob      not null,
+			ip_address   text      not null default '',
+			user_agent   text      not null default '',
+			created_at   timestamp default current_timestamp not null,
+			last_seen_at timestamp default current_timestamp not null,
+			expires_at   timestamp not null,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create index if not exists sessions_user_id_idx ON sessions (user_id);
+	`,
+
+	`
+	  create table if not exists lockouts (
+			kind            text      not null,
+			subject         text      not null,
+			failures        integer   not null default 0,
+			locked_until    timestamp,
+			last_failure_at timestamp not null,
+
+			PRIMARY KEY(kind, subject)
+		);
+	`,
+
+	`
+	  alter table api_keys add column prefix text;
+	`,
+
+	`
+	  alter table api_keys add column hashed_key text;
+	`,
+
+	`
+	  create index if not exists api_keys_prefix_idx ON api_keys (prefix);
+	`,
+
+	`
+	  alter table api_keys add column use_count integer not null default 0;
+	`,
+
+	`
+	  alter table api_keys add column last_ip text not null default '';
+	`,
+
+	`
+	  alter table api_keys add column expires_at timestamp;
+	`,
+
+	`
+	  alter table api_keys add column scopes text not null default '';
+	`,
+
+	`
+	  alter table users add column registration_token_expires_at timestamp;
+	`,
+
+	`
+	  alter table users add column status text not null default 'active';
+	`,
+
+	`
+	  alter table users add column is_admin boolean not null default 0;
+	`,
+
+	`
+	  alter table users add column disabled_at timestamp;
+	`,
+
+	`
+	  create table if not exists oidc_clients (
+			id            integer   not null primary key,
+			client_id     text      not null unique,
+			name          text      not null,
+			hashed_secret text      not null default '',
+			redirect_uris text      not null,
+			created_at    timestamp default current_timestamp not null
+		);
+	`,
+
+	`
+	  create table if not exists oidc_authorization_codes (
+			hashed_code           text      not null primary key,
+			client_id             text      not null,
+			user_id               integer   not null,
+			redirect_uri          text      not null,
+			scope                 text      not null,
+			nonce                 text      not null default '',
+			code_challenge        text      not null default '',
+			code_challenge_method text      not null default '',
+			auth_time             timestamp not null,
+			expires_at            timestamp not null,
+
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  create table if not exists identity_providers (
+			id                integer   not null primary key,
+			name              text      not null unique,
+			issuer            text      not null default '',
+			client_id         text      not null,
+			client_secret     text      not null,
+			authorization_url text      not null,
+			token_url         text      not null,
+			userinfo_url      text      not null default '',
+			jwks_url          text      not null default '',
+			scopes            text      not null,
+			subject_claim     text      not null,
+			username_claim    text      not null,
+			mapping           text      not null,
+			created_at        timestamp default current_timestamp not null
+		);
+	`,
+
+	`
+	  create table if not exists federated_identities (
+			id           integer   not null primary key,
+			provider_id  integer   not null,
+			subject      text      not null,
+			user_id      integer   not null,
+			username     text      not null default '',
+			created_at   timestamp default current_timestamp not null,
+			last_used_at timestamp,
+
+			UNIQUE(provider_id, subject),
+			FOREIGN KEY(provider_id) REFERENCES identity_providers(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`,
+
+	`
+	  alter table users add column source text not null default 'local';
+	`,
+
+	`
+	  create table if not exists saml_service_providers (
+			id            integer   not null primary key,
+			entity_id     text      not null unique,
+			acs_urls      text      not null,
+			name_id_field text      not null,
+			attributes    text      not null,
+			created_at    timestamp default current_timestamp not null
+		);
+	`,
 }
 
 const (
 	registrationTokenSize = 16
+
+	// The plaintext key column is only read to hash keys created by older
+	// versions of authfish.
+	apiKeyColumns = "id, user_id, memo, prefix, hashed_key, created_at, last_seen, use_count, last_ip, expires_at, scopes"
 )
 
 func OpenDB(file string) *sqlx.DB {
@@ -60,10 +317,53 @@ func OpenDB(file string) *sqlx.DB {
 	return sqlx.MustConnect("sqlite3", fileWithOptions)
 }
 
+// Runs the migrations which have not been run yet. The number of migrations
+// already run is tracked in the user_version pragma. Databases created before
+// that was tracked start at 0, so every migration before the first alter
+// table must be safe to run twice.
 func RunMigrations(db *sqlx.DB) {
-	for _, migration := range migrations {
-		_ = db.MustExec(migration)
+	version := 0
+	if err := db.Get(&version, "pragma user_version"); err != nil {
+		panic(err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_ = db.MustExec(migrations[i])
+		_ = db.MustExec(fmt.Sprintf("pragma user_version = %d", i+1))
+	}
+
+	if err := hashPlaintextApiKeys(db); err != nil {
+		panic(err)
+	}
+}
+
+// Replace API keys stored in plaintext by older versions of authfish with
+// their prefix and hash.
+func hashPlaintextApiKeys(db *sqlx.DB) error {
+	plaintextKeys := []struct {
+		Id  int64  `db:"id"`
+		Key string `db:"key"`
+	}{}
+
+	err := db.Select(&plaintextKeys, "select id, key from api_keys where key is not null")
+	if err != nil {
+		return err
 	}
+
+	for _, k := range plaintextKeys {
+		_, err := db.Exec(
+			"update api_keys set prefix = ?, hashed_key = ?, key = null where id = ?",
+			api_key.Prefix(k.Key),
+			utils.HashToken(k.Key),
+			k.Id,
+		)
+
+		if err != nil {
+			return fmt.Errorf("error hashing api key %d: %w", k.Id, err)
+		}
+	}
+
+	return nil
 }
 
 func FindUserByUsername(db *sqlx.DB, username string) (*user.User, error) {
@@ -115,24 +415,39 @@ func FindUserByRegistrationToken(db *sqlx.DB, registrationToken string) (*user.U
 }
 
 func FindUserByApiKey(db *sqlx.DB, apiKey string) (*user.User, error) {
-	users := []user.User{}
+	k, err := FindApiKey(db, apiKey)
 
-	err := db.Select(&users,
-		"select users.* from users inner join api_keys on users.id = api_keys.user_id where api_keys.key = ? limit 1",
-		apiKey,
-	)
-	if err != nil {
+	if err != nil || k == nil {
 		return nil, err
 	}
 
-	if len(users) != 1 {
+	return FindUserById(db, k.UserId)
+}
+
+func FindApiKey(db *sqlx.DB, apiKey string) (*api_key.ApiKey, error) {
+	prefix := api_key.Prefix(apiKey)
+
+	if len(prefix) == 0 {
 		return nil, nil
 	}
 
-	return &users[0], nil
+	candidates := []api_key.ApiKey{}
+
+	err := db.Select(&candidates, "select "+apiKeyColumns+" from api_keys where prefix = ?", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Matches(apiKey) {
+			return &candidate, nil
+		}
+	}
+
+	return nil, nil
 }
 
-func RegisterNewUser(db *sqlx.DB, username string) (*user.User, error) {
+func RegisterNewUser(db *sqlx.DB, username string, expiresAt *time.Time) (*user.User, error) {
 	username = utils.NormalizeUsername(username)
 
 	existingUser, err := FindUserByUsername(db, username)
@@ -151,9 +466,10 @@ func RegisterNewUser(db *sqlx.DB, username string) (*user.User, error) {
 	}
 
 	sqlResult, err := db.Exec(
-		"insert into users (username, registration_token) values ($1, $2)",
+		"insert into users (username, registration_token, registration_token_expires_at) values ($1, $2, $3)",
 		username,
 		registrationTokenHex,
+		expiresAt,
 	)
 
 	if err != nil {
@@ -171,11 +487,112 @@ func RegisterNewUser(db *sqlx.DB, username string) (*user.User, error) {
 		Username:          username,
 		HashedPassword:    []byte{},
 		RegistrationToken: &registrationTokenHex,
+
+		RegistrationTokenExpiresAt: expiresAt,
+		Status:                     user.StatusActive,
 	}
 
 	return newUser, nil
 }
 
+// Create an account for someone who signed up on the registration page. It
+// can't be used until an admin approves it.
+func SignUpUser(db *sqlx.DB, username string, password string) (*user.User, error) {
+	username = utils.NormalizeUsername(username)
+
+	existingUser, err := FindUserByUsername(db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingUser != nil {
+		return nil, fmt.Errorf("username %s is already taken", username)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(
+		"insert into users (username, hashed_password, status) values (?, ?, ?)",
+		username,
+		hashedPassword,
+		user.StatusPending,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new user into the database: %w", err)
+	}
+
+	return FindUserByUsername(db, username)
+}
+
+// Create a user whose password is checked by an LDAP directory.
+func CreateLdapUser(db *sqlx.DB, username string) (*user.User, error) {
+	username = utils.NormalizeUsername(username)
+
+	existingUser, err := FindUserByUsername(db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingUser != nil {
+		return nil, fmt.Errorf("username %s is already taken", username)
+	}
+
+	_, err = db.Exec("insert into users (username, source) values (?, ?)", username, user.SourceLdap)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new user into the database: %w", err)
+	}
+
+	return FindUserByUsername(db, username)
+}
+
+func ApproveUser(db *sqlx.DB, user user.User) error {
+	_, err := db.Exec("update users set status = 'active' where id = ?", user.Id)
+	return err
+}
+
+func SetUserAdmin(db *sqlx.DB, user user.User, isAdmin bool) error {
+	_, err := db.Exec("update users set is_admin = ? where id = ?", isAdmin, user.Id)
+	return err
+}
+
+// Stop user from logging in or using their API keys, and log them out, but keep
+// everything else so that they can be enabled again.
+func DisableUser(db *sqlx.DB, user user.User) error {
+	_, err := db.Exec("update users set disabled_at = ? where id = ?", time.Now().UTC().Truncate(time.Second), user.Id)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = RevokeAllUserSessionsForUser(db, user)
+	return err
+}
+
+func EnableUser(db *sqlx.DB, user user.User) error {
+	_, err := db.Exec("update users set disabled_at = null where id = ?", user.Id)
+	return err
+}
+
+func ListPendingUsers(db *sqlx.DB) ([]user.User, error) {
+	users := []user.User{}
+
+	err := db.Select(&users, "select * from users where status = ? order by created_at", user.StatusPending)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 func CompleteRegistration(db *sqlx.DB, userId int64, registrationToken string, password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 
@@ -183,7 +600,7 @@ func CompleteRegistration(db *sqlx.DB, userId int64, registrationToken string, p
 		return err
 	}
 
-	result, err := db.Exec("update users set hashed_password = ?, registration_token = null where id = ? and registration_token = ?", hashedPassword, userId, registrationToken)
+	result, err := db.Exec("update users set hashed_password = ?, registration_token = null, registration_token_expires_at = null where id = ? and registration_token = ?", hashedPassword, userId, registrationToken)
 
 	if err != nil {
 		return err
@@ -202,6 +619,39 @@ func CompleteRegistration(db *sqlx.DB, userId int64, registrationToken string, p
 	return nil
 }
 
+func ChangePassword(db *sqlx.DB, user user.User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("update users set hashed_password = ? where id = ?", hashedPassword, user.Id)
+	return err
+}
+
+// Give user a new registration token, replacing any previous one. This is
+// used both to re-send an invite and to reset a forgotten password; a
+// registered user's current password keeps working until the token is used.
+func ReissueRegistrationToken(db *sqlx.DB, user user.User, expiresAt *time.Time) (string, error) {
+	if !user.HasLocalPassword() {
+		return "", fmt.Errorf("the password of %s is managed by %s", user.Username, user.Source)
+	}
+
+	token, err := generateRandomHex(registrationTokenSize)
+	if err != nil {
+		return "", fmt.Errorf("could not generate random registrationToken: %w", err)
+	}
+
+	_, err = db.Exec("update users set registration_token = ?, registration_token_expires_at = ? where id = ?", token, expiresAt, user.Id)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
 func DeleteUser(db *sqlx.DB, username string) error {
 	username = utils.NormalizeUsername(username)
 
@@ -220,6 +670,51 @@ func DeleteUser(db *sqlx.DB, username string) error {
 		return err
 	}
 
+	_, err = db.Exec("delete from group_memberships where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	err = DeleteTotpCredential(db, *user)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from webauthn_challenges where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from webauthn_credentials where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from sessions where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from oidc_authorization_codes where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from federated_identities where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from lockouts where kind = ? and subject = ?", lockout.KindUsername, user.Username)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from policies where kind in ('allow-user', 'deny-user') and subject = ?", user.Username)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec("delete from users where id = ?", user.Id)
 	if err != nil {
 		return err
@@ -240,7 +735,9 @@ func ListUsers(db *sqlx.DB) ([]user.User, error) {
 	return users, nil
 }
 
-func CreateApiKey(db *sqlx.DB, user user.User, memo string) (*api_key.ApiKey, error) {
+// Creates a key for user, which never expires if expiresAt is nil, and is not
+// restricted if scopes is empty.
+func CreateApiKey(db *sqlx.DB, user user.User, memo string, expiresAt *time.Time, scopes []string) (*api_key.ApiKey, error) {
 	randomKey, err := generateRandomHex(16)
 
 	if err != nil {
@@ -248,10 +745,13 @@ func CreateApiKey(db *sqlx.DB, user user.User, memo string) (*api_key.ApiKey, er
 	}
 
 	sqlResult, err := db.Exec(
-		"insert into api_keys (user_id, memo, key) values ($1, $2, $3)",
+		"insert into api_keys (user_id, memo, prefix, hashed_key, expires_at, scopes) values ($1, $2, $3, $4, $5, $6)",
 		user.Id,
 		memo,
-		randomKey,
+		api_key.Prefix(randomKey),
+		utils.HashToken(randomKey),
+		expiresAt,
+		strings.Join(scopes, " "),
 	)
 
 	if err != nil {
@@ -265,10 +765,14 @@ func CreateApiKey(db *sqlx.DB, user user.User, memo string) (*api_key.ApiKey, er
 	}
 
 	apiKey := api_key.ApiKey{
-		Id:     id,
-		UserId: user.Id,
-		Memo:   memo,
-		Key:    randomKey,
+		Id:        id,
+		UserId:    user.Id,
+		Memo:      memo,
+		Prefix:    api_key.Prefix(randomKey),
+		HashedKey: utils.HashToken(randomKey),
+		ExpiresAt: expiresAt,
+		Scopes:    strings.Join(scopes, " "),
+		Key:       randomKey,
 	}
 
 	return &apiKey, nil
@@ -276,7 +780,7 @@ func CreateApiKey(db *sqlx.DB, user user.User, memo string) (*api_key.ApiKey, er
 
 func ListApiKeys(db *sqlx.DB, user user.User) ([]api_key.ApiKey, error) {
 	apiKeys := []api_key.ApiKey{}
-	err := db.Select(&apiKeys, "select * from api_keys where user_id = ?", user.Id)
+	err := db.Select(&apiKeys, "select "+apiKeyColumns+" from api_keys where user_id = ?", user.Id)
 
 	if err != nil {
 		return nil, err
@@ -285,6 +789,20 @@ func ListApiKeys(db *sqlx.DB, user user.User) ([]api_key.ApiKey, error) {
 	return apiKeys, nil
 }
 
+// Add count uses of the API key with id, the last of which was at lastSeen
+// from lastIp.
+func RecordApiKeyUsage(db *sqlx.DB, id int64, count int64, lastSeen time.Time, lastIp string) error {
+	_, err := db.Exec(
+		"update api_keys set use_count = use_count + ?, last_seen = ?, last_ip = ? where id = ?",
+		count,
+		lastSeen.UTC().Truncate(time.Second),
+		lastIp,
+		id,
+	)
+
+	return err
+}
+
 func DeleteApiKey(db *sqlx.DB, user user.User, id int64) error {
 	_, err := db.Exec("delete from api_keys where id = ? and user_id = ?", id, user.Id)
 	return err
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"authfish/internal/federated"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Register an external identity provider. Empty scopes, claims and mapping
+// get the defaults for OpenID Connect.
+func CreateIdentityProvider(db *sqlx.DB, provider federated.Provider) (*federated.Provider, error) {
+	provider.Name = strings.TrimSpace(provider.Name)
+
+	if len(provider.Name) == 0 || strings.ContainsAny(provider.Name, " \t\r\n/") {
+		return nil, fmt.Errorf("invalid provider name: %q", provider.Name)
+	}
+
+	if len(provider.ClientId) == 0 {
+		return nil, fmt.Errorf("a client id is required")
+	}
+
+	for _, endpoint := range []string{provider.AuthorizationUrl, provider.TokenUrl} {
+		if err := validateEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, endpoint := range []string{provider.UserinfoUrl, provider.JwksUrl} {
+		if len(endpoint) > 0 {
+			if err := validateEndpoint(endpoint); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !provider.IsOidc() && len(provider.UserinfoUrl) == 0 {
+		return nil, fmt.Errorf("a userinfo URL is required for providers without an issuer and JWKS URL")
+	}
+
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = "openid profile"
+	}
+
+	if len(provider.SubjectClaim) == 0 {
+		provider.SubjectClaim = "sub"
+	}
+
+	if len(provider.UsernameClaim) == 0 {
+		provider.UsernameClaim = "preferred_username"
+	}
+
+	if len(provider.Mapping) == 0 {
+		provider.Mapping = federated.MappingLink
+	}
+
+	if err := federated.ValidateMapping(provider.Mapping); err != nil {
+		return nil, err
+	}
+
+	existingProvider, err := FindIdentityProvider(db, provider.Name)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingProvider != nil {
+		return nil, fmt.Errorf("provider %s already exists", provider.Name)
+	}
+
+	sqlResult, err := db.NamedExec(
+		`insert into identity_providers
+			(name, issuer, client_id, client_secret, authorization_url, token_url, userinfo_url, jwks_url, scopes, subject_claim, username_claim, mapping)
+		values
+			(:name, :issuer, :client_id, :client_secret, :authorization_url, :token_url, :userinfo_url, :jwks_url, :scopes, :subject_claim, :username_claim, :mapping)`,
+		provider,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new provider into the database: %w", err)
+	}
+
+	provider.Id, err = sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted provider: %w", err)
+	}
+
+	return &provider, nil
+}
+
+func validateEndpoint(endpoint string) error {
+	parsedUrl, err := url.Parse(endpoint)
+
+	if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || len(parsedUrl.Host) == 0 {
+		return fmt.Errorf("invalid endpoint URL: %q", endpoint)
+	}
+
+	return nil
+}
+
+func FindIdentityProvider(db *sqlx.DB, name string) (*federated.Provider, error) {
+	providers := []federated.Provider{}
+
+	err := db.Select(&providers, "select * from identity_providers where name = ? limit 1", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(providers) != 1 {
+		return nil, nil
+	}
+
+	return &providers[0], nil
+}
+
+func ListIdentityProviders(db *sqlx.DB) ([]federated.Provider, error) {
+	providers := []federated.Provider{}
+
+	err := db.Select(&providers, "select * from identity_providers order by name")
+	if err != nil {
+		return nil, err
+	}
+
+	return providers, nil
+}
+
+// Delete a provider along with every identity linked through it.
+func DeleteIdentityProvider(db *sqlx.DB, name string) error {
+	provider, err := FindIdentityProvider(db, name)
+
+	if err != nil {
+		return err
+	}
+
+	if provider == nil {
+		return fmt.Errorf("provider %s does not exist", name)
+	}
+
+	_, err = db.Exec("delete from federated_identities where provider_id = ?", provider.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from identity_providers where id = ?", provider.Id)
+	return err
+}
+
+func FindFederatedIdentity(db *sqlx.DB, provider federated.Provider, subject string) (*federated.Identity, error) {
+	identities := []federated.Identity{}
+
+	err := db.Select(&identities, "select * from federated_identities where provider_id = ? and subject = ? limit 1", provider.Id, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(identities) != 1 {
+		return nil, nil
+	}
+
+	return &identities[0], nil
+}
+
+func ListFederatedIdentitiesForUser(db *sqlx.DB, user user.User) ([]federated.Identity, error) {
+	identities := []federated.Identity{}
+
+	err := db.Select(
+		&identities,
+		`select federated_identities.*, identity_providers.name as provider_name
+		from federated_identities
+		join identity_providers on identity_providers.id = federated_identities.provider_id
+		where federated_identities.user_id = ?
+		order by identity_providers.name, federated_identities.created_at`,
+		user.Id,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// Link subject at provider to user. Linking an identity which is already
+// linked to another user is an error.
+func LinkFederatedIdentity(db *sqlx.DB, provider federated.Provider, subject string, username string, user user.User) error {
+	existingIdentity, err := FindFederatedIdentity(db, provider, subject)
+
+	if err != nil {
+		return fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingIdentity != nil {
+		if existingIdentity.UserId != user.Id {
+			return fmt.Errorf("this %s account is already linked to another user", provider.Name)
+		}
+
+		return nil
+	}
+
+	_, err = db.Exec(
+		"insert into federated_identities (provider_id, subject, user_id, username) values (?, ?, ?, ?)",
+		provider.Id,
+		subject,
+		user.Id,
+		username,
+	)
+
+	if err != nil {
+		return fmt.Errorf("error inserting federated identity into the database: %w", err)
+	}
+
+	return nil
+}
+
+func UnlinkFederatedIdentity(db *sqlx.DB, user user.User, identityId int64) error {
+	result, err := db.Exec("delete from federated_identities where id = ? and user_id = ?", identityId, user.Id)
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("linked account does not exist")
+	}
+
+	return nil
+}
+
+// Record a login with identity, and the username the provider now knows it by.
+func TouchFederatedIdentity(db *sqlx.DB, identity federated.Identity, username string) error {
+	_, err := db.Exec(
+		"update federated_identities set last_used_at = ?, username = ? where id = ?",
+		time.Now().UTC(),
+		username,
+		identity.Id,
+	)
+
+	return err
+}
+
+// Create a user without a password, who can't log in until an admin approves
+// them.
+func CreatePendingUser(db *sqlx.DB, username string) (*user.User, error) {
+	username = utils.NormalizeUsername(username)
+
+	if len(username) == 0 {
+		return nil, fmt.Errorf("username must not be empty")
+	}
+
+	existingUser, err := FindUserByUsername(db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingUser != nil {
+		return nil, fmt.Errorf("username %s is already taken", username)
+	}
+
+	_, err = db.Exec("insert into users (username, status) values (?, ?)", username, user.StatusPending)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new user into the database: %w", err)
+	}
+
+	return FindUserByUsername(db, username)
+}
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"authfish/internal/group"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func FindGroupByName(db *sqlx.DB, name string) (*group.Group, error) {
+	name = utils.NormalizeGroupName(name)
+
+	groups := []group.Group{}
+
+	err := db.Select(&groups, "select * from groups where name = ? limit 1", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(groups) != 1 {
+		return nil, nil
+	}
+
+	return &groups[0], nil
+}
+
+func CreateGroup(db *sqlx.DB, name string) (*group.Group, error) {
+	name = utils.NormalizeGroupName(name)
+
+	if len(name) == 0 {
+		return nil, fmt.Errorf("group name must not be empty")
+	}
+
+	// Group names are forwarded to upstream apps as a comma separated list
+	if strings.ContainsAny(name, ", ") {
+		return nil, fmt.Errorf("group name must not contain commas or spaces")
+	}
+
+	existingGroup, err := FindGroupByName(db, name)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existingGroup != nil {
+		return nil, fmt.Errorf("group %s already exists (id: %d)", existingGroup.Name, existingGroup.Id)
+	}
+
+	sqlResult, err := db.Exec("insert into groups (name) values ($1)", name)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new group into the database: %w", err)
+	}
+
+	id, err := sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted group: %w", err)
+	}
+
+	newGroup := &group.Group{
+		Id:   id,
+		Name: name,
+	}
+
+	return newGroup, nil
+}
+
+func DeleteGroup(db *sqlx.DB, name string) error {
+	g, err := FindGroupByName(db, name)
+
+	if err != nil {
+		return err
+	}
+
+	if g == nil {
+		return fmt.Errorf("group %s does not exist", name)
+	}
+
+	_, err = db.Exec("delete from group_memberships where group_id = ?", g.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from policies where kind = 'allow-group' and subject = ?", g.Name)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from groups where id = ?", g.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ListGroups(db *sqlx.DB) ([]group.Group, error) {
+	groups := []group.Group{}
+
+	err := db.Select(&groups, "select * from groups order by name")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func ListGroupsForUser(db *sqlx.DB, user user.User) ([]group.Group, error) {
+	groups := []group.Group{}
+
+	err := db.Select(&groups,
+		"select groups.* from groups inner join group_memberships on groups.id = group_memberships.group_id where group_memberships.user_id = ? order by groups.name",
+		user.Id,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func ListGroupMembers(db *sqlx.DB, g group.Group) ([]user.User, error) {
+	users := []user.User{}
+
+	err := db.Select(&users,
+		"select users.* from users inner join group_memberships on users.id = group_memberships.user_id where group_memberships.group_id = ? order by users.username",
+		g.Id,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func AddGroupMember(db *sqlx.DB, g group.Group, user user.User) error {
+	_, err := db.Exec("insert or ignore into group_memberships (group_id, user_id) values ($1, $2)", g.Id, user.Id)
+	return err
+}
+
+func RemoveGroupMember(db *sqlx.DB, g group.Group, user user.User) error {
+	result, err := db.Exec("delete from group_memberships where group_id = ? and user_id = ?", g.Id, user.Id)
+
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("user %s is not a member of %s", user.Username, g.Name)
+	}
+
+	return nil
+}
+
+// Make u a member of exactly the groups in names, creating groups which do not
+// exist yet.
+func SetGroupsForUser(db *sqlx.DB, u user.User, names []string) error {
+	wanted := map[int64]bool{}
+
+	for _, name := range names {
+		g, err := FindGroupByName(db, name)
+
+		if err != nil {
+			return err
+		}
+
+		if g == nil {
+			g, err = CreateGroup(db, name)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		wanted[g.Id] = true
+
+		if err := AddGroupMember(db, *g, u); err != nil {
+			return err
+		}
+	}
+
+	current, err := ListGroupsForUser(db, u)
+
+	if err != nil {
+		return err
+	}
+
+	for _, g := range current {
+		if !wanted[g.Id] {
+			if err := RemoveGroupMember(db, g, u); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
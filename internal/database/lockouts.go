@@ -0,0 +1,81 @@
+package database
+
+import (
+	"time"
+
+	"authfish/internal/lockout"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func FindLockout(db *sqlx.DB, kind lockout.Kind, subject string) (*lockout.Lockout, error) {
+	lockouts := []lockout.Lockout{}
+
+	err := db.Select(&lockouts, "select * from lockouts where kind = ? and subject = ? limit 1", kind, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lockouts) != 1 {
+		return nil, nil
+	}
+
+	return &lockouts[0], nil
+}
+
+// Count a failed login against kind and subject, locking it if there have been
+// too many failures. The count is incremented by the database, so that
+// concurrent failures can't overwrite each other.
+func RecordLoginFailure(db *sqlx.DB, kind lockout.Kind, subject string) (*lockout.Lockout, error) {
+	now := time.Now().UTC()
+	l := lockout.Lockout{}
+
+	err := db.Get(
+		&l,
+		`insert into lockouts (kind, subject, failures, last_failure_at) values (?, ?, 1, ?)
+		on conflict (kind, subject) do update set
+			failures = case when last_failure_at > ? then failures + 1 else 1 end,
+			last_failure_at = excluded.last_failure_at
+		returning *`,
+		kind,
+		subject,
+		now,
+		now.Add(-lockout.ResetAfter),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := lockout.Backoff(kind, l.Failures)
+
+	if backoff <= 0 {
+		return &l, nil
+	}
+
+	// Concurrent failures may get here in any order, so a lockout is only
+	// ever extended
+	lockedUntil := now.Add(backoff)
+
+	err = db.Get(
+		&l,
+		`update lockouts set locked_until = max(coalesce(locked_until, ?), ?)
+		where kind = ? and subject = ?
+		returning *`,
+		lockedUntil,
+		lockedUntil,
+		kind,
+		subject,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+func ClearLockout(db *sqlx.DB, kind lockout.Kind, subject string) error {
+	_, err := db.Exec("delete from lockouts where kind = ? and subject = ?", kind, subject)
+	return err
+}
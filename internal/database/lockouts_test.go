@@ -0,0 +1,130 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"authfish/internal/lockout"
+)
+
+func TestRecordLoginFailure(t *testing.T) {
+	tests := []struct {
+		kind         lockout.Kind
+		freeAttempts int
+	}{
+		{kind: lockout.KindUsername, freeAttempts: 5},
+		{kind: lockout.KindIp, freeAttempts: 20},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.kind), func(t *testing.T) {
+			db := OpenTestDB(t)
+
+			for i := 1; i <= test.freeAttempts+2; i++ {
+				before := time.Now()
+				l, err := RecordLoginFailure(db, test.kind, "alice")
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if l.Failures != i {
+					t.Fatalf("got %d failures, want %d", l.Failures, i)
+				}
+
+				backoff := lockout.Backoff(test.kind, i)
+
+				if l.IsLocked() != (backoff > 0) {
+					t.Fatalf("got IsLocked %v after %d failures", l.IsLocked(), i)
+				}
+
+				if backoff > 0 && (l.LockedUntil.Before(before.Add(backoff)) || l.LockedUntil.After(time.Now().Add(backoff))) {
+					t.Errorf("locked until %v after %d failures, want %s from now", l.LockedUntil, i, backoff)
+				}
+			}
+
+			// Usernames and IPs are counted separately
+			other := lockout.KindIp
+			if test.kind == lockout.KindIp {
+				other = lockout.KindUsername
+			}
+
+			if l, err := FindLockout(db, other, "alice"); err != nil || l != nil {
+				t.Errorf("got lockout %+v and error %v for %s", l, err, other)
+			}
+
+			if l, err := FindLockout(db, test.kind, "bob"); err != nil || l != nil {
+				t.Errorf("got lockout %+v and error %v for another subject", l, err)
+			}
+		})
+	}
+}
+
+func TestRecordLoginFailureOnlyExtendsLockouts(t *testing.T) {
+	db := OpenTestDB(t)
+	lockedUntil := time.Now().Add(lockout.MaxBackoff * 2).UTC()
+
+	for i := 0; i < 6; i++ {
+		if _, err := RecordLoginFailure(db, lockout.KindUsername, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A lockout which a concurrent failure made longer than this one would be
+	db.MustExec("update lockouts set locked_until = ? where kind = ? and subject = ?", lockedUntil, lockout.KindUsername, "alice")
+
+	l, err := RecordLoginFailure(db, lockout.KindUsername, "alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !l.LockedUntil.Equal(lockedUntil) {
+		t.Errorf("lockout changed to %v, want %v", l.LockedUntil, lockedUntil)
+	}
+}
+
+func TestRecordLoginFailureResetsOldFailures(t *testing.T) {
+	db := OpenTestDB(t)
+
+	for i := 0; i < 10; i++ {
+		if _, err := RecordLoginFailure(db, lockout.KindUsername, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastFailureAt := time.Now().Add(-lockout.ResetAfter - time.Minute).UTC()
+	db.MustExec("update lockouts set last_failure_at = ?, locked_until = null where kind = ? and subject = ?", lastFailureAt, lockout.KindUsername, "alice")
+
+	l, err := RecordLoginFailure(db, lockout.KindUsername, "alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Failures != 1 || l.IsLocked() {
+		t.Errorf("got %d failures and IsLocked %v, want 1 and false", l.Failures, l.IsLocked())
+	}
+}
+
+func TestClearLockout(t *testing.T) {
+	db := OpenTestDB(t)
+
+	for _, kind := range []lockout.Kind{lockout.KindUsername, lockout.KindIp} {
+		if _, err := RecordLoginFailure(db, kind, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ClearLockout(db, lockout.KindUsername, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := FindLockout(db, lockout.KindUsername, "alice"); err != nil || l != nil {
+		t.Errorf("got lockout %+v and error %v after clearing it", l, err)
+	}
+
+	if l, err := FindLockout(db, lockout.KindIp, "alice"); err != nil || l == nil {
+		t.Errorf("got lockout %+v and error %v for the IP, want it kept", l, err)
+	}
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"authfish/internal/oidc"
+	"authfish/internal/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Register a relying party. Public clients get no secret.
+func CreateOidcClient(db *sqlx.DB, name string, redirectUris []string, public bool) (*oidc.Client, error) {
+	name = strings.TrimSpace(name)
+
+	if len(name) == 0 {
+		return nil, fmt.Errorf("client name must not be empty")
+	}
+
+	if len(redirectUris) == 0 {
+		return nil, fmt.Errorf("at least one redirect URI is required")
+	}
+
+	for _, redirectUri := range redirectUris {
+		if len(redirectUri) == 0 || strings.ContainsAny(redirectUri, " \t\r\n") {
+			return nil, fmt.Errorf("invalid redirect URI: %q", redirectUri)
+		}
+	}
+
+	clientId, err := generateRandomHex(16)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate client id: %w", err)
+	}
+
+	secret := ""
+	hashedSecret := ""
+
+	if !public {
+		secret, err = generateRandomHex(32)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not generate client secret: %w", err)
+		}
+
+		hashedSecret = utils.HashToken(secret)
+	}
+
+	sqlResult, err := db.Exec(
+		"insert into oidc_clients (client_id, name, hashed_secret, redirect_uris) values (?, ?, ?, ?)",
+		clientId,
+		name,
+		hashedSecret,
+		strings.Join(redirectUris, " "),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new client into the database: %w", err)
+	}
+
+	id, err := sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted client: %w", err)
+	}
+
+	return &oidc.Client{
+		Id:           id,
+		ClientId:     clientId,
+		Name:         name,
+		HashedSecret: hashedSecret,
+		RedirectUris: strings.Join(redirectUris, " "),
+		Secret:       secret,
+	}, nil
+}
+
+func FindOidcClient(db *sqlx.DB, clientId string) (*oidc.Client, error) {
+	clients := []oidc.Client{}
+
+	err := db.Select(&clients, "select * from oidc_clients where client_id = ? limit 1", clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clients) != 1 {
+		return nil, nil
+	}
+
+	return &clients[0], nil
+}
+
+func ListOidcClients(db *sqlx.DB) ([]oidc.Client, error) {
+	clients := []oidc.Client{}
+
+	err := db.Select(&clients, "select * from oidc_clients order by name")
+	if err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func DeleteOidcClient(db *sqlx.DB, clientId string) error {
+	_, err := db.Exec("delete from oidc_authorization_codes where client_id = ?", clientId)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("delete from oidc_clients where client_id = ?", clientId)
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("client %s does not exist", clientId)
+	}
+
+	return nil
+}
+
+// Store a new authorization code and return it. Only its hash is saved.
+func CreateOidcAuthorizationCode(db *sqlx.DB, code oidc.AuthorizationCode) (string, error) {
+	_, err := db.Exec("delete from oidc_authorization_codes where expires_at <= ?", time.Now().UTC())
+
+	if err != nil {
+		return "", err
+	}
+
+	rawCode, err := generateRandomHex(32)
+
+	if err != nil {
+		return "", fmt.Errorf("could not generate authorization code: %w", err)
+	}
+
+	code.HashedCode = utils.HashToken(rawCode)
+
+	_, err = db.NamedExec(
+		`insert into oidc_authorization_codes
+			(hashed_code, client_id, user_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, expires_at)
+		values
+			(:hashed_code, :client_id, :user_id, :redirect_uri, :scope, :nonce, :code_challenge, :code_challenge_method, :auth_time, :expires_at)`,
+		code,
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	return rawCode, nil
+}
+
+// Delete an authorization code so it can only be used once, and return it.
+// Returns nil if the code does not exist or was issued to another client, in
+// which case the code is left for its own client. The code is found and
+// deleted in one statement, so that only one of concurrent redemptions gets it.
+func ConsumeOidcAuthorizationCode(db *sqlx.DB, rawCode string, clientId string) (*oidc.AuthorizationCode, error) {
+	codes := []oidc.AuthorizationCode{}
+
+	err := db.Select(&codes, "delete from oidc_authorization_codes where hashed_code = ? and client_id = ? returning *", utils.HashToken(rawCode), clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(codes) != 1 {
+		return nil, nil
+	}
+
+	return &codes[0], nil
+}
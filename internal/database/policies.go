@@ -0,0 +1,89 @@
+package database
+
+import (
+	"fmt"
+
+	"authfish/internal/policy"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func CreatePolicy(db *sqlx.DB, host string, pathPrefix string, kind policy.Kind, subject *string) (*policy.Policy, error) {
+	host = policy.NormalizeHost(host)
+
+	if len(pathPrefix) == 0 {
+		pathPrefix = "/"
+	}
+
+	sqlResult, err := db.Exec(
+		"insert into policies (host, path_prefix, kind, subject) values ($1, $2, $3, $4)",
+		host,
+		pathPrefix,
+		kind,
+		subject,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new policy into database: %w", err)
+	}
+
+	id, err := sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted policy: %w", err)
+	}
+
+	newPolicy := policy.Policy{
+		Id:         id,
+		Host:       host,
+		PathPrefix: pathPrefix,
+		Kind:       kind,
+		Subject:    subject,
+	}
+
+	return &newPolicy, nil
+}
+
+func ListPolicies(db *sqlx.DB) ([]policy.Policy, error) {
+	policies := []policy.Policy{}
+
+	err := db.Select(&policies, "select * from policies order by host, path_prefix, id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func ListPoliciesForHost(db *sqlx.DB, host string) ([]policy.Policy, error) {
+	policies := []policy.Policy{}
+
+	err := db.Select(&policies, "select * from policies where host = ?", policy.NormalizeHost(host))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func DeletePolicy(db *sqlx.DB, id int64) error {
+	result, err := db.Exec("delete from policies where id = ?", id)
+
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("policy %d does not exist", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"authfish/internal/saml"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Register an app which logs users in over SAML.
+func CreateSamlServiceProvider(db *sqlx.DB, entityId string, acsUrls []string, nameIdField string, attributes []string) (*saml.ServiceProvider, error) {
+	entityId = strings.TrimSpace(entityId)
+
+	if len(entityId) == 0 {
+		return nil, fmt.Errorf("entity ID must not be empty")
+	}
+
+	if len(acsUrls) == 0 {
+		return nil, fmt.Errorf("at least one assertion consumer service URL is required")
+	}
+
+	for _, acsUrl := range acsUrls {
+		parsedUrl, err := url.Parse(acsUrl)
+
+		if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || len(parsedUrl.Host) == 0 || strings.ContainsAny(acsUrl, " \t\r\n") {
+			return nil, fmt.Errorf("invalid assertion consumer service URL: %q", acsUrl)
+		}
+	}
+
+	if err := saml.ValidateField(nameIdField); err != nil {
+		return nil, fmt.Errorf("invalid NameID: %w", err)
+	}
+
+	if nameIdField == saml.FieldGroups {
+		return nil, fmt.Errorf("invalid NameID: users can have any number of groups")
+	}
+
+	mappings := []string{}
+
+	for _, attribute := range attributes {
+		mapping, err := saml.ParseAttributeMapping(attribute)
+
+		if err != nil {
+			return nil, err
+		}
+
+		mappings = append(mappings, mapping.String())
+	}
+
+	existing, err := FindSamlServiceProvider(db, entityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, fmt.Errorf("service provider %s already exists", entityId)
+	}
+
+	sp := saml.ServiceProvider{
+		EntityId:    entityId,
+		AcsUrls:     strings.Join(acsUrls, " "),
+		NameIdField: nameIdField,
+		Attributes:  strings.Join(mappings, " "),
+	}
+
+	sqlResult, err := db.NamedExec(
+		"insert into saml_service_providers (entity_id, acs_urls, name_id_field, attributes) values (:entity_id, :acs_urls, :name_id_field, :attributes)",
+		sp,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new service provider into the database: %w", err)
+	}
+
+	sp.Id, err = sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted service provider: %w", err)
+	}
+
+	return &sp, nil
+}
+
+func FindSamlServiceProvider(db *sqlx.DB, entityId string) (*saml.ServiceProvider, error) {
+	serviceProviders := []saml.ServiceProvider{}
+
+	err := db.Select(&serviceProviders, "select * from saml_service_providers where entity_id = ? limit 1", entityId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(serviceProviders) != 1 {
+		return nil, nil
+	}
+
+	return &serviceProviders[0], nil
+}
+
+func ListSamlServiceProviders(db *sqlx.DB) ([]saml.ServiceProvider, error) {
+	serviceProviders := []saml.ServiceProvider{}
+
+	err := db.Select(&serviceProviders, "select * from saml_service_providers order by entity_id")
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceProviders, nil
+}
+
+func DeleteSamlServiceProvider(db *sqlx.DB, entityId string) error {
+	result, err := db.Exec("delete from saml_service_providers where entity_id = ?", entityId)
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("service provider %s does not exist", entityId)
+	}
+
+	return nil
+}
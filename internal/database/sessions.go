@@ -0,0 +1,154 @@
+package database
+
+import (
+	"fmt"
+
+	"authfish/internal/user"
+	"authfish/internal/user_session"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// Avoid writing to the database on every request just to bump last_seen_at
+	sessionTouchInterval = "-60 seconds"
+)
+
+func FindUserSessionByTokenHash(db *sqlx.DB, tokenHash string) (*user_session.UserSession, error) {
+	userSessions := []user_session.UserSession{}
+
+	err := db.Select(&userSessions,
+		"select * from sessions where token_hash = ? and expires_at > datetime('now') limit 1",
+		tokenHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(userSessions) != 1 {
+		return nil, nil
+	}
+
+	return &userSessions[0], nil
+}
+
+// Insert or update the session with tokenHash, which expires after maxAge
+// seconds. Expired sessions are cleaned up at the same time.
+func SaveUserSession(db *sqlx.DB, tokenHash string, userId *int64, data []byte, ipAddress string, userAgent string, maxAge int) error {
+	_, err := db.Exec("delete from sessions where expires_at <= datetime('now')")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`insert into sessions (token_hash, user_id, data, ip_address, user_agent, expires_at)
+		values ($1, $2, $3, $4, $5, datetime('now', $6))
+		on conflict(token_hash) do update set
+			user_id = excluded.user_id,
+			data = excluded.data,
+			ip_address = excluded.ip_address,
+			user_agent = excluded.user_agent,
+			last_seen_at = current_timestamp,
+			expires_at = excluded.expires_at`,
+		tokenHash,
+		userId,
+		data,
+		ipAddress,
+		userAgent,
+		fmt.Sprintf("+%d seconds", maxAge),
+	)
+
+	if err != nil {
+		return fmt.Errorf("error saving session: %w", err)
+	}
+
+	return nil
+}
+
+func TouchUserSession(db *sqlx.DB, userSession user_session.UserSession, ipAddress string, userAgent string) error {
+	_, err := db.Exec(
+		"update sessions set last_seen_at = current_timestamp, ip_address = ?, user_agent = ? where id = ? and last_seen_at < datetime('now', ?)",
+		ipAddress,
+		userAgent,
+		userSession.Id,
+		sessionTouchInterval,
+	)
+
+	return err
+}
+
+func ListUserSessions(db *sqlx.DB) ([]user_session.UserSession, error) {
+	userSessions := []user_session.UserSession{}
+
+	err := db.Select(&userSessions,
+		"select * from sessions where user_id is not null and expires_at > datetime('now') order by user_id, last_seen_at desc",
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userSessions, nil
+}
+
+func ListUserSessionsForUser(db *sqlx.DB, user user.User) ([]user_session.UserSession, error) {
+	userSessions := []user_session.UserSession{}
+
+	err := db.Select(&userSessions,
+		"select * from sessions where user_id = ? and expires_at > datetime('now') order by last_seen_at desc",
+		user.Id,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userSessions, nil
+}
+
+func DeleteUserSessionByTokenHash(db *sqlx.DB, tokenHash string) error {
+	_, err := db.Exec("delete from sessions where token_hash = ?", tokenHash)
+	return err
+}
+
+func RevokeUserSession(db *sqlx.DB, id int64) error {
+	result, err := db.Exec("delete from sessions where id = ?", id)
+
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deletedCount != 1 {
+		return fmt.Errorf("session %d does not exist", id)
+	}
+
+	return nil
+}
+
+// Like RevokeUserSession, but only if the session belongs to user.
+func RevokeUserSessionForUser(db *sqlx.DB, user user.User, id int64) error {
+	_, err := db.Exec("delete from sessions where id = ? and user_id = ?", id, user.Id)
+	return err
+}
+
+// Log user out everywhere except for the session with keepTokenHash.
+func RevokeOtherUserSessionsForUser(db *sqlx.DB, user user.User, keepTokenHash string) error {
+	_, err := db.Exec("delete from sessions where user_id = ? and token_hash != ?", user.Id, keepTokenHash)
+	return err
+}
+
+func RevokeAllUserSessionsForUser(db *sqlx.DB, user user.User) (int64, error) {
+	result, err := db.Exec("delete from sessions where user_id = ?", user.Id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
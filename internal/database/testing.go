@@ -0,0 +1,40 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"authfish/internal/user"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Opens a migrated database in a temporary directory for a test. An in
+// memory database won't do, since every connection of the pool would get its
+// own.
+func OpenTestDB(t testing.TB) *sqlx.DB {
+	db := OpenDB(filepath.Join(t.TempDir(), "authfish.db"))
+	t.Cleanup(func() { db.Close() })
+	RunMigrations(db)
+
+	return db
+}
+
+// Creates a user who has signed up and been approved, or fails the test.
+func CreateTestUser(t testing.TB, db *sqlx.DB, username string, password string) *user.User {
+	u, err := SignUpUser(db, username, password)
+
+	if err == nil {
+		err = ApproveUser(db, *u)
+	}
+
+	if err == nil {
+		u, err = FindUserById(db, u.Id)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"fmt"
+
+	"authfish/internal/totp"
+	"authfish/internal/user"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func FindTotpCredential(db *sqlx.DB, user user.User) (*totp.Credential, error) {
+	credentials := []totp.Credential{}
+
+	err := db.Select(&credentials, "select * from totp_credentials where user_id = ? limit 1", user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(credentials) != 1 {
+		return nil, nil
+	}
+
+	return &credentials[0], nil
+}
+
+// Store a new, unconfirmed secret for user, replacing any earlier unconfirmed
+// secret. Fails if the user already has a confirmed secret.
+func CreatePendingTotpCredential(db *sqlx.DB, user user.User, secret string) (*totp.Credential, error) {
+	existing, err := FindTotpCredential(db, user)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if existing != nil && existing.IsConfirmed() {
+		return nil, fmt.Errorf("two-factor authentication is already enabled for %s", user.Username)
+	}
+
+	_, err = db.Exec("insert or replace into totp_credentials (user_id, secret) values ($1, $2)", user.Id, secret)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting totp secret into database: %w", err)
+	}
+
+	return &totp.Credential{
+		UserId: user.Id,
+		Secret: secret,
+	}, nil
+}
+
+// Activate the pending secret for user and replace their recovery codes.
+func ConfirmTotpCredential(db *sqlx.DB, user user.User, step int64, recoveryCodes []string) error {
+	tx, err := db.Beginx()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"update totp_credentials set confirmed_at = current_timestamp, last_used_step = ? where user_id = ? and confirmed_at is null",
+		step,
+		user.Id,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	updatedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if updatedCount != 1 {
+		return fmt.Errorf("no pending two-factor authentication setup for %s", user.Username)
+	}
+
+	_, err = tx.Exec("delete from recovery_codes where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec(
+			"insert into recovery_codes (user_id, hashed_code) values ($1, $2)",
+			user.Id,
+			totp.HashRecoveryCode(code),
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Record step as the most recently used code. Returns an error if step has
+// already been used, which means the code is being replayed.
+func UpdateTotpLastUsedStep(db *sqlx.DB, user user.User, step int64) error {
+	result, err := db.Exec(
+		"update totp_credentials set last_used_step = ? where user_id = ? and last_used_step < ?",
+		step,
+		user.Id,
+		step,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	updatedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if updatedCount != 1 {
+		return fmt.Errorf("two-factor code has already been used")
+	}
+
+	return nil
+}
+
+func DeleteTotpCredential(db *sqlx.DB, user user.User) error {
+	_, err := db.Exec("delete from recovery_codes where user_id = ?", user.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from totp_credentials where user_id = ?", user.Id)
+	return err
+}
+
+// Mark an unused recovery code as used. Returns false if code is not one of
+// user's unused recovery codes.
+func ConsumeRecoveryCode(db *sqlx.DB, user user.User, code string) (bool, error) {
+	result, err := db.Exec(
+		"update recovery_codes set used_at = current_timestamp where user_id = ? and hashed_code = ? and used_at is null",
+		user.Id,
+		totp.HashRecoveryCode(code),
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	updatedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return updatedCount > 0, nil
+}
+
+func CountUnusedRecoveryCodes(db *sqlx.DB, user user.User) (int, error) {
+	count := 0
+
+	err := db.Get(&count, "select count(*) from recovery_codes where user_id = ? and used_at is null", user.Id)
+
+	return count, err
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"authfish/internal/totp"
+	"authfish/internal/user"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Enables two-factor authentication for a new user, and returns the user and
+// their recovery codes.
+func createTotpUser(t *testing.T, db *sqlx.DB, username string, step int64) (*user.User, []string) {
+	u := CreateTestUser(t, db, username, "correct horse battery staple")
+
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoveryCodes, err := totp.GenerateRecoveryCodes()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreatePendingTotpCredential(db, *u, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConfirmTotpCredential(db, *u, step, recoveryCodes); err != nil {
+		t.Fatal(err)
+	}
+
+	return u, recoveryCodes
+}
+
+func TestUpdateTotpLastUsedStep(t *testing.T) {
+	db := OpenTestDB(t)
+	step := totp.Step(time.Now())
+	u, _ := createTotpUser(t, db, "alice", step)
+
+	// The code used to confirm the setup can't log in
+	if err := UpdateTotpLastUsedStep(db, *u, step); err == nil {
+		t.Error("step used to confirm was accepted")
+	}
+
+	if err := UpdateTotpLastUsedStep(db, *u, step+1); err != nil {
+		t.Fatalf("next step was rejected: %v", err)
+	}
+
+	if err := UpdateTotpLastUsedStep(db, *u, step+1); err == nil {
+		t.Error("replayed step was accepted")
+	}
+
+	// A code of the previous step is still in the window, but older
+	if err := UpdateTotpLastUsedStep(db, *u, step); err == nil {
+		t.Error("older step was accepted")
+	}
+}
+
+func TestConsumeRecoveryCode(t *testing.T) {
+	db := OpenTestDB(t)
+	alice, aliceCodes := createTotpUser(t, db, "alice", 1)
+	bob, _ := createTotpUser(t, db, "bob", 1)
+
+	if ok, err := ConsumeRecoveryCode(db, *bob, aliceCodes[0]); err != nil || ok {
+		t.Errorf("got %v and error %v for the code of another user", ok, err)
+	}
+
+	if ok, err := ConsumeRecoveryCode(db, *alice, aliceCodes[0]); err != nil || !ok {
+		t.Fatalf("got %v and error %v for an unused code", ok, err)
+	}
+
+	if ok, err := ConsumeRecoveryCode(db, *alice, aliceCodes[0]); err != nil || ok {
+		t.Errorf("got %v and error %v for a used code", ok, err)
+	}
+
+	if ok, err := ConsumeRecoveryCode(db, *alice, "not a recovery code"); err != nil || ok {
+		t.Errorf("got %v and error %v for an unknown code", ok, err)
+	}
+
+	count, err := CountUnusedRecoveryCodes(db, *alice)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != totp.RecoveryCodeCount-1 {
+		t.Errorf("got %d unused codes, want %d", count, totp.RecoveryCodeCount-1)
+	}
+}
+
+func TestDeleteTotpCredentialDeletesRecoveryCodes(t *testing.T) {
+	db := OpenTestDB(t)
+	u, recoveryCodes := createTotpUser(t, db, "alice", 1)
+
+	if err := DeleteTotpCredential(db, *u); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := ConsumeRecoveryCode(db, *u, recoveryCodes[0]); err != nil || ok {
+		t.Errorf("got %v and error %v for a code of a deleted setup", ok, err)
+	}
+}
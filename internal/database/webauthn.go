@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+
+	"authfish/internal/user"
+	"authfish/internal/webauthn"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Remember a challenge we sent to a browser. Registration challenges belong to
+// the logged in user, login challenges have a nil userId.
+func CreateWebauthnChallenge(db *sqlx.DB, challenge []byte, userId *int64) error {
+	_, err := db.Exec(
+		"delete from webauthn_challenges where created_at <= datetime('now', ?)",
+		challengeTimeoutModifier(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("insert into webauthn_challenges (challenge, user_id) values ($1, $2)", challenge, userId)
+	return err
+}
+
+// Delete a challenge so it can only be used once. Returns false if the
+// challenge was never issued to userId, or has expired.
+func ConsumeWebauthnChallenge(db *sqlx.DB, challenge []byte, userId *int64) (bool, error) {
+	result, err := db.Exec(
+		"delete from webauthn_challenges where challenge = ? and user_id is ? and created_at > datetime('now', ?)",
+		challenge,
+		userId,
+		challengeTimeoutModifier(),
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	deletedCount, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return deletedCount == 1, nil
+}
+
+func challengeTimeoutModifier() string {
+	return fmt.Sprintf("-%d seconds", int(webauthn.ChallengeTimeout.Seconds()))
+}
+
+func CreateWebauthnCredential(db *sqlx.DB, user user.User, credential webauthn.Credential) (*webauthn.Credential, error) {
+	sqlResult, err := db.Exec(
+		"insert into webauthn_credentials (user_id, name, credential_id, public_key, sign_count) values ($1, $2, $3, $4, $5)",
+		user.Id,
+		credential.Name,
+		credential.CredentialId,
+		credential.PublicKey,
+		credential.SignCount,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new passkey into database: %w", err)
+	}
+
+	id, err := sqlResult.LastInsertId()
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ID of newly inserted passkey: %w", err)
+	}
+
+	credential.Id = id
+	credential.UserId = user.Id
+
+	return &credential, nil
+}
+
+func FindWebauthnCredentialByCredentialId(db *sqlx.DB, credentialId []byte) (*webauthn.Credential, error) {
+	credentials := []webauthn.Credential{}
+
+	err := db.Select(&credentials, "select * from webauthn_credentials where credential_id = ? limit 1", credentialId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(credentials) != 1 {
+		return nil, nil
+	}
+
+	return &credentials[0], nil
+}
+
+func ListWebauthnCredentials(db *sqlx.DB, user user.User) ([]webauthn.Credential, error) {
+	credentials := []webauthn.Credential{}
+
+	err := db.Select(&credentials, "select * from webauthn_credentials where user_id = ? order by created_at", user.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func UpdateWebauthnCredentialUsage(db *sqlx.DB, credential webauthn.Credential, signCount int64) error {
+	_, err := db.Exec(
+		"update webauthn_credentials set sign_count = ?, last_used_at = current_timestamp where id = ?",
+		signCount,
+		credential.Id,
+	)
+
+	return err
+}
+
+func DeleteWebauthnCredential(db *sqlx.DB, user user.User, id int64) error {
+	_, err := db.Exec("delete from webauthn_credentials where id = ? and user_id = ?", id, user.Id)
+	return err
+}
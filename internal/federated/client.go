@@ -0,0 +1,235 @@
+package federated
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"authfish/internal/oidc"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Endpoints from an OpenID Connect discovery document.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func Discover(issuer string) (*Discovery, error) {
+	discovery := Discovery{}
+
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, issuer)
+	}
+
+	return &discovery, nil
+}
+
+// Where to send the user to log in with p.
+func (p Provider) AuthorizationRequestUrl(redirectUri string, state string, nonce string, codeChallenge string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientId},
+		"redirect_uri":          {redirectUri},
+		"scope":                 {p.Scopes},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {oidc.CodeChallengeMethodS256},
+	}
+
+	if p.IsOidc() {
+		params.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationUrl, "?") {
+		separator = "&"
+	}
+
+	return p.AuthorizationUrl + separator + params.Encode()
+}
+
+// Exchange the authorization code the user came back with for claims about
+// them. With OpenID Connect the claims come from the verified ID token, and
+// from the userinfo endpoint for anything the ID token is missing.
+func (p Provider) FetchClaims(redirectUri string, code string, codeVerifier string, nonce string) (oidc.Claims, error) {
+	tokens, err := p.exchangeCode(redirectUri, code, codeVerifier)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims := oidc.Claims{}
+
+	if p.IsOidc() {
+		claims, err = p.verifyIdToken(tokens.IdToken, nonce)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid id token: %w", err)
+		}
+	}
+
+	if len(p.UserinfoUrl) > 0 && (len(claims.String(p.SubjectClaim)) == 0 || len(claims.String(p.UsernameClaim)) == 0) {
+		userinfo := oidc.Claims{}
+
+		if err := getJSON(p.UserinfoUrl, tokens.AccessToken, &userinfo); err != nil {
+			return nil, fmt.Errorf("could not fetch userinfo: %w", err)
+		}
+
+		// The subject of an ID token can't be overridden by userinfo
+		if p.IsOidc() && userinfo.String("sub") != claims.String("sub") {
+			return nil, fmt.Errorf("userinfo is for a different subject than the id token")
+		}
+
+		for name, value := range userinfo {
+			if _, ok := claims[name]; !ok {
+				claims[name] = value
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+func (p Provider) exchangeCode(redirectUri string, code string, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectUri},
+		"code_verifier": {codeVerifier},
+		"client_id":     {p.ClientId},
+		"client_secret": {p.ClientSecret},
+	}
+
+	request, err := http.NewRequest(http.MethodPost, p.TokenUrl, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Some OAuth2 providers respond with a form encoded body otherwise
+	request.Header.Set("Accept", "application/json")
+
+	response, err := httpClient.Do(request)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not reach token endpoint: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	tokens := tokenResponse{}
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("malformed token response (status %d)", response.StatusCode)
+	}
+
+	if len(tokens.Error) > 0 {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", tokens.Error, tokens.Description)
+	}
+
+	if response.StatusCode != http.StatusOK || len(tokens.AccessToken) == 0 {
+		return nil, fmt.Errorf("token endpoint returned status %d", response.StatusCode)
+	}
+
+	return &tokens, nil
+}
+
+func (p Provider) verifyIdToken(idToken string, nonce string) (oidc.Claims, error) {
+	if len(idToken) == 0 {
+		return nil, fmt.Errorf("no id token in token response")
+	}
+
+	response, err := httpClient.Get(p.JwksUrl)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch JWKS: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch JWKS: %w", err)
+	}
+
+	keys, err := oidc.ParseJwks(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := oidc.VerifyToken(idToken, keys, "", "JWT")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.String("iss") != p.Issuer {
+		return nil, fmt.Errorf("issued by %q instead of %q", claims.String("iss"), p.Issuer)
+	}
+
+	if !claims.HasAudience(p.ClientId) {
+		return nil, fmt.Errorf("not issued for client %s", p.ClientId)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("nonce does not match")
+	}
+
+	return claims, nil
+}
+
+func getJSON(url string, bearerToken string, value interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	if len(bearerToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	response, err := httpClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, response.StatusCode)
+	}
+
+	decoder := json.NewDecoder(io.LimitReader(response.Body, 1<<20))
+	// Keep numeric ids, like GitHub's, exact
+	decoder.UseNumber()
+
+	return decoder.Decode(value)
+}
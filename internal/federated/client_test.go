@@ -0,0 +1,243 @@
+package federated
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"authfish/internal/oidc"
+)
+
+const (
+	testClientId    = "authfish"
+	testCode        = "code-from-provider"
+	testAccessToken = "access-token"
+	testNonce       = "nonce-from-login"
+)
+
+// A stand-in OpenID Connect provider. Its token endpoint returns idToken
+// signed by tokenKey, while its JWKS only has jwksKey.
+type testProvider struct {
+	server   *httptest.Server
+	jwksKey  *oidc.SigningKey
+	tokenKey *oidc.SigningKey
+	idToken  oidc.Claims
+	userinfo oidc.Claims
+}
+
+func newTestSigningKey(t *testing.T) *oidc.SigningKey {
+	key, err := oidc.LoadOrCreateSigningKey(filepath.Join(t.TempDir(), "signing_key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newTestProvider(t *testing.T, key *oidc.SigningKey) *testProvider {
+	p := &testProvider{jwksKey: key, tokenKey: key}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != testCode || r.FormValue("client_id") != testClientId || len(r.FormValue("code_verifier")) == 0 {
+			writeTestJSON(rw, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		response := map[string]string{"access_token": testAccessToken, "token_type": "Bearer"}
+
+		if p.idToken != nil {
+			idToken, err := p.tokenKey.Sign("JWT", p.idToken)
+
+			if err != nil {
+				t.Error(err)
+			}
+
+			response["id_token"] = idToken
+		}
+
+		writeTestJSON(rw, http.StatusOK, response)
+	})
+
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		writeTestJSON(rw, http.StatusOK, p.jwksKey.Jwks())
+	})
+
+	mux.HandleFunc("/userinfo", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		writeTestJSON(rw, http.StatusOK, p.userinfo)
+	})
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *testProvider) oidcProvider() Provider {
+	return Provider{
+		Name:             "test",
+		Issuer:           p.server.URL,
+		ClientId:         testClientId,
+		ClientSecret:     "secret",
+		AuthorizationUrl: p.server.URL + "/authorize",
+		TokenUrl:         p.server.URL + "/token",
+		UserinfoUrl:      p.server.URL + "/userinfo",
+		JwksUrl:          p.server.URL + "/jwks",
+		SubjectClaim:     "sub",
+		UsernameClaim:    "preferred_username",
+	}
+}
+
+// Claims of a valid ID token for the provider.
+func (p *testProvider) validIdToken() oidc.Claims {
+	return oidc.Claims{
+		"iss":                p.server.URL,
+		"aud":                testClientId,
+		"sub":                "subject-1",
+		"preferred_username": "alice",
+		"nonce":              testNonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func writeTestJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+func TestFetchClaims(t *testing.T) {
+	key := newTestSigningKey(t)
+	unknownKey := newTestSigningKey(t)
+
+	tests := []struct {
+		name string
+		// Changes the provider's responses from a valid login
+		setup        func(p *testProvider)
+		wantUsername string
+		wantErr      string
+	}{
+		{
+			name:         "valid id token",
+			wantUsername: "alice",
+		},
+		{
+			name: "username from userinfo",
+			setup: func(p *testProvider) {
+				delete(p.idToken, "preferred_username")
+				p.userinfo = oidc.Claims{"sub": "subject-1", "preferred_username": "alice"}
+			},
+			wantUsername: "alice",
+		},
+		{
+			name:    "nonce mismatch",
+			setup:   func(p *testProvider) { p.idToken["nonce"] = "nonce-of-another-login" },
+			wantErr: "nonce does not match",
+		},
+		{
+			name:    "missing nonce",
+			setup:   func(p *testProvider) { delete(p.idToken, "nonce") },
+			wantErr: "nonce does not match",
+		},
+		{
+			name:    "wrong issuer",
+			setup:   func(p *testProvider) { p.idToken["iss"] = "https://evil.example.org" },
+			wantErr: "issued by",
+		},
+		{
+			name:    "wrong audience",
+			setup:   func(p *testProvider) { p.idToken["aud"] = "another-client" },
+			wantErr: "not issued for client",
+		},
+		{
+			name:    "expired",
+			setup:   func(p *testProvider) { p.idToken["exp"] = time.Now().Add(-time.Hour).Unix() },
+			wantErr: "invalid id token",
+		},
+		{
+			name:    "signed with an unknown kid",
+			setup:   func(p *testProvider) { p.tokenKey = unknownKey },
+			wantErr: "invalid id token",
+		},
+		{
+			name:    "no id token",
+			setup:   func(p *testProvider) { p.idToken = nil },
+			wantErr: "no id token",
+		},
+		{
+			name: "userinfo for a different subject",
+			setup: func(p *testProvider) {
+				delete(p.idToken, "preferred_username")
+				p.userinfo = oidc.Claims{"sub": "subject-2", "preferred_username": "mallory"}
+			},
+			wantErr: "different subject",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvider(t, key)
+			p.idToken = p.validIdToken()
+
+			if test.setup != nil {
+				test.setup(p)
+			}
+
+			claims, err := p.oidcProvider().FetchClaims("https://auth.example.com/login/federated/callback", testCode, "verifier", testNonce)
+
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if claims.String("sub") != "subject-1" || claims.String("preferred_username") != test.wantUsername {
+				t.Errorf("got claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestFetchClaimsWithOAuth2(t *testing.T) {
+	p := newTestProvider(t, newTestSigningKey(t))
+	p.userinfo = oidc.Claims{"id": json.Number("1234"), "login": "alice"}
+
+	// Without an issuer and JWKS, everything comes from userinfo
+	provider := p.oidcProvider()
+	provider.Issuer = ""
+	provider.JwksUrl = ""
+	provider.SubjectClaim = "id"
+	provider.UsernameClaim = "login"
+
+	claims, err := provider.FetchClaims("https://auth.example.com/login/federated/callback", testCode, "verifier", "")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if claims.String("id") != "1234" || claims.String("login") != "alice" {
+		t.Errorf("got claims %v", claims)
+	}
+
+	if _, err := provider.FetchClaims("https://auth.example.com/login/federated/callback", "wrong-code", "verifier", ""); err == nil {
+		t.Error("a code the provider refused was accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package federated
+
+import (
+	"fmt"
+	"time"
+)
+
+// What to do when someone logs in with an external identity which is not
+// linked to a user yet.
+const (
+	// Refuse. Users link identities themselves from /me.
+	MappingLink = "link"
+	// Link it to the user with the same username, if there is one. Only use
+	// this for providers which you control, since anyone who can pick a
+	// username there can log in as that user here.
+	MappingUsername = "username"
+	// Create a new user, which can't log in until an admin approves it.
+	MappingCreate = "create"
+)
+
+// An external OpenID Connect or OAuth2 identity provider users can log in with.
+type Provider struct {
+	Id               int64     `db:"id"`
+	Name             string    `db:"name"`
+	Issuer           string    `db:"issuer"` // Empty for plain OAuth2 providers
+	ClientId         string    `db:"client_id"`
+	ClientSecret     string    `db:"client_secret"`
+	AuthorizationUrl string    `db:"authorization_url"`
+	TokenUrl         string    `db:"token_url"`
+	UserinfoUrl      string    `db:"userinfo_url"`
+	JwksUrl          string    `db:"jwks_url"`
+	Scopes           string    `db:"scopes"` // Space separated
+	SubjectClaim     string    `db:"subject_claim"`
+	UsernameClaim    string    `db:"username_claim"`
+	Mapping          string    `db:"mapping"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+func ValidateMapping(mapping string) error {
+	switch mapping {
+	case MappingLink, MappingUsername, MappingCreate:
+		return nil
+	default:
+		return fmt.Errorf("mapping must be one of %s, %s or %s: %q", MappingLink, MappingUsername, MappingCreate, mapping)
+	}
+}
+
+// Whether ID tokens from p can be verified. Otherwise claims come from the
+// userinfo endpoint.
+func (p Provider) IsOidc() bool {
+	return len(p.Issuer) > 0 && len(p.JwksUrl) > 0
+}
+
+// An external identity linked to a user.
+type Identity struct {
+	Id         int64      `db:"id"`
+	ProviderId int64      `db:"provider_id"`
+	Subject    string     `db:"subject"`
+	UserId     int64      `db:"user_id"`
+	Username   string     `db:"username"` // As known by the provider, for display
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+
+	// Filled in when listing identities
+	ProviderName string `db:"provider_name"`
+}
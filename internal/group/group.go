@@ -0,0 +1,9 @@
+package group
+
+import "time"
+
+type Group struct {
+	Id        int64     `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
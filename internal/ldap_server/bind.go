@@ -0,0 +1,187 @@
+package ldap_server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"authfish/internal/authenticator"
+	"authfish/internal/database"
+	"authfish/internal/lockout"
+	"authfish/internal/user"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Only simple binds with the DN of a user entry are supported, and anonymous
+// binds, which can only read the root DSE.
+func (s *Server) bind(c *connection, messageId int64, op *ber.Packet) *ber.Packet {
+	// A failed bind leaves the connection anonymous
+	c.userId = 0
+
+	if len(op.Children) < 3 {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError, "malformed bind request")
+	}
+
+	if version, _ := op.Children[0].Value.(int64); version != 3 {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError, "only LDAPv3 is supported")
+	}
+
+	name := op.Children[1].Data.String()
+	auth := op.Children[2]
+
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultAuthMethodNotSupported, "only simple binds are supported")
+	}
+
+	password := auth.Data.String()
+
+	if len(name) == 0 && len(password) == 0 {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+	}
+
+	// A DN without password is an unauthenticated bind, which some apps
+	// mistake for a successful login.
+	if len(password) == 0 {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultUnwillingToPerform, "a password is required")
+	}
+
+	username, ok := s.usernameFromDn(name)
+
+	if !ok {
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, fmt.Sprintf("not a user DN: %s", name))
+	}
+
+	u, err := s.checkCredentials(username, password, c.ip)
+
+	if err != nil {
+		// The details would tell clients which usernames exist
+		log.Printf("Failed LDAP bind as %s from %s: %v", username, c.ip, err)
+		return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, "invalid credentials")
+	}
+
+	c.userId = u.Id
+
+	return result(messageId, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+}
+
+// Checks password against the API keys and the password of username, with the
+// same lockouts as the login form.
+func (s *Server) checkCredentials(username string, password string, ip string) (*user.User, error) {
+	activeLockout, err := authenticator.FindActiveLockout(s.db, username, ip)
+
+	if err != nil {
+		return nil, fmt.Errorf("error running database query: %w", err)
+	}
+
+	if activeLockout != nil {
+		return nil, activeLockout
+	}
+
+	u, err := s.checkApiKey(username, password, ip)
+
+	if err == nil && u == nil {
+		u, err = s.checkPassword(username, password)
+	}
+
+	if err != nil {
+		if newLockout := authenticator.RecordFailure(s.db, username, ip); newLockout != nil {
+			return nil, newLockout
+		}
+
+		return nil, err
+	}
+
+	if err := database.ClearLockout(s.db, lockout.KindUsername, username); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", username, err)
+	}
+
+	if u.IsDisabled() {
+		return nil, fmt.Errorf("user %s is disabled", u.Username)
+	}
+
+	if !u.IsActive() {
+		return nil, fmt.Errorf("user %s is %s", u.Username, u.Status)
+	}
+
+	return u, nil
+}
+
+// Returns nil without error if password is not an API key of username. Keys
+// restricted to hosts only work for those hosts, so they can't bind.
+func (s *Server) checkApiKey(username string, password string, ip string) (*user.User, error) {
+	k, err := database.FindApiKey(s.db, password)
+
+	if err != nil || k == nil {
+		return nil, err
+	}
+
+	u, err := database.FindUserById(s.db, k.UserId)
+
+	if err != nil || u == nil || u.Username != username {
+		return nil, err
+	}
+
+	if k.IsExpired() {
+		return nil, fmt.Errorf("api key %s has expired", k.Prefix)
+	}
+
+	if k.IsRestrictedToHosts() {
+		return nil, fmt.Errorf("api key %s is restricted to hosts", k.Prefix)
+	}
+
+	if err := database.RecordApiKeyUsage(s.db, k.Id, 1, time.Now(), ip); err != nil {
+		log.Printf("Error recording use of api key %s: %v", k.Prefix, err)
+	}
+
+	return u, nil
+}
+
+// LDAP has no way to ask for a second factor, so users with two-factor
+// authentication enabled have to bind with an API key.
+func (s *Server) checkPassword(username string, password string) (*user.User, error) {
+	u, err := database.FindUserByUsername(s.db, username)
+
+	if err != nil {
+		return nil, fmt.Errorf("error running database query: %w", err)
+	}
+
+	if u != nil {
+		totpCredential, err := database.FindTotpCredential(s.db, *u)
+
+		if err != nil {
+			return nil, fmt.Errorf("error running database query: %w", err)
+		}
+
+		if totpCredential != nil && totpCredential.IsConfirmed() {
+			return nil, fmt.Errorf("%s has two-factor authentication enabled, bind with an API key instead", username)
+		}
+	}
+
+	return s.authenticator.Authenticate(username, password)
+}
+
+// Returns the username in a DN like uid=alice,ou=people,<base DN>.
+func (s *Server) usernameFromDn(dn string) (string, bool) {
+	parsedDn, err := ldap.ParseDN(dn)
+
+	if err != nil {
+		return "", false
+	}
+
+	peopleDn, _ := ldap.ParseDN(s.peopleDn())
+
+	if len(parsedDn.RDNs) != len(peopleDn.RDNs)+1 || !peopleDn.AncestorOfFold(parsedDn) {
+		return "", false
+	}
+
+	attributes := parsedDn.RDNs[0].Attributes
+
+	if len(attributes) != 1 || !strings.EqualFold(attributes[0].Type, "uid") {
+		return "", false
+	}
+
+	return attributes[0].Value, true
+}
@@ -0,0 +1,176 @@
+package ldap_server
+
+import (
+	"strings"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Attributes whose values are DNs, which are compared as DNs in filters.
+var dnAttributes = map[string]bool{
+	"member":   true,
+	"memberof": true,
+}
+
+type attribute struct {
+	name   string
+	values []string
+}
+
+type entry struct {
+	dn         string
+	attributes []attribute
+}
+
+// Returns the values of the attribute called name, or nil if e does not have
+// it.
+func (e entry) get(name string) []string {
+	for _, a := range e.attributes {
+		if strings.EqualFold(a.name, name) {
+			return a.values
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) peopleDn() string {
+	return "ou=people," + s.baseDn
+}
+
+func (s *Server) groupsDn() string {
+	return "ou=groups," + s.baseDn
+}
+
+func (s *Server) userDn(username string) string {
+	return rdn("uid", username) + "," + s.peopleDn()
+}
+
+func (s *Server) groupDn(name string) string {
+	return rdn("cn", name) + "," + s.groupsDn()
+}
+
+// Escapes value for use in a DN.
+func rdn(attributeType string, value string) string {
+	return (&ldap.AttributeTypeAndValue{Type: attributeType, Value: value}).String()
+}
+
+// Tells clients where the directory is. Only returned for a base object
+// search of the empty DN.
+func (s *Server) rootDse() entry {
+	return entry{
+		dn: "",
+		attributes: []attribute{
+			{"objectClass", []string{"top"}},
+			{"namingContexts", []string{s.baseDn}},
+			{"supportedLDAPVersion", []string{"3"}},
+			{"vendorName", []string{"authfish"}},
+		},
+	}
+}
+
+// Builds the directory from the database. Users who can't log in, because
+// they are pending or disabled, are left out.
+//
+//	<base DN>
+//	├── ou=people
+//	│   └── uid=<username>
+//	└── ou=groups
+//	    └── cn=<group name>
+func (s *Server) loadEntries() ([]entry, error) {
+	parsedBaseDn, _ := ldap.ParseDN(s.baseDn)
+	baseRdn := parsedBaseDn.RDNs[0].Attributes[0]
+
+	entries := []entry{
+		{
+			dn: s.baseDn,
+			attributes: []attribute{
+				{"objectClass", []string{"top"}},
+				{baseRdn.Type, []string{baseRdn.Value}},
+			},
+		},
+		{
+			dn: s.peopleDn(),
+			attributes: []attribute{
+				{"objectClass", []string{"top", "organizationalUnit"}},
+				{"ou", []string{"people"}},
+			},
+		},
+		{
+			dn: s.groupsDn(),
+			attributes: []attribute{
+				{"objectClass", []string{"top", "organizationalUnit"}},
+				{"ou", []string{"groups"}},
+			},
+		},
+	}
+
+	users, err := database.ListUsers(s.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := database.ListGroups(s.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	activeUsers := map[int64]user.User{}
+	memberOf := map[int64][]string{}
+
+	for _, u := range users {
+		if u.IsActive() {
+			activeUsers[u.Id] = u
+		}
+	}
+
+	for _, g := range groups {
+		members, err := database.ListGroupMembers(s.db, g)
+
+		if err != nil {
+			return nil, err
+		}
+
+		memberDns := []string{}
+
+		for _, member := range members {
+			if _, ok := activeUsers[member.Id]; ok {
+				memberDns = append(memberDns, s.userDn(member.Username))
+				memberOf[member.Id] = append(memberOf[member.Id], s.groupDn(g.Name))
+			}
+		}
+
+		entries = append(entries, entry{
+			dn: s.groupDn(g.Name),
+			attributes: []attribute{
+				{"objectClass", []string{"top", "groupOfNames"}},
+				{"cn", []string{g.Name}},
+				{"member", memberDns},
+			},
+		})
+	}
+
+	for _, u := range users {
+		if !u.IsActive() {
+			continue
+		}
+
+		entries = append(entries, entry{
+			dn: s.userDn(u.Username),
+			attributes: []attribute{
+				{"objectClass", []string{"top", "person", "organizationalPerson", "inetOrgPerson"}},
+				{"uid", []string{u.Username}},
+				{"cn", []string{u.Username}},
+				{"sn", []string{u.Username}},
+				{"memberOf", memberOf[u.Id]},
+			},
+		})
+	}
+
+	return entries, nil
+}
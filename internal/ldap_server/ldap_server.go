@@ -0,0 +1,181 @@
+package ldap_server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"authfish/internal/authenticator"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// Connections without any requests for this long are closed.
+	idleTimeout = 5 * time.Minute
+
+	// Requests from apps are tiny. This keeps a client from making the
+	// server buffer huge packets.
+	maxPacketLength = 1 << 20
+
+	// How long to wait before accepting connections again after an error.
+	acceptRetryDelay = time.Second
+)
+
+var errUnbind = errors.New("client unbound")
+
+// Serves the users and groups of authfish read-only over LDAP, for apps which
+// can't log users in any other way. Users bind with their password or an API
+// key, and any bound user may search the directory.
+type Server struct {
+	db            *sqlx.DB
+	authenticator authenticator.Authenticator
+	baseDn        string
+}
+
+func New(db *sqlx.DB, authenticator authenticator.Authenticator, baseDn string) (*Server, error) {
+	parsedBaseDn, err := ldap.ParseDN(baseDn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parsedBaseDn.RDNs) == 0 {
+		return nil, fmt.Errorf("base DN must not be empty")
+	}
+
+	return &Server{
+		db:            db,
+		authenticator: authenticator,
+		baseDn:        parsedBaseDn.String(),
+	}, nil
+}
+
+// The state of one client connection.
+type connection struct {
+	conn net.Conn
+	ip   string
+
+	// Who the client is bound as, or 0 if it has not bound successfully
+	userId int64
+}
+
+func (c *connection) write(packet *ber.Packet) error {
+	c.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+	_, err := c.conn.Write(packet.Bytes())
+	return err
+}
+
+// Serves connections until listener is closed. Other errors accepting
+// connections, like running out of file descriptors, are retried.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("Error accepting LDAP connection: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		go s.serveConnection(conn)
+	}
+}
+
+func (s *Server) serveConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// A bug handling one client must not take down the whole server
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Panic serving LDAP connection from %s: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+	}()
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+
+	c := &connection{conn: conn, ip: ip}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		packet, err := readMessage(conn)
+
+		if err != nil {
+			return
+		}
+
+		if err := s.handleMessage(c, packet); err != nil {
+			if err != errUnbind {
+				log.Printf("Closing LDAP connection from %s: %v", c.ip, err)
+			}
+
+			return
+		}
+	}
+}
+
+// Returns an error if the connection should be closed.
+func (s *Server) handleMessage(c *connection, packet *ber.Packet) error {
+	if len(packet.Children) < 2 {
+		return fmt.Errorf("malformed message")
+	}
+
+	messageId, ok := packet.Children[0].Value.(int64)
+	op := packet.Children[1]
+
+	if !ok || op.ClassType != ber.ClassApplication {
+		return fmt.Errorf("malformed message")
+	}
+
+	switch op.Tag {
+	case ldap.ApplicationBindRequest:
+		return c.write(s.bind(c, messageId, op))
+	case ldap.ApplicationUnbindRequest:
+		return errUnbind
+	case ldap.ApplicationSearchRequest:
+		return s.search(c, messageId, op)
+	case ldap.ApplicationAbandonRequest:
+		// Searches are answered all at once, so there is nothing to abandon
+		return nil
+	case ldap.ApplicationModifyRequest, ldap.ApplicationAddRequest, ldap.ApplicationDelRequest, ldap.ApplicationModifyDNRequest, ldap.ApplicationCompareRequest:
+		// The response to each of these has the tag after the request's
+		return c.write(result(messageId, op.Tag+1, ldap.LDAPResultUnwillingToPerform, "the directory is read-only"))
+	case ldap.ApplicationExtendedRequest:
+		return c.write(result(messageId, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, "extended operations are not supported"))
+	default:
+		return fmt.Errorf("unsupported operation %d", op.Tag)
+	}
+}
+
+// Wraps op in an LDAPMessage.
+func message(messageId int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	packet.AppendChild(op)
+
+	return packet
+}
+
+// An LDAPResult, which is how most operations respond.
+func result(messageId int64, tag ber.Tag, code uint16, diagnosticMessage string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, ldap.ApplicationMap[uint8(tag)])
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnosticMessage, "Diagnostic Message"))
+
+	return message(messageId, op)
+}
@@ -0,0 +1,586 @@
+package ldap_server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"authfish/internal/authenticator"
+	"authfish/internal/database"
+	"authfish/internal/totp"
+	"authfish/internal/user"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	testBaseDn   = "dc=example,dc=com"
+	testPassword = "correct horse battery staple"
+)
+
+type testServer struct {
+	db      *sqlx.DB
+	address string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	db := database.OpenTestDB(t)
+	server, err := New(db, authenticator.NewLocal(db), testBaseDn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+
+	return &testServer{db: db, address: listener.Addr().String()}
+}
+
+func (s *testServer) dial(t *testing.T) *ldap.Conn {
+	conn, err := ldap.DialURL("ldap://" + s.address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(conn.Close)
+
+	return conn
+}
+
+// Returns a connection bound as a new user.
+func (s *testServer) dialBound(t *testing.T) *ldap.Conn {
+	database.CreateTestUser(t, s.db, "searcher", testPassword)
+	conn := s.dial(t)
+
+	if err := conn.Bind(userDn("searcher"), testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func userDn(username string) string {
+	return "uid=" + username + ",ou=people," + testBaseDn
+}
+
+func isResultCode(err error, code uint16) bool {
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == code
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name string
+		// Returns the DN and password to bind with
+		setup    func(t *testing.T, db *sqlx.DB) (string, string)
+		wantCode uint16
+		// Diagnostic message of a failed bind, if not the generic one
+		wantMessage string
+	}{
+		{
+			name: "password",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), testPassword
+			},
+			wantCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name: "upper case DN",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				return "UID=alice,OU=people,DC=example,DC=com", testPassword
+			},
+			wantCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name: "wrong password",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), "wrong"
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "unknown user",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				return userDn("nobody"), testPassword
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "DN outside of people",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				return "uid=alice,ou=groups," + testBaseDn, testPassword
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+			// DNs which can't be users are no secret
+			wantMessage: "not a user DN: uid=alice,ou=groups," + testBaseDn,
+		},
+		{
+			name: "API key",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), createApiKey(t, db, *u, nil, nil)
+			},
+			wantCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name: "read-only API key",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), createApiKey(t, db, *u, nil, []string{"read-only"})
+			},
+			wantCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name: "host-scoped API key",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), createApiKey(t, db, *u, nil, []string{"wiki.example.com"})
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "expired API key",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				expiresAt := time.Now().Add(-time.Hour)
+				return userDn("alice"), createApiKey(t, db, *u, &expiresAt, nil)
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "API key of another user",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				bob := database.CreateTestUser(t, db, "bob", testPassword)
+				return userDn("alice"), createApiKey(t, db, *bob, nil, nil)
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "password of a user with two-factor authentication",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				enableTotp(t, db, *u)
+				return userDn("alice"), testPassword
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "API key of a user with two-factor authentication",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				enableTotp(t, db, *u)
+				return userDn("alice"), createApiKey(t, db, *u, nil, nil)
+			},
+			wantCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name: "disabled user",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+
+				if err := database.DisableUser(db, *u); err != nil {
+					t.Fatal(err)
+				}
+
+				return userDn("alice"), testPassword
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "API key of a disabled user",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				u := database.CreateTestUser(t, db, "alice", testPassword)
+				key := createApiKey(t, db, *u, nil, nil)
+
+				if err := database.DisableUser(db, *u); err != nil {
+					t.Fatal(err)
+				}
+
+				return userDn("alice"), key
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "pending user",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				if _, err := database.SignUpUser(db, "alice", testPassword); err != nil {
+					t.Fatal(err)
+				}
+
+				return userDn("alice"), testPassword
+			},
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name: "DN without password",
+			setup: func(t *testing.T, db *sqlx.DB) (string, string) {
+				database.CreateTestUser(t, db, "alice", testPassword)
+				return userDn("alice"), ""
+			},
+			wantCode:    ldap.LDAPResultUnwillingToPerform,
+			wantMessage: "a password is required",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			dn, password := test.setup(t, s.db)
+			conn := s.dial(t)
+
+			var err error
+
+			if len(password) == 0 {
+				_, err = conn.SimpleBind(&ldap.SimpleBindRequest{Username: dn, AllowEmptyPassword: true})
+			} else {
+				err = conn.Bind(dn, password)
+			}
+
+			if test.wantCode == ldap.LDAPResultSuccess {
+				if err != nil {
+					t.Fatalf("bind failed: %v", err)
+				}
+
+				return
+			}
+
+			if !isResultCode(err, test.wantCode) {
+				t.Fatalf("got error %v, want result code %d", err, test.wantCode)
+			}
+
+			// Failed binds must not tell which usernames exist, or why
+			wantMessage := test.wantMessage
+
+			if len(wantMessage) == 0 && test.wantCode == ldap.LDAPResultInvalidCredentials {
+				wantMessage = "invalid credentials"
+			}
+
+			if !strings.HasSuffix(err.Error(), ": "+wantMessage) {
+				t.Errorf("got error %q, want message %q", err, wantMessage)
+			}
+
+			// The connection stays anonymous
+			if _, err := conn.Search(ldap.NewSearchRequest(testBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)); !isResultCode(err, ldap.LDAPResultInsufficientAccessRights) {
+				t.Errorf("search after a failed bind got error %v", err)
+			}
+		})
+	}
+}
+
+func createApiKey(t *testing.T, db *sqlx.DB, u user.User, expiresAt *time.Time, scopes []string) string {
+	k, err := database.CreateApiKey(db, u, "test", expiresAt, scopes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k.Key
+}
+
+func enableTotp(t *testing.T, db *sqlx.DB, u user.User) {
+	secret, err := totp.GenerateSecret()
+
+	if err == nil {
+		_, err = database.CreatePendingTotpCredential(db, u, secret)
+	}
+
+	if err == nil {
+		err = database.ConfirmTotpCredential(db, u, totp.Step(time.Now()), nil)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnonymousSearch(t *testing.T) {
+	s := newTestServer(t)
+	database.CreateTestUser(t, s.db, "alice", testPassword)
+	conn := s.dial(t)
+
+	for _, baseDn := range []string{testBaseDn, "ou=people," + testBaseDn, userDn("alice")} {
+		request := ldap.NewSearchRequest(baseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)
+
+		if result, err := conn.Search(request); !isResultCode(err, ldap.LDAPResultInsufficientAccessRights) {
+			t.Errorf("anonymous search of %s got %v and error %v", baseDn, result, err)
+		}
+	}
+
+	// Clients find the base DN in the root DSE before binding
+	request := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"namingContexts"}, nil)
+	result, err := conn.Search(request)
+
+	if err != nil || len(result.Entries) != 1 || result.Entries[0].GetAttributeValue("namingContexts") != testBaseDn {
+		t.Errorf("got root DSE %v and error %v", result, err)
+	}
+}
+
+// Returns the DNs found by a search, sorted.
+func searchDns(t *testing.T, conn *ldap.Conn, baseDn string, scope int, filter string) ([]string, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(baseDn, scope, ldap.NeverDerefAliases, 0, 0, false, filter, []string{"1.1"}, nil))
+
+	if err != nil {
+		return nil, err
+	}
+
+	dns := []string{}
+	for _, e := range result.Entries {
+		dns = append(dns, e.DN)
+	}
+
+	sort.Strings(dns)
+
+	return dns, nil
+}
+
+func TestSearchScope(t *testing.T) {
+	s := newTestServer(t)
+	alice := database.CreateTestUser(t, s.db, "alice", testPassword)
+	admins, err := database.CreateGroup(s.db, "admins")
+
+	if err == nil {
+		err = database.AddGroupMember(s.db, *admins, *alice)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := s.dialBound(t)
+
+	people := "ou=people," + testBaseDn
+	groups := "ou=groups," + testBaseDn
+	adminsDn := "cn=admins," + groups
+
+	tests := []struct {
+		baseDn  string
+		scope   int
+		want    []string
+		wantErr uint16
+	}{
+		{baseDn: testBaseDn, scope: ldap.ScopeBaseObject, want: []string{testBaseDn}},
+		{baseDn: testBaseDn, scope: ldap.ScopeSingleLevel, want: []string{groups, people}},
+		{baseDn: testBaseDn, scope: ldap.ScopeWholeSubtree, want: []string{adminsDn, testBaseDn, groups, people, userDn("alice"), userDn("searcher")}},
+		{baseDn: people, scope: ldap.ScopeBaseObject, want: []string{people}},
+		{baseDn: people, scope: ldap.ScopeSingleLevel, want: []string{userDn("alice"), userDn("searcher")}},
+		{baseDn: people, scope: ldap.ScopeWholeSubtree, want: []string{people, userDn("alice"), userDn("searcher")}},
+		{baseDn: "OU=People,DC=Example,DC=com", scope: ldap.ScopeSingleLevel, want: []string{userDn("alice"), userDn("searcher")}},
+		{baseDn: userDn("alice"), scope: ldap.ScopeBaseObject, want: []string{userDn("alice")}},
+		{baseDn: userDn("alice"), scope: ldap.ScopeSingleLevel, want: []string{}},
+		{baseDn: "ou=robots," + testBaseDn, scope: ldap.ScopeWholeSubtree, wantErr: ldap.LDAPResultNoSuchObject},
+		{baseDn: "dc=example,dc=org", scope: ldap.ScopeWholeSubtree, wantErr: ldap.LDAPResultNoSuchObject},
+	}
+
+	for _, test := range tests {
+		got, err := searchDns(t, conn, test.baseDn, test.scope, "(objectClass=*)")
+
+		if test.wantErr != 0 {
+			if !isResultCode(err, test.wantErr) {
+				t.Errorf("search of %s with scope %d got %v and error %v, want result code %d", test.baseDn, test.scope, got, err, test.wantErr)
+			}
+
+			continue
+		}
+
+		if err != nil || strings.Join(got, "; ") != strings.Join(test.want, "; ") {
+			t.Errorf("search of %s with scope %d got %v and error %v, want %v", test.baseDn, test.scope, got, err, test.want)
+		}
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+	s := newTestServer(t)
+	alice := database.CreateTestUser(t, s.db, "alice", testPassword)
+	database.CreateTestUser(t, s.db, "bob", testPassword)
+	mallory := database.CreateTestUser(t, s.db, "mallory", testPassword)
+	admins, err := database.CreateGroup(s.db, "admins")
+
+	if err == nil {
+		err = database.AddGroupMember(s.db, *admins, *alice)
+	}
+
+	if err == nil {
+		err = database.AddGroupMember(s.db, *admins, *mallory)
+	}
+
+	// Disabled users are left out of the directory, and their groups
+	if err == nil {
+		err = database.DisableUser(s.db, *mallory)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := s.dialBound(t)
+	adminsDn := "cn=admins,ou=groups," + testBaseDn
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"(uid=alice)", []string{userDn("alice")}},
+		{"(UID=ALICE)", []string{userDn("alice")}},
+		{"(uid=mallory)", []string{}},
+		{"(uid=al*)", []string{userDn("alice")}},
+		{"(uid=*o*)", []string{userDn("bob")}},
+		{"(uid=*ce)", []string{userDn("alice")}},
+		{"(uid=a*x*)", []string{}},
+		{"(|(uid=alice)(uid=bob))", []string{userDn("alice"), userDn("bob")}},
+		{"(&(objectClass=inetOrgPerson)(!(uid=searcher)))", []string{userDn("alice"), userDn("bob")}},
+		{"(&(objectClass=inetOrgPerson)(memberOf=" + adminsDn + "))", []string{userDn("alice")}},
+		{"(memberOf=CN=Admins,OU=Groups,DC=Example,DC=com)", []string{userDn("alice")}},
+		{"(&(objectClass=groupOfNames)(member=" + userDn("alice") + "))", []string{adminsDn}},
+		{"(member=" + userDn("mallory") + ")", []string{}},
+		{"(memberOf=*)", []string{userDn("alice")}},
+		{"(uid>=s)", []string{userDn("searcher")}},
+		{"(uid<=b)", []string{userDn("alice")}},
+		{"(uid:caseExactMatch:=alice)", []string{}},
+	}
+
+	for _, test := range tests {
+		got, err := searchDns(t, conn, testBaseDn, ldap.ScopeWholeSubtree, test.filter)
+
+		if err != nil || strings.Join(got, "; ") != strings.Join(test.want, "; ") {
+			t.Errorf("search for %s got %v and error %v, want %v", test.filter, got, err, test.want)
+		}
+	}
+}
+
+func TestSearchAttributes(t *testing.T) {
+	s := newTestServer(t)
+	database.CreateTestUser(t, s.db, "alice", testPassword)
+	conn := s.dialBound(t)
+
+	request := ldap.NewSearchRequest(userDn("alice"), ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"uid", "CN"}, nil)
+	result, err := conn.Search(request)
+
+	if err != nil || len(result.Entries) != 1 {
+		t.Fatalf("got %v and error %v", result, err)
+	}
+
+	attributes := result.Entries[0].Attributes
+
+	if len(attributes) != 2 || result.Entries[0].GetAttributeValue("uid") != "alice" || result.Entries[0].GetAttributeValue("cn") != "alice" {
+		t.Errorf("got attributes %v, want uid and cn", result.Entries[0])
+	}
+
+	// Size limits are enforced
+	request = ldap.NewSearchRequest(testBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", nil, nil)
+
+	if _, err := conn.Search(request); !isResultCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("got error %v, want size limit exceeded", err)
+	}
+}
+
+func TestWriteOperationsAreRejected(t *testing.T) {
+	s := newTestServer(t)
+	conn := s.dialBound(t)
+	dn := userDn("searcher")
+
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace("cn", []string{"mallory"})
+
+	add := ldap.NewAddRequest(userDn("mallory"), nil)
+	add.Attribute("objectClass", []string{"inetOrgPerson"})
+
+	_, compareErr := conn.Compare(dn, "uid", "searcher")
+
+	operations := map[string]error{
+		"modify":    conn.Modify(modify),
+		"add":       conn.Add(add),
+		"delete":    conn.Del(ldap.NewDelRequest(dn, nil)),
+		"modify DN": conn.ModifyDN(ldap.NewModifyDNRequest(dn, "uid=mallory", true, "")),
+		"compare":   compareErr,
+	}
+
+	for name, err := range operations {
+		if !isResultCode(err, ldap.LDAPResultUnwillingToPerform) {
+			t.Errorf("%s got error %v, want unwilling to perform", name, err)
+		}
+	}
+
+	if _, err := conn.PasswordModify(ldap.NewPasswordModifyRequest(dn, testPassword, "new password")); !isResultCode(err, ldap.LDAPResultProtocolError) {
+		t.Errorf("password modify got error %v, want protocol error", err)
+	}
+
+	// Nothing changed
+	users, err := database.ListUsers(s.db)
+
+	if err != nil || len(users) != 1 || users[0].Username != "searcher" {
+		t.Errorf("got users %v and error %v", users, err)
+	}
+}
+
+func TestOversizedPacketsCloseTheConnection(t *testing.T) {
+	limit := ber.MaxPacketLengthBytes
+	s := newTestServer(t)
+
+	if ber.MaxPacketLengthBytes != limit {
+		t.Errorf("starting the server changed the packet limit of all LDAP clients to %d", ber.MaxPacketLengthBytes)
+	}
+
+	length := maxPacketLength + 1
+
+	// None of these send the bytes they claim, so the server would wait for
+	// them if it didn't check the lengths
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{
+			name:   "message over the limit",
+			packet: []byte{0x30, 0x84, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)},
+		},
+		{
+			name:   "element longer than its message",
+			packet: []byte{0x30, 0x06, 0x04, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		},
+		{
+			name:   "indefinite length",
+			packet: []byte{0x30, 0x80},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.address)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			if _, err := conn.Write(test.packet); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Error("server answered an oversized packet")
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Error("server is still reading an oversized packet")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package ldap_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Reads one LDAPMessage of at most maxPacketLength bytes.
+//
+// The ber package allocates whatever length a packet claims before reading
+// it, and its limit is global, so it would also apply to the LDAP client of
+// the LDAP authenticator. Instead, the message is read into a buffer first,
+// and only decoded once every length in it is known to fit.
+func readMessage(r io.Reader) (*ber.Packet, error) {
+	header := make([]byte, 2, 6)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// An LDAPMessage is a SEQUENCE
+	if header[0] != 0x30 {
+		return nil, fmt.Errorf("message is not a sequence")
+	}
+
+	length := int64(header[1])
+
+	if length&0x80 != 0 {
+		lengthBytes := make([]byte, length&0x7f)
+
+		// LDAP only allows the definite form (RFC 4511 5.1)
+		if len(lengthBytes) == 0 || len(lengthBytes) > 4 {
+			return nil, fmt.Errorf("unsupported length form")
+		}
+
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+
+		header = append(header, lengthBytes...)
+		length = 0
+
+		for _, b := range lengthBytes {
+			length = length<<8 | int64(b)
+		}
+	}
+
+	if length > maxPacketLength {
+		return nil, fmt.Errorf("message of %d bytes is bigger than %d bytes", length, maxPacketLength)
+	}
+
+	content := make([]byte, length)
+
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+
+	if err := checkLengths(content); err != nil {
+		return nil, err
+	}
+
+	return ber.ReadPacket(io.MultiReader(bytes.NewReader(header), bytes.NewReader(content)))
+}
+
+// Checks that each element in data, and each element nested in those, is no
+// longer than what is left of its parent.
+func checkLengths(data []byte) error {
+	for len(data) > 0 {
+		identifier := data[0]
+		data = data[1:]
+
+		// High tag numbers continue in the following bytes
+		if identifier&0x1f == 0x1f {
+			for len(data) > 0 && data[0]&0x80 != 0 {
+				data = data[1:]
+			}
+
+			if len(data) == 0 {
+				return fmt.Errorf("truncated tag")
+			}
+
+			data = data[1:]
+		}
+
+		if len(data) == 0 {
+			return fmt.Errorf("truncated length")
+		}
+
+		length := int(data[0])
+		data = data[1:]
+
+		if length&0x80 != 0 {
+			lengthBytes := length & 0x7f
+
+			if lengthBytes == 0 || lengthBytes > 4 || lengthBytes > len(data) {
+				return fmt.Errorf("unsupported length form")
+			}
+
+			length = 0
+
+			for _, b := range data[:lengthBytes] {
+				length = length<<8 | int(b)
+			}
+
+			data = data[lengthBytes:]
+		}
+
+		if length > len(data) {
+			return fmt.Errorf("element of %d bytes is longer than its parent", length)
+		}
+
+		if identifier&0x20 != 0 {
+			if err := checkLengths(data[:length]); err != nil {
+				return err
+			}
+		}
+
+		data = data[length:]
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package ldap_server
+
+import (
+	"fmt"
+	"strings"
+
+	"authfish/internal/database"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func (s *Server) search(c *connection, messageId int64, op *ber.Packet) error {
+	done := func(code uint16, diagnosticMessage string) error {
+		return c.write(result(messageId, ldap.ApplicationSearchResultDone, code, diagnosticMessage))
+	}
+
+	if len(op.Children) < 8 {
+		return done(ldap.LDAPResultProtocolError, "malformed search request")
+	}
+
+	baseObject := op.Children[0].Data.String()
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	typesOnly, _ := op.Children[5].Value.(bool)
+	filter := op.Children[6]
+
+	requestedAttributes := []string{}
+	for _, attribute := range op.Children[7].Children {
+		requestedAttributes = append(requestedAttributes, attribute.Data.String())
+	}
+
+	var entries []entry
+
+	if len(baseObject) == 0 && scope == ldap.ScopeBaseObject {
+		entries = []entry{s.rootDse()}
+	} else {
+		if err := s.checkBound(c); err != nil {
+			return done(ldap.LDAPResultInsufficientAccessRights, err.Error())
+		}
+
+		allEntries, err := s.loadEntries()
+
+		if err != nil {
+			return done(ldap.LDAPResultOther, fmt.Sprintf("error running database query: %v", err))
+		}
+
+		entries, err = inScope(allEntries, baseObject, scope)
+
+		if err != nil {
+			return done(ldap.LDAPResultNoSuchObject, err.Error())
+		}
+	}
+
+	sent := int64(0)
+
+	for _, e := range entries {
+		if !matches(filter, e) {
+			continue
+		}
+
+		if sizeLimit > 0 && sent >= sizeLimit {
+			return done(ldap.LDAPResultSizeLimitExceeded, "")
+		}
+
+		if err := c.write(searchResultEntry(messageId, e, requestedAttributes, typesOnly)); err != nil {
+			return err
+		}
+
+		sent++
+	}
+
+	return done(ldap.LDAPResultSuccess, "")
+}
+
+// Only clients bound as a user who can still log in may search.
+func (s *Server) checkBound(c *connection) error {
+	if c.userId == 0 {
+		return fmt.Errorf("bind as a user to search the directory")
+	}
+
+	u, err := database.FindUserById(s.db, c.userId)
+
+	if err != nil || u == nil || !u.IsActive() {
+		c.userId = 0
+		return fmt.Errorf("the bound user can no longer log in")
+	}
+
+	return nil
+}
+
+// Returns the entries within scope of baseObject.
+func inScope(entries []entry, baseObject string, scope int64) ([]entry, error) {
+	baseDn, err := ldap.ParseDN(baseObject)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid base DN: %w", err)
+	}
+
+	found := len(baseDn.RDNs) == 0
+	result := []entry{}
+
+	for _, e := range entries {
+		dn, _ := ldap.ParseDN(e.dn)
+		isBase := baseDn.EqualFold(dn)
+		found = found || isBase
+
+		switch scope {
+		case ldap.ScopeBaseObject:
+			if isBase {
+				result = append(result, e)
+			}
+		case ldap.ScopeSingleLevel:
+			if len(dn.RDNs) == len(baseDn.RDNs)+1 && baseDn.AncestorOfFold(dn) {
+				result = append(result, e)
+			}
+		default:
+			if isBase || baseDn.AncestorOfFold(dn) {
+				result = append(result, e)
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%s does not exist", baseObject)
+	}
+
+	return result, nil
+}
+
+// Evaluates a search filter against e. Values are compared case-insensitively,
+// and extensible matches never match.
+func matches(filter *ber.Packet, e entry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(child, e) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(child, e) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matches(filter.Children[0], e)
+	case ldap.FilterPresent:
+		return len(e.get(filter.Data.String())) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false
+		}
+
+		name := filter.Children[0].Data.String()
+		assertion := filter.Children[1].Data.String()
+
+		for _, value := range e.get(name) {
+			if compareValues(name, value, assertion, filter.Tag) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+
+		for _, value := range e.get(filter.Children[0].Data.String()) {
+			if matchesSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true
+			}
+		}
+
+		return false
+	default:
+		return false
+	}
+}
+
+func compareValues(name string, value string, assertion string, tag ber.Tag) bool {
+	if dnAttributes[strings.ToLower(name)] && tag == ldap.FilterEqualityMatch {
+		valueDn, err := ldap.ParseDN(value)
+		assertionDn, assertionErr := ldap.ParseDN(assertion)
+
+		if err == nil && assertionErr == nil {
+			return valueDn.EqualFold(assertionDn)
+		}
+	}
+
+	value = strings.ToLower(value)
+	assertion = strings.ToLower(assertion)
+
+	switch tag {
+	case ldap.FilterGreaterOrEqual:
+		return value >= assertion
+	case ldap.FilterLessOrEqual:
+		return value <= assertion
+	default:
+		return value == assertion
+	}
+}
+
+func matchesSubstrings(value string, substrings []*ber.Packet) bool {
+	for _, substring := range substrings {
+		part := strings.ToLower(substring.Data.String())
+
+		switch substring.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, part) {
+				return false
+			}
+
+			value = value[len(part):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, part)
+
+			if i < 0 {
+				return false
+			}
+
+			value = value[i+len(part):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, part) {
+				return false
+			}
+
+			value = ""
+		}
+	}
+
+	return true
+}
+
+// Returns e with the attributes the client asked for. No attributes, or *,
+// means all of them. 1.1 matches no attribute, so it means none of them.
+func searchResultEntry(messageId int64, e entry, requestedAttributes []string, typesOnly bool) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+
+	for _, a := range e.attributes {
+		// An attribute without values is one the entry doesn't have
+		if len(a.values) == 0 || !isRequested(a.name, requestedAttributes) {
+			continue
+		}
+
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.name, "Type"))
+
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+
+		if !typesOnly {
+			for _, value := range a.values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+		}
+
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+
+	op.AppendChild(attributes)
+
+	return message(messageId, op)
+}
+
+func isRequested(name string, requestedAttributes []string) bool {
+	if len(requestedAttributes) == 0 {
+		return true
+	}
+
+	for _, requested := range requestedAttributes {
+		if requested == "*" || strings.EqualFold(requested, name) {
+			return true
+		}
+	}
+
+	return false
+}
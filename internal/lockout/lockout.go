@@ -0,0 +1,80 @@
+package lockout
+
+import (
+	"fmt"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindUsername Kind = "username"
+	KindIp       Kind = "ip"
+)
+
+const (
+	// Failures are forgotten after this long without another failure
+	ResetAfter = 24 * time.Hour
+
+	// Backoff doubles with every failure after the free attempts, starting at
+	// BaseBackoff, up to MaxBackoff.
+	BaseBackoff = 30 * time.Second
+	MaxBackoff  = time.Hour
+)
+
+// Number of failures allowed before locking. Many users may share an IP
+// address, so IPs get more attempts than usernames.
+var freeAttempts = map[Kind]int{
+	KindUsername: 5,
+	KindIp:       20,
+}
+
+// Failed login attempts for a username or client IP address.
+type Lockout struct {
+	Kind          Kind       `db:"kind"`
+	Subject       string     `db:"subject"`
+	Failures      int        `db:"failures"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	LastFailureAt time.Time  `db:"last_failure_at"`
+}
+
+func (l Lockout) IsLocked() bool {
+	return l.LockedUntil != nil && time.Now().Before(*l.LockedUntil)
+}
+
+// Time left until another login attempt is allowed.
+func (l Lockout) Remaining() time.Duration {
+	if !l.IsLocked() {
+		return 0
+	}
+
+	return time.Until(*l.LockedUntil)
+}
+
+func (l Lockout) Error() string {
+	return fmt.Sprintf(
+		"too many failed login attempts, try again in %s",
+		l.Remaining().Round(time.Second),
+	)
+}
+
+func Backoff(kind Kind, failures int) time.Duration {
+	excess := failures - freeAttempts[kind]
+
+	if excess <= 0 {
+		return 0
+	}
+
+	// Avoid overflowing the shift, the result would be capped anyway
+	if excess > 16 {
+		return MaxBackoff
+	}
+
+	backoff := BaseBackoff << (excess - 1)
+
+	if backoff > MaxBackoff {
+		return MaxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,67 @@
+package lockout
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		kind     Kind
+		failures int
+		want     time.Duration
+	}{
+		{kind: KindUsername, failures: 0, want: 0},
+		{kind: KindUsername, failures: 5, want: 0},
+		{kind: KindUsername, failures: 6, want: BaseBackoff},
+		{kind: KindUsername, failures: 7, want: 2 * BaseBackoff},
+		{kind: KindUsername, failures: 8, want: 4 * BaseBackoff},
+		{kind: KindUsername, failures: 11, want: 32 * BaseBackoff},
+		{kind: KindUsername, failures: 12, want: 64 * BaseBackoff},
+		{kind: KindUsername, failures: 13, want: MaxBackoff},
+		{kind: KindUsername, failures: 100, want: MaxBackoff},
+		{kind: KindIp, failures: 6, want: 0},
+		{kind: KindIp, failures: 20, want: 0},
+		{kind: KindIp, failures: 21, want: BaseBackoff},
+		{kind: KindIp, failures: 22, want: 2 * BaseBackoff},
+		{kind: KindIp, failures: 1000, want: MaxBackoff},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.kind)+" "+fmt.Sprint(test.failures), func(t *testing.T) {
+			if got := Backoff(test.kind, test.failures); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name        string
+		lockedUntil *time.Time
+		want        bool
+	}{
+		{name: "never locked"},
+		{name: "lock expired", lockedUntil: &past},
+		{name: "locked", lockedUntil: &future, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := Lockout{Kind: KindUsername, Subject: "alice", LockedUntil: test.lockedUntil}
+
+			if l.IsLocked() != test.want {
+				t.Errorf("got IsLocked %v, want %v", l.IsLocked(), test.want)
+			}
+
+			if test.want != (l.Remaining() > 0) {
+				t.Errorf("got %s remaining", l.Remaining())
+			}
+		})
+	}
+}
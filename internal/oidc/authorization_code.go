@@ -0,0 +1,72 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// How long a client has to exchange an authorization code for tokens.
+const AuthorizationCodeLifetime = time.Minute
+
+// How long ID tokens and access tokens are valid for.
+const TokenLifetime = time.Hour
+
+// Scopes which authfish knows about. Others are ignored.
+var SupportedScopes = []string{"openid", "profile", "groups"}
+
+const (
+	CodeChallengeMethodPlain = "plain"
+	CodeChallengeMethodS256  = "S256"
+)
+
+type AuthorizationCode struct {
+	HashedCode          string    `db:"hashed_code"`
+	ClientId            string    `db:"client_id"`
+	UserId              int64     `db:"user_id"`
+	RedirectUri         string    `db:"redirect_uri"`
+	Scope               string    `db:"scope"` // Space separated
+	Nonce               string    `db:"nonce"`
+	CodeChallenge       string    `db:"code_challenge"`
+	CodeChallengeMethod string    `db:"code_challenge_method"`
+	AuthTime            time.Time `db:"auth_time"`
+	ExpiresAt           time.Time `db:"expires_at"`
+}
+
+func (c AuthorizationCode) IsExpired() bool {
+	return time.Now().After(c.ExpiresAt)
+}
+
+// Whether the space separated scopes include scope.
+func HasScope(scopes string, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check the PKCE code verifier sent to the token endpoint against the
+// challenge sent to the authorization endpoint (RFC 7636).
+func (c AuthorizationCode) VerifyCodeVerifier(verifier string) bool {
+	if len(c.CodeChallenge) == 0 {
+		return len(verifier) == 0
+	}
+
+	if len(verifier) == 0 {
+		return false
+	}
+
+	expected := verifier
+
+	if c.CodeChallengeMethod == CodeChallengeMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(c.CodeChallenge)) == 1
+}
@@ -0,0 +1,51 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"authfish/internal/utils"
+)
+
+// A relying party, i.e. an app which lets its users log in with authfish.
+type Client struct {
+	Id           int64     `db:"id"`
+	ClientId     string    `db:"client_id"`
+	Name         string    `db:"name"`
+	HashedSecret string    `db:"hashed_secret"` // Empty for public clients
+	RedirectUris string    `db:"redirect_uris"` // Space separated
+	CreatedAt    time.Time `db:"created_at"`
+
+	// Only known right after the client is created
+	Secret string `db:"-"`
+}
+
+// Public clients, like single page apps and mobile apps, can't keep a secret.
+// They must use PKCE instead.
+func (c Client) IsPublic() bool {
+	return len(c.HashedSecret) == 0
+}
+
+func (c Client) RedirectUriList() []string {
+	return strings.Fields(c.RedirectUris)
+}
+
+// Redirect URIs must match a registered one exactly.
+func (c Client) AllowsRedirectUri(redirectUri string) bool {
+	for _, allowed := range c.RedirectUriList() {
+		if allowed == redirectUri {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Client) SecretMatches(secret string) bool {
+	if c.IsPublic() {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.HashedSecret), []byte(utils.HashToken(secret))) == 1
+}
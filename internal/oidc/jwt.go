@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingKeyBits = 2048
+
+	// JWT type of access tokens (RFC 9068), so that ID tokens can't be used as
+	// access tokens.
+	AccessTokenType = "at+jwt"
+)
+
+// Key used to sign ID tokens and access tokens with RS256.
+type SigningKey struct {
+	privateKey *rsa.PrivateKey
+	KeyId      string
+}
+
+type Claims map[string]interface{}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyId     string `json:"kid,omitempty"`
+}
+
+// Read the signing key from path, generating it first if it does not exist.
+// Keeping it in the data dir means tokens stay valid across restarts.
+func LoadOrCreateSigningKey(path string) (*SigningKey, error) {
+	pemBytes, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return createSigningKey(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key in %s: %w", path, err)
+	}
+
+	privateKey, ok := parsedKey.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s is not an RSA key", path)
+	}
+
+	return newSigningKey(privateKey)
+}
+
+func createSigningKey(path string) (*SigningKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(path, pemBytes, 0600); err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(privateKey)
+}
+
+func newSigningKey(privateKey *rsa.PrivateKey) (*SigningKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return &SigningKey{
+		privateKey: privateKey,
+		KeyId:      base64.RawURLEncoding.EncodeToString(sum[:12]),
+	}, nil
+}
+
+// The public key as a JSON Web Key Set, for the jwks_uri.
+func (k *SigningKey) Jwks() map[string]interface{} {
+	publicKey := k.privateKey.PublicKey
+
+	return map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": k.KeyId,
+				"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// Returns a signed JWT with claims and the given typ header.
+func (k *SigningKey) Sign(tokenType string, claims Claims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "RS256", Type: tokenType, KeyId: k.KeyId})
+
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.privateKey, crypto.SHA256, digest[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Returns the claims of token if it was signed by k, has the given typ header
+// and has not expired.
+func (k *SigningKey) Verify(token string, tokenType string) (Claims, error) {
+	return VerifyToken(token, map[string]*rsa.PublicKey{k.KeyId: &k.privateKey.PublicKey}, tokenType)
+}
+
+// Parse the RSA keys of a JSON Web Key Set, by key id. Other keys are skipped.
+func ParseJwks(data []byte) (map[string]*rsa.PublicKey, error) {
+	jwks := struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyId   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}{}
+
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("malformed JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+
+	for _, key := range jwks.Keys {
+		if key.KeyType != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+
+		if err != nil {
+			return nil, fmt.Errorf("malformed modulus of key %s", key.KeyId)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("malformed exponent of key %s", key.KeyId)
+		}
+
+		keys[key.KeyId] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// Returns the claims of token if it was signed with RS256 by one of keys, has
+// one of the given typ headers and has not expired. Include an empty string in
+// tokenTypes to accept tokens without a typ header.
+func VerifyToken(token string, keys map[string]*rsa.PublicKey, tokenTypes ...string) (Claims, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	header := jwtHeader{}
+
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	publicKey, ok := keys[header.KeyId]
+
+	if header.Algorithm != "RS256" || !ok || !hasTokenType(header.Type, tokenTypes) {
+		return nil, fmt.Errorf("token was not issued by a trusted key")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	claims := Claims{}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	exp, ok := claims["exp"].(float64)
+
+	if !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+
+	return claims, nil
+}
+
+func hasTokenType(tokenType string, tokenTypes []string) bool {
+	for _, t := range tokenTypes {
+		if strings.EqualFold(tokenType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns claim as a string, also for numeric claims like GitHub user ids.
+// Returns an empty string if the claim is missing.
+func (c Claims) String(claim string) string {
+	switch value := c[claim].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case json.Number:
+		return value.String()
+	default:
+		return ""
+	}
+}
+
+// Whether the aud claim is, or includes, audience.
+func (c Claims) HasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"authfish/internal/user"
+)
+
+type Kind string
+
+const (
+	AllowUser      Kind = "allow-user"
+	AllowGroup     Kind = "allow-group"
+	DenyUser       Kind = "deny-user"
+	AllowAnonymous Kind = "allow-anonymous"
+)
+
+type Policy struct {
+	Id         int64     `db:"id"`
+	Host       string    `db:"host"`
+	PathPrefix string    `db:"path_prefix"`
+	Kind       Kind      `db:"kind"`
+	Subject    *string   `db:"subject"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type Decision int
+
+const (
+	Allow Decision = iota
+	Unauthenticated
+	Forbidden
+)
+
+// Decide whether u (which may be nil for anonymous requests), a member of
+// groups, may access path, given every policy configured for the requested
+// host.
+//
+// Only policies whose path prefix matches path are considered. Anonymous
+// access wins over everything else, then deny rules, then allow rules. If no
+// allow rules match the path, any authenticated user is allowed, which keeps
+// hosts without policies working exactly as before.
+func Evaluate(policies []Policy, u *user.User, groups []string, path string) Decision {
+	matching := []Policy{}
+	for _, p := range policies {
+		if p.MatchesPath(path) {
+			matching = append(matching, p)
+		}
+	}
+
+	for _, p := range matching {
+		if p.Kind == AllowAnonymous {
+			return Allow
+		}
+	}
+
+	if u == nil {
+		return Unauthenticated
+	}
+
+	hasAllowRules := false
+	allowed := false
+
+	for _, p := range matching {
+		switch p.Kind {
+		case DenyUser:
+			if p.matchesUser(u) {
+				return Forbidden
+			}
+		case AllowUser:
+			hasAllowRules = true
+			if p.matchesUser(u) {
+				allowed = true
+			}
+		case AllowGroup:
+			hasAllowRules = true
+			if p.matchesAnyGroup(groups) {
+				allowed = true
+			}
+		}
+	}
+
+	if hasAllowRules && !allowed {
+		return Forbidden
+	}
+
+	return Allow
+}
+
+func (p Policy) MatchesPath(path string) bool {
+	return MatchesPathPrefix(path, p.PathPrefix)
+}
+
+// A path prefix only matches on segment boundaries, so /admin matches /admin
+// and /admin/users, but not /administrator.
+//
+// The prefix is cleaned like the request path, which loses its trailing
+// slash, so /admin/ matches /admin as well.
+func MatchesPathPrefix(requestPath string, prefix string) bool {
+	prefix = path.Clean("/" + prefix)
+
+	if prefix == "/" {
+		return true
+	}
+
+	if !strings.HasPrefix(requestPath, prefix) {
+		return false
+	}
+
+	return len(requestPath) == len(prefix) || requestPath[len(prefix)] == '/'
+}
+
+func (p Policy) matchesUser(u *user.User) bool {
+	return p.Subject != nil && *p.Subject == u.Username
+}
+
+func (p Policy) matchesAnyGroup(groups []string) bool {
+	if p.Subject == nil {
+		return false
+	}
+
+	for _, g := range groups {
+		if g == *p.Subject {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NormalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSpace(host))
+}
@@ -0,0 +1,57 @@
+package policy
+
+import (
+	"testing"
+
+	"authfish/internal/user"
+)
+
+func TestMatchesPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/", "", true},
+		{"/anything", "/", true},
+		{"/admin", "/admin", true},
+		{"/admin/users", "/admin", true},
+		{"/admin", "/admin/", true},
+		{"/admin/users", "/admin/", true},
+		{"/admin/users", "admin", true},
+		{"/admin/users", "/admin//", true},
+
+		{"/administrator", "/admin", false},
+		{"/administrator", "/admin/", false},
+		{"/", "/admin", false},
+		{"/public", "/admin", false},
+		{"/adm", "/admin", false},
+	}
+
+	for _, test := range tests {
+		if got := MatchesPathPrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("MatchesPathPrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateWithTrailingSlash(t *testing.T) {
+	admins := "admins"
+	policies := []Policy{{Host: "wiki.example.com", PathPrefix: "/admin/", Kind: AllowGroup, Subject: &admins}}
+	u := &user.User{Id: 1, Username: "alice"}
+
+	// The checked path is cleaned, so a request for /admin/ arrives as /admin
+	for _, path := range []string{"/admin", "/admin/users"} {
+		if got := Evaluate(policies, u, nil, path); got != Forbidden {
+			t.Errorf("Evaluate for %s = %v, want Forbidden", path, got)
+		}
+
+		if got := Evaluate(policies, u, []string{admins}, path); got != Allow {
+			t.Errorf("Evaluate for %s as an admin = %v, want Allow", path, got)
+		}
+	}
+
+	if got := Evaluate(policies, u, nil, "/administrator"); got != Allow {
+		t.Errorf("Evaluate for /administrator = %v, want Allow", got)
+	}
+}
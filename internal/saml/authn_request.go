@@ -0,0 +1,99 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// Requests from apps are tiny. Anything bigger is not worth inflating.
+const maxRequestSize = 64 * 1024
+
+// The parts of an AuthnRequest authfish looks at. Signatures on requests are
+// not checked, since responses only go to registered URLs anyway.
+type AuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	Id                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	AssertionConsumerServiceUrl string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	IsPassive                   bool     `xml:"IsPassive,attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// Decodes a SAMLRequest parameter. Requests sent with the HTTP-Redirect
+// binding are deflated, those sent with the HTTP-POST binding are not.
+func DecodeRequest(encoded string, deflated bool) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, fmt.Errorf("SAMLRequest is not base64 encoded: %w", err)
+	}
+
+	if !deflated {
+		return data, nil
+	}
+
+	inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxRequestSize+1))
+
+	if err != nil {
+		return nil, fmt.Errorf("SAMLRequest is not deflated: %w", err)
+	}
+
+	if len(inflated) > maxRequestSize {
+		return nil, fmt.Errorf("SAMLRequest is too big")
+	}
+
+	return inflated, nil
+}
+
+// Encodes a request for the HTTP-Redirect binding.
+func EncodeRedirectRequest(request []byte) (string, error) {
+	var buffer bytes.Buffer
+
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := writer.Write(request); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func ParseAuthnRequest(data []byte) (*AuthnRequest, error) {
+	request := AuthnRequest{}
+
+	if err := xml.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("SAMLRequest is not an AuthnRequest: %w", err)
+	}
+
+	if request.Version != "2.0" {
+		return nil, fmt.Errorf("unsupported SAML version %q", request.Version)
+	}
+
+	if len(request.Id) == 0 {
+		return nil, fmt.Errorf("AuthnRequest has no ID")
+	}
+
+	if len(request.Issuer) == 0 {
+		return nil, fmt.Errorf("AuthnRequest has no Issuer")
+	}
+
+	// Responses are only ever posted back
+	if len(request.ProtocolBinding) > 0 && request.ProtocolBinding != BindingHttpPost {
+		return nil, fmt.Errorf("unsupported ProtocolBinding %q, only %s is supported", request.ProtocolBinding, BindingHttpPost)
+	}
+
+	return &request, nil
+}
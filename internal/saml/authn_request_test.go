@@ -0,0 +1,139 @@
+package saml
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// An AuthnRequest as service providers send it, with attrs added to its root
+// element.
+func testAuthnRequest(attrs string) string {
+	return `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ` + attrs + `>` +
+		`<saml:Issuer>` + testSpEntityId + `</saml:Issuer>` +
+		`</samlp:AuthnRequest>`
+}
+
+func TestDecodeRequest(t *testing.T) {
+	request := testAuthnRequest(`ID="_request-1" Version="2.0"`)
+
+	redirectEncoded, err := EncodeRedirectRequest([]byte(request))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tooBig, err := EncodeRedirectRequest([]byte(strings.Repeat(" ", maxRequestSize+1)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		deflated bool
+		wantErr  string
+	}{
+		{name: "redirect binding", encoded: redirectEncoded, deflated: true},
+		{name: "post binding", encoded: base64.StdEncoding.EncodeToString([]byte(request))},
+		{name: "not base64", encoded: "<AuthnRequest/>", wantErr: "not base64"},
+		{name: "redirect binding without deflate", encoded: base64.StdEncoding.EncodeToString([]byte(request)), deflated: true, wantErr: "not deflated"},
+		{name: "too big", encoded: tooBig, deflated: true, wantErr: "too big"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := DecodeRequest(test.encoded, test.deflated)
+
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(decoded) != request {
+				t.Errorf("got request %q, want %q", decoded, request)
+			}
+		})
+	}
+}
+
+func TestParseAuthnRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    AuthnRequest
+		wantErr string
+	}{
+		{
+			name:    "redirect binding",
+			request: testAuthnRequest(`ID="_request-1" Version="2.0" AssertionConsumerServiceURL="` + testAcsUrl + `" IsPassive="true"`),
+			want:    AuthnRequest{Id: "_request-1", AssertionConsumerServiceUrl: testAcsUrl, IsPassive: true},
+		},
+		{
+			name:    "post binding",
+			request: testAuthnRequest(`ID="_request-1" Version="2.0" ProtocolBinding="` + BindingHttpPost + `"`),
+			want:    AuthnRequest{Id: "_request-1", ProtocolBinding: BindingHttpPost},
+		},
+		{
+			name:    "unsupported binding",
+			request: testAuthnRequest(`ID="_request-1" Version="2.0" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"`),
+			wantErr: "unsupported ProtocolBinding",
+		},
+		{
+			name:    "unsupported version",
+			request: testAuthnRequest(`ID="_request-1" Version="1.1"`),
+			wantErr: "unsupported SAML version",
+		},
+		{
+			name:    "no ID",
+			request: testAuthnRequest(`Version="2.0"`),
+			wantErr: "no ID",
+		},
+		{
+			name:    "no Issuer",
+			request: `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_request-1" Version="2.0"/>`,
+			wantErr: "no Issuer",
+		},
+		{
+			name:    "another message",
+			request: `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_request-1" Version="2.0"/>`,
+			wantErr: "not an AuthnRequest",
+		},
+		{
+			name:    "not XML",
+			request: "SAMLRequest",
+			wantErr: "not an AuthnRequest",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := ParseAuthnRequest([]byte(test.request))
+
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if request.Id != test.want.Id || request.Issuer != testSpEntityId || request.AssertionConsumerServiceUrl != test.want.AssertionConsumerServiceUrl ||
+				request.ProtocolBinding != test.want.ProtocolBinding || request.IsPassive != test.want.IsPassive {
+				t.Errorf("got request %+v, want %+v", request, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	signingKeyBits = 2048
+
+	// Service providers pin the certificate from the metadata, so it should
+	// outlive any app it is configured in.
+	certificateLifetime = 20 * 365 * 24 * time.Hour
+)
+
+// Key and self-signed certificate assertions are signed with.
+type KeyPair struct {
+	privateKey  *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// Read the key from keyPath and the certificate from certPath, generating them
+// first if they do not exist. The certificate is kept in its own file, so
+// that it can be handed to service providers which don't read metadata.
+func LoadOrCreateKeyPair(keyPath string, certPath string) (*KeyPair, error) {
+	privateKey, err := loadOrCreatePrivateKey(keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes, err := os.ReadFile(certPath)
+
+	if os.IsNotExist(err) {
+		return createCertificate(certPath, privateKey)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", certPath)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate in %s: %w", certPath, err)
+	}
+
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+
+	if !ok || !publicKey.Equal(&privateKey.PublicKey) {
+		return nil, fmt.Errorf("certificate in %s does not match the key in %s", certPath, keyPath)
+	}
+
+	return &KeyPair{privateKey: privateKey, Certificate: certificate}, nil
+}
+
+func loadOrCreatePrivateKey(path string) (*rsa.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return createPrivateKey(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key in %s: %w", path, err)
+	}
+
+	privateKey, ok := parsedKey.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s is not an RSA key", path)
+	}
+
+	return privateKey, nil
+}
+
+func createPrivateKey(path string) (*rsa.PrivateKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(path, pemBytes, 0600); err != nil {
+		return nil, err
+	}
+
+	return privateKey, nil
+}
+
+func createCertificate(path string, privateKey *rsa.PrivateKey) (*KeyPair, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "authfish"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificateLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := os.WriteFile(path, pemBytes, 0644); err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{privateKey: privateKey, Certificate: certificate}, nil
+}
+
+// The certificate as it appears in metadata and signatures.
+func (k *KeyPair) CertificateBase64() string {
+	return base64.StdEncoding.EncodeToString(k.Certificate.Raw)
+}
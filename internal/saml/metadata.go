@@ -0,0 +1,39 @@
+package saml
+
+import (
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Returns the metadata of authfish as an identity provider, which service
+// providers read the entity ID, the single sign-on URL and the certificate
+// from.
+func (k *KeyPair) Metadata(entityId string, singleSignOnUrl string) ([]byte, error) {
+	entityDescriptor := etree.NewElement("md:EntityDescriptor")
+	entityDescriptor.CreateAttr("xmlns:md", namespaceMetadata)
+	entityDescriptor.CreateAttr("xmlns:ds", dsig.Namespace)
+	entityDescriptor.CreateAttr("entityID", entityId)
+
+	idpDescriptor := entityDescriptor.CreateElement("md:IDPSSODescriptor")
+	idpDescriptor.CreateAttr("WantAuthnRequestsSigned", "false")
+	idpDescriptor.CreateAttr("protocolSupportEnumeration", namespaceProtocol)
+
+	keyDescriptor := idpDescriptor.CreateElement("md:KeyDescriptor")
+	keyDescriptor.CreateAttr("use", "signing")
+	keyDescriptor.CreateElement("ds:KeyInfo").CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").SetText(k.CertificateBase64())
+
+	idpDescriptor.CreateElement("md:NameIDFormat").SetText(NameIdFormatUnspecified)
+
+	for _, binding := range []string{BindingHttpRedirect, BindingHttpPost} {
+		singleSignOnService := idpDescriptor.CreateElement("md:SingleSignOnService")
+		singleSignOnService.CreateAttr("Binding", binding)
+		singleSignOnService.CreateAttr("Location", singleSignOnUrl)
+	}
+
+	document := etree.NewDocument()
+	document.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	document.SetRoot(entityDescriptor)
+	document.Indent(2)
+
+	return document.WriteToBytes()
+}
@@ -0,0 +1,227 @@
+package saml
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	namespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	namespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	namespaceMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	BindingHttpPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	BindingHttpRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	NameIdFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	StatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	StatusResponder = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	StatusNoPassive = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+
+	attributeNameFormatBasic  = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	authnContextPassword      = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	subjectConfirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// How long the service provider may take to consume an assertion
+	AssertionLifetime = 5 * time.Minute
+)
+
+// What authfish asserts about a user to a service provider.
+type Assertion struct {
+	Issuer       string // Entity ID of authfish
+	Audience     string // Entity ID of the service provider
+	Destination  string // Assertion consumer service URL
+	InResponseTo string // ID of the AuthnRequest
+	NameId       string
+	AuthnInstant time.Time
+	Attributes   []Attribute
+}
+
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+// Returns a Response with the signed assertion, ready to be posted to the
+// service provider.
+func (k *KeyPair) SignedResponse(a Assertion) ([]byte, error) {
+	now := time.Now().UTC()
+	response := newResponse(a.Issuer, a.Destination, a.InResponseTo, now)
+	addStatus(response, StatusSuccess, "")
+
+	assertion, err := k.signAssertion(buildAssertion(a, now))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not sign assertion: %w", err)
+	}
+
+	response.AddChild(assertion)
+
+	return writeDocument(response)
+}
+
+// Returns an unsigned Response telling the service provider that the user
+// could not be logged in.
+func ErrorResponse(issuer string, destination string, inResponseTo string, statusCode string, message string) ([]byte, error) {
+	response := newResponse(issuer, destination, inResponseTo, time.Now().UTC())
+	addStatus(response, StatusResponder, statusCode)
+
+	if len(message) > 0 {
+		response.SelectElement("samlp:Status").CreateElement("samlp:StatusMessage").SetText(message)
+	}
+
+	return writeDocument(response)
+}
+
+func newResponse(issuer string, destination string, inResponseTo string, now time.Time) *etree.Element {
+	response := etree.NewElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", namespaceProtocol)
+	response.CreateAttr("xmlns:saml", namespaceAssertion)
+	response.CreateAttr("ID", newId())
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", formatTime(now))
+	response.CreateAttr("Destination", destination)
+
+	if len(inResponseTo) > 0 {
+		response.CreateAttr("InResponseTo", inResponseTo)
+	}
+
+	response.CreateElement("saml:Issuer").SetText(issuer)
+
+	return response
+}
+
+// Second level status codes, like NoPassive, are nested in the top level one.
+func addStatus(response *etree.Element, statusCode string, secondLevelStatusCode string) {
+	status := response.CreateElement("samlp:Status")
+	code := status.CreateElement("samlp:StatusCode")
+	code.CreateAttr("Value", statusCode)
+
+	if len(secondLevelStatusCode) > 0 {
+		code.CreateElement("samlp:StatusCode").CreateAttr("Value", secondLevelStatusCode)
+	}
+}
+
+func buildAssertion(a Assertion, now time.Time) *etree.Element {
+	notOnOrAfter := formatTime(now.Add(AssertionLifetime))
+
+	// The namespace is declared again so that the assertion is the same on
+	// its own, which is how its signature is computed.
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", namespaceAssertion)
+	assertion.CreateAttr("ID", newId())
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", formatTime(now))
+	assertion.CreateElement("saml:Issuer").SetText(a.Issuer)
+
+	subject := assertion.CreateElement("saml:Subject")
+	nameId := subject.CreateElement("saml:NameID")
+	nameId.CreateAttr("Format", NameIdFormatUnspecified)
+	nameId.SetText(a.NameId)
+
+	subjectConfirmation := subject.CreateElement("saml:SubjectConfirmation")
+	subjectConfirmation.CreateAttr("Method", subjectConfirmationBearer)
+	subjectConfirmationData := subjectConfirmation.CreateElement("saml:SubjectConfirmationData")
+
+	if len(a.InResponseTo) > 0 {
+		subjectConfirmationData.CreateAttr("InResponseTo", a.InResponseTo)
+	}
+
+	subjectConfirmationData.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	subjectConfirmationData.CreateAttr("Recipient", a.Destination)
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", formatTime(now))
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(a.Audience)
+
+	authnStatement := assertion.CreateElement("saml:AuthnStatement")
+	authnStatement.CreateAttr("AuthnInstant", formatTime(a.AuthnInstant.UTC()))
+	authnStatement.CreateAttr("SessionIndex", newId())
+	authnStatement.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").SetText(authnContextPassword)
+
+	attributeStatement := etree.NewElement("saml:AttributeStatement")
+
+	for _, a := range a.Attributes {
+		// An attribute without values is one the user doesn't have
+		if len(a.Values) == 0 {
+			continue
+		}
+
+		attribute := attributeStatement.CreateElement("saml:Attribute")
+		attribute.CreateAttr("Name", a.Name)
+		attribute.CreateAttr("NameFormat", attributeNameFormatBasic)
+
+		for _, value := range a.Values {
+			attribute.CreateElement("saml:AttributeValue").SetText(value)
+		}
+	}
+
+	// An empty AttributeStatement is not allowed
+	if len(attributeStatement.ChildElements()) > 0 {
+		assertion.AddChild(attributeStatement)
+	}
+
+	return assertion
+}
+
+// Signs assertion with an enveloped signature, which the schema wants right
+// after the Issuer.
+func (k *KeyPair) signAssertion(assertion *etree.Element) (*etree.Element, error) {
+	signingContext, err := dsig.NewSigningContext(k.privateKey, [][]byte{k.Certificate.Raw})
+
+	if err != nil {
+		return nil, err
+	}
+
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	if err := signingContext.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		return nil, err
+	}
+
+	signed, err := signingContext.SignEnveloped(assertion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signature := signed.RemoveChildAt(len(signed.Child) - 1)
+	signed.InsertChildAt(1, signature)
+
+	return signed, nil
+}
+
+func writeDocument(root *etree.Element) ([]byte, error) {
+	document := etree.NewDocument()
+	document.SetRoot(root)
+
+	return document.WriteToBytes()
+}
+
+// IDs must not start with a digit.
+func newId() string {
+	randomBytes := make([]byte, 20)
+
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic(err)
+	}
+
+	return "_" + hex.EncodeToString(randomBytes)
+}
+
+func formatTime(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05.000Z")
+}
+
+// Encodes a response for the SAMLResponse form field.
+func EncodeResponse(response []byte) string {
+	return base64.StdEncoding.EncodeToString(response)
+}
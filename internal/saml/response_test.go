@@ -0,0 +1,248 @@
+package saml
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testIdpEntityId = "https://auth.example.com/saml/metadata"
+	testSpEntityId  = "https://app.example.com/saml/metadata"
+	testAcsUrl      = "https://app.example.com/saml/acs"
+	testRequestId   = "_request-1"
+)
+
+func newTestKeyPair(t *testing.T) *KeyPair {
+	dir := t.TempDir()
+	keyPair, err := LoadOrCreateKeyPair(filepath.Join(dir, "saml_signing_key.pem"), filepath.Join(dir, "saml_certificate.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPair
+}
+
+func testAssertion() Assertion {
+	return Assertion{
+		Issuer:       testIdpEntityId,
+		Audience:     testSpEntityId,
+		Destination:  testAcsUrl,
+		InResponseTo: testRequestId,
+		NameId:       "alice",
+		AuthnInstant: time.Now(),
+		Attributes: []Attribute{
+			{Name: "uid", Values: []string{"alice"}},
+			{Name: "groups", Values: []string{"admins", "staff"}},
+			{Name: "empty"},
+		},
+	}
+}
+
+// Parses a response and returns its root element and its assertion.
+func parseResponse(t *testing.T, response []byte) (*etree.Element, *etree.Element) {
+	document := etree.NewDocument()
+
+	if err := document.ReadFromBytes(response); err != nil {
+		t.Fatal(err)
+	}
+
+	root := document.Root()
+	assertion := root.SelectElement("Assertion")
+
+	if root.Tag != "Response" || assertion == nil {
+		t.Fatalf("got a %s without an assertion: %s", root.Tag, response)
+	}
+
+	return root, assertion
+}
+
+func validateSignature(assertion *etree.Element, certificate *x509.Certificate) error {
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{certificate},
+	})
+
+	_, err := validationContext.Validate(assertion)
+
+	return err
+}
+
+func TestSignedResponse(t *testing.T) {
+	keyPair := newTestKeyPair(t)
+	before := time.Now().UTC().Truncate(time.Millisecond)
+
+	response, err := keyPair.SignedResponse(testAssertion())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, assertion := parseResponse(t, response)
+
+	if err := validateSignature(assertion, keyPair.Certificate); err != nil {
+		t.Fatalf("signature does not validate: %v", err)
+	}
+
+	// The schema wants the signature right after the Issuer
+	children := assertion.ChildElements()
+
+	if len(children) < 2 || children[0].Tag != "Issuer" || children[1].Tag != "Signature" {
+		t.Errorf("assertion starts with %v, want Issuer and Signature", children)
+	}
+
+	if got := root.SelectAttrValue("Destination", ""); got != testAcsUrl {
+		t.Errorf("got Destination %q, want %q", got, testAcsUrl)
+	}
+
+	if got := root.SelectAttrValue("InResponseTo", ""); got != testRequestId {
+		t.Errorf("got InResponseTo %q on the response, want %q", got, testRequestId)
+	}
+
+	if got := root.FindElement("./Status/StatusCode").SelectAttrValue("Value", ""); got != StatusSuccess {
+		t.Errorf("got status %q", got)
+	}
+
+	if audience := assertion.FindElement("./Conditions/AudienceRestriction/Audience"); audience == nil || audience.Text() != testSpEntityId {
+		t.Errorf("got Audience %v, want %q", audience, testSpEntityId)
+	}
+
+	if nameId := assertion.FindElement("./Subject/NameID"); nameId == nil || nameId.Text() != "alice" {
+		t.Errorf("got NameID %v, want alice", nameId)
+	}
+
+	confirmationData := assertion.FindElement("./Subject/SubjectConfirmation/SubjectConfirmationData")
+
+	if confirmationData == nil {
+		t.Fatal("assertion has no SubjectConfirmationData")
+	}
+
+	if got := confirmationData.SelectAttrValue("Recipient", ""); got != testAcsUrl {
+		t.Errorf("got Recipient %q, want %q", got, testAcsUrl)
+	}
+
+	if got := confirmationData.SelectAttrValue("InResponseTo", ""); got != testRequestId {
+		t.Errorf("got InResponseTo %q in the assertion, want %q", got, testRequestId)
+	}
+
+	conditions := assertion.SelectElement("Conditions")
+
+	for _, element := range []*etree.Element{confirmationData, conditions} {
+		notOnOrAfter, err := time.Parse(time.RFC3339, element.SelectAttrValue("NotOnOrAfter", ""))
+
+		if err != nil {
+			t.Fatalf("%s has an invalid NotOnOrAfter: %v", element.Tag, err)
+		}
+
+		if notOnOrAfter.Before(before.Add(AssertionLifetime)) || notOnOrAfter.After(time.Now().Add(AssertionLifetime)) {
+			t.Errorf("%s is valid until %v, want %v after signing", element.Tag, notOnOrAfter, AssertionLifetime)
+		}
+	}
+
+	attributes := map[string][]string{}
+
+	for _, attribute := range assertion.FindElements("./AttributeStatement/Attribute") {
+		for _, value := range attribute.SelectElements("AttributeValue") {
+			name := attribute.SelectAttrValue("Name", "")
+			attributes[name] = append(attributes[name], value.Text())
+		}
+	}
+
+	if len(attributes) != 2 || len(attributes["uid"]) != 1 || len(attributes["groups"]) != 2 {
+		t.Errorf("got attributes %v, want uid and both groups, without empty", attributes)
+	}
+}
+
+func TestSignedResponseRejectsChanges(t *testing.T) {
+	keyPair := newTestKeyPair(t)
+	otherKeyPair := newTestKeyPair(t)
+
+	tests := []struct {
+		name string
+		// Changes the signed assertion
+		change      func(assertion *etree.Element)
+		certificate *x509.Certificate
+	}{
+		{
+			name:   "changed NameID",
+			change: func(assertion *etree.Element) { assertion.FindElement("./Subject/NameID").SetText("mallory") },
+		},
+		{
+			name: "changed Audience",
+			change: func(assertion *etree.Element) {
+				assertion.FindElement("./Conditions/AudienceRestriction/Audience").SetText("https://evil.example.org")
+			},
+		},
+		{
+			name: "added attribute",
+			change: func(assertion *etree.Element) {
+				attribute := assertion.FindElement("./AttributeStatement").CreateElement("saml:Attribute")
+				attribute.CreateAttr("Name", "groups")
+				attribute.CreateElement("saml:AttributeValue").SetText("admins")
+			},
+		},
+		{
+			name:        "certificate of another key",
+			certificate: otherKeyPair.Certificate,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := keyPair.SignedResponse(testAssertion())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, assertion := parseResponse(t, response)
+			certificate := keyPair.Certificate
+
+			if test.change != nil {
+				test.change(assertion)
+			}
+
+			if test.certificate != nil {
+				certificate = test.certificate
+			}
+
+			if err := validateSignature(assertion, certificate); err == nil {
+				t.Error("signature still validates")
+			}
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	response, err := ErrorResponse(testIdpEntityId, testAcsUrl, testRequestId, StatusNoPassive, "the user is not logged in")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document := etree.NewDocument()
+
+	if err := document.ReadFromBytes(response); err != nil {
+		t.Fatal(err)
+	}
+
+	root := document.Root()
+
+	if root.SelectElement("Assertion") != nil {
+		t.Error("error response has an assertion")
+	}
+
+	statusCode := root.FindElement("./Status/StatusCode")
+
+	if statusCode.SelectAttrValue("Value", "") != StatusResponder || statusCode.FindElement("./StatusCode").SelectAttrValue("Value", "") != StatusNoPassive {
+		t.Errorf("got status %s", response)
+	}
+
+	if got := root.SelectAttrValue("InResponseTo", ""); got != testRequestId {
+		t.Errorf("got InResponseTo %q, want %q", got, testRequestId)
+	}
+}
@@ -0,0 +1,109 @@
+package saml
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// User fields which can be sent as the NameID or as attributes.
+const (
+	FieldId        = "id"
+	FieldUsername  = "username"
+	FieldIsAdmin   = "is_admin"
+	FieldSource    = "source"
+	FieldCreatedAt = "created_at"
+	FieldGroups    = "groups" // One value per group
+)
+
+var Fields = []string{FieldId, FieldUsername, FieldIsAdmin, FieldSource, FieldCreatedAt, FieldGroups}
+
+// An app which lets its users log in with authfish over SAML.
+type ServiceProvider struct {
+	Id          int64     `db:"id"`
+	EntityId    string    `db:"entity_id"`
+	AcsUrls     string    `db:"acs_urls"` // Space separated, the first one is the default
+	NameIdField string    `db:"name_id_field"`
+	Attributes  string    `db:"attributes"` // Space separated <attribute name>=<field>
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// An attribute sent to a service provider, and the user field it is set to.
+type AttributeMapping struct {
+	Name  string
+	Field string
+}
+
+func ValidateField(field string) error {
+	for _, known := range Fields {
+		if field == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("field must be one of %s: %q", strings.Join(Fields, ", "), field)
+}
+
+// Parses an attribute mapping like uid=username. Attribute names are often
+// URIs, so only the last = separates the name from the field.
+func ParseAttributeMapping(mapping string) (AttributeMapping, error) {
+	i := strings.LastIndex(mapping, "=")
+
+	if i <= 0 {
+		return AttributeMapping{}, fmt.Errorf("attribute must look like <name>=<field>: %q", mapping)
+	}
+
+	name := mapping[:i]
+	field := mapping[i+1:]
+
+	if strings.ContainsAny(name, " \t\r\n") {
+		return AttributeMapping{}, fmt.Errorf("attribute name must not contain spaces: %q", name)
+	}
+
+	if err := ValidateField(field); err != nil {
+		return AttributeMapping{}, err
+	}
+
+	return AttributeMapping{Name: name, Field: field}, nil
+}
+
+func (m AttributeMapping) String() string {
+	return m.Name + "=" + m.Field
+}
+
+func (sp ServiceProvider) AcsUrlList() []string {
+	return strings.Fields(sp.AcsUrls)
+}
+
+// Returns the URL to send the response to. An AssertionConsumerServiceURL in
+// the request must match a registered one exactly, and requests without one
+// get the first registered URL.
+func (sp ServiceProvider) AcsUrl(requested string) (string, bool) {
+	acsUrls := sp.AcsUrlList()
+
+	if len(requested) == 0 && len(acsUrls) > 0 {
+		return acsUrls[0], true
+	}
+
+	for _, allowed := range acsUrls {
+		if allowed == requested {
+			return allowed, true
+		}
+	}
+
+	return "", false
+}
+
+// Mappings are validated when the service provider is added, so invalid ones
+// are skipped.
+func (sp ServiceProvider) AttributeMappings() []AttributeMapping {
+	mappings := []AttributeMapping{}
+
+	for _, mapping := range strings.Fields(sp.Attributes) {
+		if parsed, err := ParseAttributeMapping(mapping); err == nil {
+			mappings = append(mappings, parsed)
+		}
+	}
+
+	return mappings
+}
@@ -0,0 +1,162 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"authfish/internal/utils"
+)
+
+const (
+	Issuer            = "authfish"
+	SecretSize        = 20 // RFC 4226 recommends 160 bit secrets for HMAC-SHA1
+	Digits            = 6
+	Period            = 30 * time.Second
+	Skew              = 1 // Number of periods before and after now to accept
+	RecoveryCodeCount = 10
+	RecoveryCodeSize  = 5
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Credential struct {
+	UserId       int64      `db:"user_id"`
+	Secret       string     `db:"secret"`
+	ConfirmedAt  *time.Time `db:"confirmed_at"`
+	LastUsedStep int64      `db:"last_used_step"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+func (c Credential) IsConfirmed() bool {
+	return c.ConfirmedAt != nil
+}
+
+type RecoveryCode struct {
+	Id         int64      `db:"id"`
+	UserId     int64      `db:"user_id"`
+	HashedCode string     `db:"hashed_code"`
+	UsedAt     *time.Time `db:"used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("could not generate random bytes: %w", err)
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// Returns the otpauth:// URI understood by authenticator apps, which is what
+// gets encoded in the enrollment QR code.
+func ProvisioningURI(secret string, accountName string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", Issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period.Seconds())))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + Issuer + ":" + accountName,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Generate the code for a single time step, as per RFC 6238.
+func GenerateCode(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+
+	if err != nil {
+		return "", fmt.Errorf("could not decode totp secret: %w", err)
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, as per RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	binaryCode := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, binaryCode%modulus), nil
+}
+
+// Check code against the steps surrounding t. Steps at or before lastUsedStep
+// are rejected so that a code can not be replayed. Returns the matching step
+// so that it can be recorded as the new lastUsedStep.
+func Validate(secret string, code string, t time.Time, lastUsedStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	currentStep := Step(t)
+
+	for step := currentStep - Skew; step <= currentStep+Skew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+
+		expected, err := GenerateCode(secret, step)
+
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		randomBytes := make([]byte, RecoveryCodeSize)
+
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, fmt.Errorf("could not generate random bytes: %w", err)
+		}
+
+		codes = append(codes, hex.EncodeToString(randomBytes))
+	}
+
+	return codes, nil
+}
+
+// Recovery codes may be typed in upper case or copied with whitespace.
+func HashRecoveryCode(code string) string {
+	return utils.HashToken(strings.ToLower(strings.TrimSpace(code)))
+}
@@ -0,0 +1,121 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret of the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestGenerateCode(t *testing.T) {
+	// RFC 6238 appendix B, whose 8 digit codes end in these 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, test := range tests {
+		t.Run(time.Unix(test.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			code, err := GenerateCode(rfcSecret, Step(time.Unix(test.unix, 0)))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code != test.want {
+				t.Errorf("got code %s, want %s", code, test.want)
+			}
+		})
+	}
+}
+
+func TestGenerateCodeAcceptsLowerCaseSecrets(t *testing.T) {
+	upper, _ := GenerateCode(rfcSecret, 1)
+	lower, err := GenerateCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+
+	if err != nil || lower != upper {
+		t.Errorf("got code %s and error %v, want %s", lower, err, upper)
+	}
+}
+
+func TestGenerateCodeRejectsInvalidSecrets(t *testing.T) {
+	if _, err := GenerateCode("not base32!", 1); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := GenerateCode(rfcSecret, step)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return code
+	}
+
+	tests := []struct {
+		name         string
+		code         string
+		lastUsedStep int64
+		wantStep     int64
+		wantOk       bool
+	}{
+		{name: "current step", code: codeAt(step), wantStep: step, wantOk: true},
+		{name: "with spaces", code: " " + codeAt(step) + "\n", wantStep: step, wantOk: true},
+		{name: "previous step", code: codeAt(step - Skew), wantStep: step - Skew, wantOk: true},
+		{name: "next step", code: codeAt(step + Skew), wantStep: step + Skew, wantOk: true},
+		{name: "before the window", code: codeAt(step - Skew - 1)},
+		{name: "after the window", code: codeAt(step + Skew + 1)},
+		{name: "wrong code", code: "000000"},
+		{name: "too short", code: codeAt(step)[1:]},
+		{name: "replayed", code: codeAt(step), lastUsedStep: step},
+		{name: "older than the last used step", code: codeAt(step - 1), lastUsedStep: step},
+		{name: "newer than the last used step", code: codeAt(step + 1), lastUsedStep: step, wantStep: step + 1, wantOk: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotStep, ok := Validate(rfcSecret, test.code, now, test.lastUsedStep)
+
+			if ok != test.wantOk || gotStep != test.wantStep {
+				t.Errorf("got step %d and %v, want step %d and %v", gotStep, ok, test.wantStep, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	// Users may copy codes with whitespace or type them in upper case
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+codes[0]+"\n") || HashRecoveryCode(codes[0]) != HashRecoveryCode(strings.ToUpper(codes[0])) {
+		t.Error("hash depends on case or whitespace")
+	}
+
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Error("different codes have the same hash")
+	}
+}
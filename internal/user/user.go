@@ -6,6 +6,17 @@ type CurrentUserContext struct{}
 
 var CurrentUserContextKey CurrentUserContext = CurrentUserContext{}
 
+const (
+	StatusActive  = "active"
+	StatusPending = "pending" // Signed up, but not yet approved by an admin
+)
+
+// Where the password of a user is checked.
+const (
+	SourceLocal = "local"
+	SourceLdap  = "ldap" // Created on first login, groups are synced from LDAP
+)
+
 type User struct {
 	Id                int64     `db:"id"`
 	Username          string    `db:"username"`
@@ -13,4 +24,28 @@ type User struct {
 	RegistrationToken *string   `db:"registration_token"`
 	CreatedAt         time.Time `db:"created_at"`
 	UpdatedAt         time.Time `db:"updated_at"`
+
+	RegistrationTokenExpiresAt *time.Time `db:"registration_token_expires_at"`
+	Status                     string     `db:"status"`
+	IsAdmin                    bool       `db:"is_admin"`
+	DisabledAt                 *time.Time `db:"disabled_at"`
+	Source                     string     `db:"source"`
+}
+
+// Whether u may log in and use authfish protected resources.
+func (u User) IsActive() bool {
+	return u.Status == StatusActive && !u.IsDisabled()
+}
+
+func (u User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
+// Whether the password of u is managed by authfish, rather than a directory.
+func (u User) HasLocalPassword() bool {
+	return u.Source == SourceLocal
+}
+
+func (u User) RegistrationTokenExpired() bool {
+	return u.RegistrationTokenExpiresAt != nil && time.Now().After(*u.RegistrationTokenExpiresAt)
 }
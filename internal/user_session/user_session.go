@@ -0,0 +1,15 @@
+package user_session
+
+import "time"
+
+type UserSession struct {
+	Id         int64     `db:"id"`
+	TokenHash  string    `db:"token_hash"`
+	UserId     *int64    `db:"user_id"`
+	Data       []byte    `db:"data"`
+	IpAddress  string    `db:"ip_address"`
+	UserAgent  string    `db:"user_agent"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
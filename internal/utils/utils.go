@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
 	"strings"
 )
 
@@ -9,3 +12,27 @@ func NormalizeUsername(username string) string {
 		username,
 	)
 }
+
+func NormalizeGroupName(name string) string {
+	return strings.TrimSpace(
+		name,
+	)
+}
+
+// Hash a random token, like an API key or a session token, for storage.
+// Random tokens can't be guessed like passwords can, so a fast unsalted hash
+// is enough to protect them.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether requests with method are not supposed to change anything.
+func IsSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,348 @@
+package admin
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"authfish/internal/api_key"
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/user_session"
+	"authfish/internal/utils"
+	"authfish/internal/web/csrf"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	//go:embed users.template.html
+	usersTemplateString string
+	usersTemplate       *template.Template = template.Must(template.New("users").Parse(usersTemplateString))
+
+	//go:embed user.template.html
+	userTemplateString string
+	userTemplate       *template.Template = template.Must(template.New("user").Parse(userTemplateString))
+)
+
+const (
+	// Session flashes carrying the result of an action to the next page
+	noticeFlashKey = "adminNotice"
+	linkFlashKey   = "adminLink"
+
+	inviteLifetime        = 7 * 24 * time.Hour
+	passwordResetLifetime = 48 * time.Hour
+)
+
+type templateVars struct {
+	CurrentUser *user.User
+	Users       []user.User
+	User        *user.User
+	ApiKeys     []api_key.ApiKey
+	Sessions    []user_session.UserSession
+	Notice      string
+	Link        string
+	CsrfToken   string
+}
+
+func renderTemplate(rw http.ResponseWriter, r *http.Request, t *template.Template, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
+	rw.WriteHeader(status)
+	t.Execute(rw, vars)
+}
+
+type Service struct {
+	store sessions.Store
+	db    *sqlx.DB
+}
+
+func New(store sessions.Store, db *sqlx.DB) *Service {
+	return &Service{
+		store: store,
+		db:    db,
+	}
+}
+
+// Lists all users, with forms to invite new ones.
+func (s *Service) ShowUsers(rw http.ResponseWriter, r *http.Request) {
+	currentUser := s.requireAdmin(rw, r)
+
+	if currentUser == nil {
+		return
+	}
+
+	users, err := database.ListUsers(s.db)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vars := templateVars{CurrentUser: currentUser, Users: users}
+	vars.Notice, vars.Link = s.popFlashes(rw, r)
+
+	renderTemplate(rw, r, usersTemplate, http.StatusOK, vars)
+}
+
+// Shows the sessions and API keys of the user named in the username query
+// parameter.
+func (s *Service) ShowUser(rw http.ResponseWriter, r *http.Request) {
+	currentUser := s.requireAdmin(rw, r)
+
+	if currentUser == nil {
+		return
+	}
+
+	u := s.findUser(rw, r.URL.Query().Get("username"))
+
+	if u == nil {
+		return
+	}
+
+	apiKeys, err := database.ListApiKeys(s.db, *u)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userSessions, err := database.ListUserSessionsForUser(s.db, *u)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vars := templateVars{CurrentUser: currentUser, User: u, ApiKeys: apiKeys, Sessions: userSessions}
+	vars.Notice, vars.Link = s.popFlashes(rw, r)
+
+	renderTemplate(rw, r, userTemplate, http.StatusOK, vars)
+}
+
+// Handles every form on the admin pages. The action field picks what to do
+// with the user named in the username field.
+func (s *Service) HandleAction(rw http.ResponseWriter, r *http.Request) {
+	currentUser := s.requireAdmin(rw, r)
+
+	if currentUser == nil {
+		return
+	}
+
+	action := r.FormValue("action")
+	username := utils.NormalizeUsername(r.FormValue("username"))
+
+	if action == "invite" {
+		s.handleInvite(rw, r, username)
+		return
+	}
+
+	u := s.findUser(rw, username)
+
+	if u == nil {
+		return
+	}
+
+	switch action {
+	case "approve":
+		s.handleApprove(rw, r, *u)
+	case "delete":
+		s.handleDelete(rw, r, *currentUser, *u)
+	case "disable":
+		s.handleDisable(rw, r, *currentUser, *u)
+	case "enable":
+		s.handleEnable(rw, r, *u)
+	case "reset-password":
+		s.handleResetPassword(rw, r, *u)
+	case "revoke-key":
+		s.handleRevokeKey(rw, r, *u)
+	case "revoke-session":
+		s.handleRevokeSession(rw, r, *u)
+	default:
+		http.Error(rw, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+func (s *Service) handleInvite(rw http.ResponseWriter, r *http.Request, username string) {
+	if len(username) == 0 {
+		http.Error(rw, "Username must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(inviteLifetime).UTC().Truncate(time.Second)
+	u, err := database.RegisterNewUser(s.db, username, &expiresAt)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, "/admin", fmt.Sprintf("Invited %s. Send them this link, it expires on %s:", u.Username, expiresAt), registrationPath(*u.RegistrationToken))
+}
+
+func (s *Service) handleApprove(rw http.ResponseWriter, r *http.Request, u user.User) {
+	if err := database.ApproveUser(s.db, u); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, "/admin", fmt.Sprintf("Approved %s.", u.Username), "")
+}
+
+func (s *Service) handleDelete(rw http.ResponseWriter, r *http.Request, currentUser user.User, u user.User) {
+	if u.Id == currentUser.Id {
+		http.Error(rw, "You can't delete yourself", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.DeleteUser(s.db, u.Username); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, "/admin", fmt.Sprintf("Deleted %s.", u.Username), "")
+}
+
+func (s *Service) handleDisable(rw http.ResponseWriter, r *http.Request, currentUser user.User, u user.User) {
+	if u.Id == currentUser.Id {
+		http.Error(rw, "You can't disable yourself", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.DisableUser(s.db, u); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, userPath(u), fmt.Sprintf("Disabled %s.", u.Username), "")
+}
+
+func (s *Service) handleEnable(rw http.ResponseWriter, r *http.Request, u user.User) {
+	if err := database.EnableUser(s.db, u); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, userPath(u), fmt.Sprintf("Enabled %s.", u.Username), "")
+}
+
+func (s *Service) handleResetPassword(rw http.ResponseWriter, r *http.Request, u user.User) {
+	expiresAt := time.Now().Add(passwordResetLifetime).UTC().Truncate(time.Second)
+	token, err := database.ReissueRegistrationToken(s.db, u, &expiresAt)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, userPath(u), fmt.Sprintf("Send %s this link to choose a new password, it expires on %s:", u.Username, expiresAt), registrationPath(token))
+}
+
+func (s *Service) handleRevokeKey(rw http.ResponseWriter, r *http.Request, u user.User) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	if err != nil {
+		http.Error(rw, "Invalid api key id", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.DeleteApiKey(s.db, u, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, userPath(u), "Revoked API key.", "")
+}
+
+func (s *Service) handleRevokeSession(rw http.ResponseWriter, r *http.Request, u user.User) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	if err != nil {
+		http.Error(rw, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.RevokeUserSessionForUser(s.db, u, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.redirectWithFlashes(rw, r, userPath(u), "Logged out session.", "")
+}
+
+// Returns the current user if they are an admin. Otherwise responds with a
+// redirect to the login page or an error, and returns nil.
+func (s *Service) requireAdmin(rw http.ResponseWriter, r *http.Request) *user.User {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return nil
+	}
+
+	if !currentUser.IsAdmin {
+		http.Error(rw, "Only admins can see this page", http.StatusForbidden)
+		return nil
+	}
+
+	// API keys are for scripts, not for administering authfish
+	if current_user.CurrentAuthMethod(r.Context()) != current_user.AuthMethodSession {
+		http.Error(rw, "Log in to use the admin pages", http.StatusForbidden)
+		return nil
+	}
+
+	return currentUser
+}
+
+// Returns the user with username, or responds with an error and returns nil.
+func (s *Service) findUser(rw http.ResponseWriter, username string) *user.User {
+	u, err := database.FindUserByUsername(s.db, username)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	if u == nil {
+		http.Error(rw, fmt.Sprintf("User does not exist: %s", username), http.StatusNotFound)
+		return nil
+	}
+
+	return u
+}
+
+func (s *Service) redirectWithFlashes(rw http.ResponseWriter, r *http.Request, path string, notice string, link string) {
+	if err := session.AddFlash(rw, r, s.store, noticeFlashKey, notice); err != nil {
+		http.Error(rw, fmt.Sprintf("could not save session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(link) > 0 {
+		if err := session.AddFlash(rw, r, s.store, linkFlashKey, link); err != nil {
+			http.Error(rw, fmt.Sprintf("could not save session: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(rw, r, path, http.StatusFound)
+}
+
+func (s *Service) popFlashes(rw http.ResponseWriter, r *http.Request) (string, string) {
+	notice, _ := session.PopFlash(rw, r, s.store, noticeFlashKey)
+	link, _ := session.PopFlash(rw, r, s.store, linkFlashKey)
+	return notice, link
+}
+
+func userPath(u user.User) string {
+	return "/admin/user?" + url.Values{"username": {u.Username}}.Encode()
+}
+
+func registrationPath(token string) string {
+	return "/register?" + url.Values{"registrationToken": {token}}.Encode()
+}
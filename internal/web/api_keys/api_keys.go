@@ -0,0 +1,105 @@
+package api_keys
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// Session flash holding a newly created key until /me shows it
+	NewApiKeyFlashKey = "newApiKey"
+
+	maxMemoLength = 200
+)
+
+type Service struct {
+	store sessions.Store
+	db    *sqlx.DB
+}
+
+func New(store sessions.Store, db *sqlx.DB) *Service {
+	return &Service{
+		store: store,
+		db:    db,
+	}
+}
+
+// Handles the API key forms on /me.
+func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Don't let API keys mint more API keys
+	if current_user.CurrentAuthMethod(r.Context()) != current_user.AuthMethodSession {
+		http.Error(rw, "API keys can only be managed after logging in", http.StatusForbidden)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "create":
+		s.handleCreate(rw, r, *currentUser)
+	case "revoke":
+		s.handleRevoke(rw, r, *currentUser)
+	default:
+		http.Error(rw, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+func (s *Service) handleCreate(rw http.ResponseWriter, r *http.Request, u user.User) {
+	memo := strings.TrimSpace(r.FormValue("memo"))
+
+	if len(memo) == 0 || len(memo) > maxMemoLength {
+		http.Error(rw, fmt.Sprintf("Memo must be between 1 and %d characters", maxMemoLength), http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := database.CreateApiKey(s.db, u, memo, nil, nil)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.AddFlash(rw, r, s.store, NewApiKeyFlashKey, apiKey.Key); err != nil {
+		http.Error(rw, fmt.Sprintf("could not save session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(rw, r, "/me", http.StatusFound)
+}
+
+func (s *Service) handleRevoke(rw http.ResponseWriter, r *http.Request, u user.User) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	if err != nil {
+		http.Error(rw, "Invalid api key id", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.DeleteApiKey(s.db, u, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(rw, r, "/me", http.StatusFound)
+}
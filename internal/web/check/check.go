@@ -1,9 +1,16 @@
 package check
 
 import (
+	"authfish/internal/database"
+	"authfish/internal/policy"
+	"authfish/internal/user"
 	"authfish/internal/web/current_user"
 	"authfish/internal/web/session"
 	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	_ "embed"
 	"net/http"
@@ -12,15 +19,30 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// Names of the response headers used to describe the authenticated user to
+// nginx. Headers with an empty name are not sent.
+type IdentityHeaders struct {
+	User       string
+	UserId     string
+	Groups     string
+	AuthMethod string
+}
+
 type Service struct {
-	store sessions.Store
-	db    *sqlx.DB
+	store    sessions.Store
+	db       *sqlx.DB
+	domains  []string
+	lifetime session.Lifetime
+	headers  IdentityHeaders
 }
 
-func New(store sessions.Store, db *sqlx.DB) *Service {
+func New(store sessions.Store, db *sqlx.DB, domains []string, lifetime session.Lifetime, headers IdentityHeaders) *Service {
 	return &Service{
-		store: store,
-		db:    db,
+		store:    store,
+		db:       db,
+		domains:  domains,
+		lifetime: lifetime,
+		headers:  headers,
 	}
 }
 
@@ -34,11 +56,108 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if currentUser == nil {
+	host, requestPath := originalHostAndPath(r)
+
+	policies, err := database.ListPoliciesForHost(s.db, host)
+
+	if err != nil {
+		log.Printf("Encountered error loading policies for %s: %v", host, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	groups := []string{}
+
+	if currentUser != nil {
+		groups, err = groupNames(s.db, *currentUser)
+
+		if err != nil {
+			log.Printf("Encountered error loading groups for %s: %v", currentUser.Username, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	switch policy.Evaluate(policies, currentUser, groups, requestPath) {
+	case policy.Unauthenticated:
 		log.Printf("Current user not found")
 		rw.WriteHeader(http.StatusUnauthorized)
 		return
+	case policy.Forbidden:
+		log.Printf("User %s is not allowed to access %s%s", currentUser.Username, host, requestPath)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if apiKey := current_user.CurrentApiKey(r.Context()); apiKey != nil {
+		// nginx makes auth requests with GET whatever the original method was,
+		// so r.Method is no substitute. Without the header, read-only keys are
+		// refused.
+		method := r.Header.Get("X-Original-Method")
+
+		if !apiKey.Allows(host, requestPath, method) {
+			log.Printf("Api key %s of %s is not allowed to %s %s%s", apiKey.Prefix, currentUser.Username, method, host, requestPath)
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	if currentUser != nil {
+		s.setIdentityHeaders(rw, r, currentUser, groups)
+	}
+
+	if current_user.CurrentAuthMethod(r.Context()) == current_user.AuthMethodSession {
+		if err := session.RenewUserSession(rw, r, s.store, s.domains, s.lifetime); err != nil {
+			log.Printf("Encountered error renewing session for %s: %v", currentUser.Username, err)
+		}
 	}
 
 	rw.WriteHeader(http.StatusOK)
 }
+
+func (s *Service) setIdentityHeaders(rw http.ResponseWriter, r *http.Request, u *user.User, groups []string) {
+	setHeaderIfNamed(rw, s.headers.User, u.Username)
+	setHeaderIfNamed(rw, s.headers.UserId, strconv.FormatInt(u.Id, 10))
+	setHeaderIfNamed(rw, s.headers.Groups, strings.Join(groups, ","))
+	setHeaderIfNamed(rw, s.headers.AuthMethod, string(current_user.CurrentAuthMethod(r.Context())))
+}
+
+func setHeaderIfNamed(rw http.ResponseWriter, name string, value string) {
+	if len(name) == 0 {
+		return
+	}
+
+	rw.Header().Set(name, value)
+}
+
+// Returns the host and path of the request nginx is asking about. Both are
+// empty if X-Original-URL is missing or invalid, in which case no policies
+// will match.
+func originalHostAndPath(r *http.Request) (string, string) {
+	parsedUrl, err := url.ParseRequestURI(r.Header.Get("X-Original-URL"))
+
+	if err != nil {
+		return "", ""
+	}
+
+	// nginx normalizes the URI before proxying upstream, so do the same here.
+	// Otherwise /public/../admin would be matched against policies for /public.
+	cleanPath := path.Clean("/" + parsedUrl.Path)
+
+	return policy.NormalizeHost(parsedUrl.Hostname()), cleanPath
+}
+
+func groupNames(db *sqlx.DB, u user.User) ([]string, error) {
+	groups, err := database.ListGroupsForUser(db, u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+
+	return names, nil
+}
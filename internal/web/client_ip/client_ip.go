@@ -0,0 +1,32 @@
+package client_ip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returns the IP address of the client that made r. When authfish runs behind
+// a reverse proxy, every request comes from the proxy, so the client address
+// is taken from trustedHeader instead (e.g. X-Real-IP or X-Forwarded-For). The
+// header is ignored if trustedHeader is empty, as it could be set by anyone.
+func ClientIp(r *http.Request, trustedHeader string) string {
+	if len(trustedHeader) > 0 {
+		// The proxy appends the address it saw to any list the client sent,
+		// so only the last entry can be trusted.
+		values := strings.Split(r.Header.Get(trustedHeader), ",")
+		ip := strings.TrimSpace(values[len(values)-1])
+
+		if len(ip) > 0 {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
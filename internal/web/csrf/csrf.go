@@ -0,0 +1,85 @@
+package csrf
+
+import (
+	"context"
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+
+	"authfish/internal/utils"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+var (
+	//go:embed forbidden.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("forbidden").Parse(templateString))
+)
+
+type tokenContext struct{}
+
+var tokenContextKey tokenContext = tokenContext{}
+
+// Where Token gets the CSRF token of a request from.
+type tokenSource struct {
+	store   sessions.Store
+	domains []string
+}
+
+// Rejects requests which could change something unless they carry the CSRF
+// token of their session, either in a form field or in a header for fetch()
+// requests. Pages with forms get a token from Token. Requests to exemptPaths
+// are passed through untouched.
+func Middleware(store sessions.Store, domains []string, exemptPaths ...string) mux.MiddlewareFunc {
+	exempt := map[string]bool{}
+	for _, path := range exemptPaths {
+		exempt[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if exempt[r.URL.Path] {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if !utils.IsSafeMethod(r.Method) {
+				if err := session.VerifyCsrfToken(r, store); err != nil {
+					log.Printf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+					rw.WriteHeader(http.StatusForbidden)
+					parsedTemplate.Execute(rw, nil)
+					return
+				}
+			}
+
+			source := &tokenSource{store: store, domains: domains}
+
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), tokenContextKey, source)))
+		})
+	}
+}
+
+// Returns the CSRF token to include in forms rendered for this request. The
+// token is kept in the session, so it is only created when a form needs it,
+// otherwise every anonymous visit would add a session. Callers authenticated
+// with an API key don't have a session to keep it in, and don't get one.
+func Token(rw http.ResponseWriter, r *http.Request) string {
+	source, ok := r.Context().Value(tokenContextKey).(*tokenSource)
+
+	if !ok || current_user.CurrentApiKey(r.Context()) != nil {
+		return ""
+	}
+
+	token, err := session.GetCsrfToken(rw, r, source.store, source.domains)
+
+	if err != nil {
+		log.Printf("Error saving CSRF token: %v", err)
+	}
+
+	return token
+}
@@ -0,0 +1,203 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"authfish/internal/database"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/mux"
+)
+
+func newTestRouter(t *testing.T) *mux.Router {
+	store := session.NewSqliteStore(database.OpenTestDB(t), []byte("0123456789abcdef0123456789abcdef"))
+
+	r := mux.NewRouter()
+	r.Use(Middleware(store, nil, "/exempt"))
+
+	// Renders a form
+	r.HandleFunc("/form", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(Token(rw, r)))
+	})
+
+	// Renders a page without forms, or accepts a submitted form
+	r.HandleFunc("/page", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+
+	r.HandleFunc("/exempt", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+
+	return r
+}
+
+// Fetches a form, and returns its CSRF token and the session cookie it came
+// with.
+func fetchForm(t *testing.T, router http.Handler) (string, *http.Cookie) {
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/form", nil))
+
+	cookies := rw.Result().Cookies()
+
+	if len(cookies) != 1 || cookies[0].Name != session.SessionName {
+		t.Fatalf("form did not set the session cookie: %v", cookies)
+	}
+
+	token := rw.Body.String()
+
+	if len(token) == 0 {
+		t.Fatal("form did not get a CSRF token")
+	}
+
+	return token, cookies[0]
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		withCookie bool
+		formToken  string // "valid" sends the token of the session
+		header     string // "valid" sends the token of the session
+		origin     string
+		wantStatus int
+	}{
+		{
+			name:       "same-site form post",
+			method:     http.MethodPost,
+			path:       "/page",
+			withCookie: true,
+			formToken:  "valid",
+			origin:     "https://auth.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "fetch with the token in a header",
+			method:     http.MethodPost,
+			path:       "/page",
+			withCookie: true,
+			header:     "valid",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "cross-origin post with the session cookie",
+			method:     http.MethodPost,
+			path:       "/page",
+			withCookie: true,
+			origin:     "https://evil.example.org",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "cross-origin post with a guessed token",
+			method:     http.MethodPost,
+			path:       "/page",
+			withCookie: true,
+			formToken:  strings.Repeat("0", 64),
+			origin:     "https://evil.example.org",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "cross-origin post with a token but no session",
+			method:     http.MethodPost,
+			path:       "/page",
+			formToken:  "valid",
+			origin:     "https://evil.example.org",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "cross-origin delete",
+			method:     http.MethodDelete,
+			path:       "/page",
+			withCookie: true,
+			origin:     "https://evil.example.org",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "cross-origin post to an exempt path",
+			method:     http.MethodPost,
+			path:       "/exempt",
+			origin:     "https://evil.example.org",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "get without a token",
+			method:     http.MethodGet,
+			path:       "/page",
+			withCookie: true,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t)
+			token, cookie := fetchForm(t, router)
+
+			form := url.Values{}
+			if test.formToken == "valid" {
+				form.Set(session.CsrfTokenFormField, token)
+			} else if len(test.formToken) > 0 {
+				form.Set(session.CsrfTokenFormField, test.formToken)
+			}
+
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if test.withCookie {
+				r.AddCookie(cookie)
+			}
+
+			if test.header == "valid" {
+				r.Header.Set(session.CsrfTokenHeader, token)
+			}
+
+			if len(test.origin) > 0 {
+				r.Header.Set("Origin", test.origin)
+			}
+
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+
+			if rw.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", rw.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPagesWithoutFormsDontCreateSessions(t *testing.T) {
+	router := newTestRouter(t)
+
+	for _, path := range []string{"/page", "/exempt"} {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if cookies := rw.Result().Cookies(); len(cookies) > 0 {
+			t.Errorf("%s set cookies: %v", path, cookies)
+		}
+	}
+}
+
+func TestTokenIsKeptInTheSession(t *testing.T) {
+	router := newTestRouter(t)
+	token, cookie := fetchForm(t, router)
+
+	r := httptest.NewRequest(http.MethodGet, "/form", nil)
+	r.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+
+	if rw.Body.String() != token {
+		t.Errorf("second form got token %q, want %q", rw.Body.String(), token)
+	}
+
+	if cookies := rw.Result().Cookies(); len(cookies) > 0 {
+		t.Errorf("second form set cookies again: %v", cookies)
+	}
+}
@@ -1,8 +1,10 @@
 package current_user
 
 import (
+	"authfish/internal/api_key"
 	"authfish/internal/database"
 	"authfish/internal/user"
+	"authfish/internal/web/key_usage"
 	"authfish/internal/web/session"
 	"context"
 	"fmt"
@@ -14,26 +16,47 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// AuthMethod describes how the current user proved their identity.
+type AuthMethod string
+
+const (
+	AuthMethodSession     AuthMethod = "session"
+	AuthMethodBasicAuth   AuthMethod = "basic"
+	AuthMethodBearerToken AuthMethod = "bearer"
+)
+
+// Where nginx checks requests to protected hosts. Handled by the check
+// package, which depends on this one.
+const checkPath = "/check"
+
+type authMethodContext struct{}
+
+var authMethodContextKey authMethodContext = authMethodContext{}
+
+type apiKeyContext struct{}
+
+var apiKeyContextKey apiKeyContext = apiKeyContext{}
+
 // Try to find the current user based on the session cookie. If any errors are
 // encountered, delete the session, but otherwise do nothing. HTTP handlers
 // are required to check for an authenticated user in the request context.
-func AddCurrentUserToRequestContext(db *sqlx.DB, store sessions.Store, handler http.Handler) http.HandlerFunc {
+func AddCurrentUserToRequestContext(db *sqlx.DB, store sessions.Store, lifetime session.Lifetime, keyUsage *key_usage.Recorder, handler http.Handler) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		userFromSession, err := findUserFromSession(db, store, rw, r)
+		userFromSession, err := findUserFromSession(db, store, lifetime, rw, r)
 		if err == nil && userFromSession != nil {
-			setUserContextAndServe(userFromSession, handler, rw, r)
+			setUserContextAndServe(userFromSession, AuthMethodSession, nil, handler, rw, r)
 			return
 		}
 
-		userFromBasicAuth, err := findUserFromBasicAuth(db, store, rw, r)
+		userFromBasicAuth, apiKey, err := findUserFromBasicAuth(db, keyUsage, rw, r)
 		if err == nil && userFromBasicAuth != nil {
-			setUserContextAndServe(userFromBasicAuth, handler, rw, r)
+			setUserContextAndServe(userFromBasicAuth, AuthMethodBasicAuth, apiKey, handler, rw, r)
 			return
 		}
 
-		userFromBearerToken, err := findUserFromBearerToken(db, store, rw, r)
+		userFromBearerToken, apiKey, err := findUserFromBearerToken(db, keyUsage, rw, r)
 		if err == nil && userFromBearerToken != nil {
-			setUserContextAndServe(userFromBearerToken, handler, rw, r)
+			setUserContextAndServe(userFromBearerToken, AuthMethodBearerToken, apiKey, handler, rw, r)
 			return
 		}
 
@@ -58,38 +81,102 @@ func CurrentUser(context context.Context) (*user.User, error) {
 	return currentUser, nil
 }
 
-func findUserFromSession(db *sqlx.DB, store sessions.Store, rw http.ResponseWriter, r *http.Request) (*user.User, error) {
-	userId, err := session.GetUserIdFromSession(rw, r, store)
+// Returns the method used to authenticate the current user, or an empty
+// AuthMethod if there is no current user.
+func CurrentAuthMethod(context context.Context) AuthMethod {
+	authMethod, _ := context.Value(authMethodContextKey).(AuthMethod)
+	return authMethod
+}
+
+// Returns the API key the current user authenticated with, or nil if they
+// did not use one.
+func CurrentApiKey(context context.Context) *api_key.ApiKey {
+	apiKey, _ := context.Value(apiKeyContextKey).(*api_key.ApiKey)
+	return apiKey
+}
+
+func findUserFromSession(db *sqlx.DB, store sessions.Store, lifetime session.Lifetime, rw http.ResponseWriter, r *http.Request) (*user.User, error) {
+	userId, err := session.GetUserIdFromSession(rw, r, store, lifetime)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return database.FindUserById(db, userId)
+	return activeUser(database.FindUserById(db, userId))
 }
 
-func findUserFromBasicAuth(db *sqlx.DB, store sessions.Store, rw http.ResponseWriter, r *http.Request) (*user.User, error) {
+func findUserFromBasicAuth(db *sqlx.DB, keyUsage *key_usage.Recorder, rw http.ResponseWriter, r *http.Request) (*user.User, *api_key.ApiKey, error) {
 	_, apiKey, ok := r.BasicAuth()
 
 	if !ok {
-		return nil, fmt.Errorf("basic auth credentials not found")
+		return nil, nil, fmt.Errorf("basic auth credentials not found")
 	}
 
-	return database.FindUserByApiKey(db, apiKey)
+	return findUserFromApiKey(db, keyUsage, apiKey, r)
 }
 
-func findUserFromBearerToken(db *sqlx.DB, store sessions.Store, rw http.ResponseWriter, r *http.Request) (*user.User, error) {
+func findUserFromBearerToken(db *sqlx.DB, keyUsage *key_usage.Recorder, rw http.ResponseWriter, r *http.Request) (*user.User, *api_key.ApiKey, error) {
 	reqToken := strings.TrimSpace(r.Header.Get("Authorization"))
 	tokenParts := strings.SplitN(reqToken, "Bearer", 2)
 	if len(tokenParts) != 2 {
-		return nil, fmt.Errorf("bearer token not found")
+		return nil, nil, fmt.Errorf("bearer token not found")
 	}
 	apiKey := strings.TrimSpace(tokenParts[1])
 
-	return database.FindUserByApiKey(db, apiKey)
+	return findUserFromApiKey(db, keyUsage, apiKey, r)
+}
+
+// Expired keys are treated like unknown keys. Keys with host scopes are only
+// meant for the hosts behind /check, so they don't work for the pages of
+// authfish itself, like /me.
+func findUserFromApiKey(db *sqlx.DB, keyUsage *key_usage.Recorder, apiKey string, r *http.Request) (*user.User, *api_key.ApiKey, error) {
+	k, err := database.FindApiKey(db, apiKey)
+
+	if err != nil || k == nil {
+		return nil, nil, err
+	}
+
+	if k.IsExpired() {
+		return nil, nil, fmt.Errorf("api key %s has expired", k.Prefix)
+	}
+
+	if k.IsRestrictedToHosts() && r.URL.Path != checkPath {
+		return nil, nil, fmt.Errorf("api key %s is restricted to hosts, and can only be used for %s", k.Prefix, checkPath)
+	}
+
+	u, err := activeUser(database.FindUserById(db, k.UserId))
+
+	if err != nil || u == nil {
+		return nil, nil, err
+	}
+
+	// Keys of users who can't log in are not being used
+	keyUsage.Record(*k, r)
+
+	return u, k, nil
+}
+
+// Users who are not active, because they are disabled or still waiting for
+// approval, are treated like unknown users.
+func activeUser(u *user.User, err error) (*user.User, error) {
+	if err != nil || u == nil {
+		return nil, err
+	}
+
+	if u.IsDisabled() {
+		return nil, fmt.Errorf("user %s is disabled", u.Username)
+	}
+
+	if !u.IsActive() {
+		return nil, fmt.Errorf("user %s is %s", u.Username, u.Status)
+	}
+
+	return u, nil
 }
 
-func setUserContextAndServe(u *user.User, handler http.Handler, rw http.ResponseWriter, r *http.Request) {
+func setUserContextAndServe(u *user.User, authMethod AuthMethod, apiKey *api_key.ApiKey, handler http.Handler, rw http.ResponseWriter, r *http.Request) {
 	newContext := context.WithValue(r.Context(), user.CurrentUserContextKey, u)
+	newContext = context.WithValue(newContext, authMethodContextKey, authMethod)
+	newContext = context.WithValue(newContext, apiKeyContextKey, apiKey)
 	handler.ServeHTTP(rw, r.WithContext(newContext))
 }
@@ -0,0 +1,474 @@
+package federated_login
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"authfish/internal/database"
+	"authfish/internal/federated"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/login"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	StartPath      = "/login/federated"
+	CallbackPath   = "/login/federated/callback"
+	IdentitiesPath = "/me/federated-identities"
+
+	// Holds the state of a login in progress. It is separate from the session
+	// cookie because that one is SameSite=Strict, and so not sent along when
+	// the provider redirects back to the callback.
+	StateCookieName = "authfishFederated"
+	StateLifetime   = 600 // seconds
+
+	stateKey         = "state"
+	nonceKey         = "nonce"
+	codeVerifierKey  = "codeVerifier"
+	providerKey      = "provider"
+	redirectKey      = "redirect"
+	linkUserIdKey    = "linkUserId"
+	randomValueBytes = 32
+)
+
+var (
+	//go:embed continue.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("continue").Parse(templateString))
+)
+
+type templateVars struct {
+	Message string
+	Target  string
+	Errors  []error
+}
+
+func renderTemplate(rw http.ResponseWriter, status int, vars templateVars) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	parsedTemplate.Execute(rw, vars)
+}
+
+// Lets users log in with an account at an external identity provider, and
+// link such accounts from /me.
+type Service struct {
+	store      sessions.Store
+	stateStore sessions.Store
+	db         *sqlx.DB
+	domains    []string
+	lifetime   session.Lifetime
+	baseUrl    *url.URL
+	secure     bool
+}
+
+func New(store sessions.Store, stateStore sessions.Store, db *sqlx.DB, domains []string, lifetime session.Lifetime, baseUrl *url.URL, secure bool) *Service {
+	return &Service{
+		store:      store,
+		stateStore: stateStore,
+		db:         db,
+		domains:    domains,
+		lifetime:   lifetime,
+		baseUrl:    baseUrl,
+		secure:     secure,
+	}
+}
+
+// Sends the user to the provider to log in. Linked from the login page.
+func (s *Service) Start(rw http.ResponseWriter, r *http.Request) {
+	provider, err := database.FindIdentityProvider(s.db, r.URL.Query().Get("provider"))
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if provider == nil {
+		http.Error(rw, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	redirect := login.SafeRedirect(r.URL.Query().Get("redirect"), r.Host, s.domains)
+
+	s.startAuthorization(rw, r, *provider, redirect, 0)
+}
+
+// Handles the link and unlink buttons in the list of linked accounts on /me.
+func (s *Service) HandleIdentities(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "link":
+		provider, err := database.FindIdentityProvider(s.db, r.FormValue("provider"))
+
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if provider == nil {
+			http.Error(rw, "Unknown provider", http.StatusNotFound)
+			return
+		}
+
+		s.startAuthorization(rw, r, *provider, "/me", currentUser.Id)
+	case "unlink":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		if err != nil {
+			http.Error(rw, "Invalid linked account id", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.checkCanUnlink(*currentUser); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := database.UnlinkFederatedIdentity(s.db, *currentUser, id); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(rw, r, "/me", http.StatusFound)
+	default:
+		http.Error(rw, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// Users created by a provider have no password, so their last linked account
+// is the only way to log in.
+func (s *Service) checkCanUnlink(u user.User) error {
+	if len(u.HashedPassword) > 0 {
+		return nil
+	}
+
+	identities, err := database.ListFederatedIdentitiesForUser(s.db, u)
+
+	if err != nil {
+		return err
+	}
+
+	if len(identities) <= 1 {
+		return fmt.Errorf("this is the only way you can log in, so it can't be unlinked")
+	}
+
+	return nil
+}
+
+// Where the provider sends the user back to, with an authorization code.
+func (s *Service) Callback(rw http.ResponseWriter, r *http.Request) {
+	state, err := s.stateStore.Get(r, StateCookieName)
+
+	if err != nil || state.IsNew {
+		renderTemplate(rw, http.StatusBadRequest, templateVars{
+			Target: "/login",
+			Errors: []error{fmt.Errorf("login expired, please try again")},
+		})
+		return
+	}
+
+	expectedState, _ := state.Values[stateKey].(string)
+	nonce, _ := state.Values[nonceKey].(string)
+	codeVerifier, _ := state.Values[codeVerifierKey].(string)
+	providerName, _ := state.Values[providerKey].(string)
+	redirect, _ := state.Values[redirectKey].(string)
+	linkUserId, _ := state.Values[linkUserIdKey].(int64)
+
+	// The state is only good for one attempt
+	state.Options.MaxAge = -1
+	if err := state.Save(r, rw); err != nil {
+		log.Printf("Error deleting federated login state: %v", err)
+	}
+
+	failureTarget := "/login"
+	if linkUserId != 0 {
+		failureTarget = "/me"
+	}
+
+	query := r.URL.Query()
+
+	if len(expectedState) == 0 || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(expectedState)) != 1 {
+		renderTemplate(rw, http.StatusBadRequest, templateVars{
+			Target: failureTarget,
+			Errors: []error{fmt.Errorf("login expired, please try again")},
+		})
+		return
+	}
+
+	if providerError := query.Get("error"); len(providerError) > 0 {
+		renderTemplate(rw, http.StatusUnauthorized, templateVars{
+			Target: failureTarget,
+			Errors: []error{fmt.Errorf("%s refused the login: %s %s", providerName, providerError, query.Get("error_description"))},
+		})
+		return
+	}
+
+	provider, err := database.FindIdentityProvider(s.db, providerName)
+
+	if err == nil && provider == nil {
+		err = fmt.Errorf("provider %s does not exist", providerName)
+	}
+
+	if err != nil {
+		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+			Target: failureTarget,
+			Errors: []error{err},
+		})
+		return
+	}
+
+	claims, err := provider.FetchClaims(s.callbackUrl(r), query.Get("code"), codeVerifier, nonce)
+
+	if err != nil {
+		log.Printf("Error logging in with %s: %v", provider.Name, err)
+		renderTemplate(rw, http.StatusBadGateway, templateVars{
+			Target: failureTarget,
+			Errors: []error{fmt.Errorf("could not log in with %s: %w", provider.Name, err)},
+		})
+		return
+	}
+
+	subject := claims.String(provider.SubjectClaim)
+	providerUsername := claims.String(provider.UsernameClaim)
+
+	if len(subject) == 0 {
+		renderTemplate(rw, http.StatusBadGateway, templateVars{
+			Target: failureTarget,
+			Errors: []error{fmt.Errorf("%s did not send the %s claim", provider.Name, provider.SubjectClaim)},
+		})
+		return
+	}
+
+	if linkUserId != 0 {
+		s.link(rw, *provider, subject, providerUsername, linkUserId)
+		return
+	}
+
+	s.login(rw, r, *provider, subject, providerUsername, redirect)
+}
+
+func (s *Service) link(rw http.ResponseWriter, provider federated.Provider, subject string, providerUsername string, userId int64) {
+	u, err := database.FindUserById(s.db, userId)
+
+	if err == nil && u == nil {
+		err = fmt.Errorf("user %d does not exist", userId)
+	}
+
+	if err == nil {
+		err = database.LinkFederatedIdentity(s.db, provider, subject, providerUsername, *u)
+	}
+
+	if err != nil {
+		renderTemplate(rw, http.StatusConflict, templateVars{
+			Target: "/me",
+			Errors: []error{err},
+		})
+		return
+	}
+
+	renderTemplate(rw, http.StatusOK, templateVars{
+		Message: fmt.Sprintf("Linked your %s account.", provider.Name),
+		Target:  "/me",
+	})
+}
+
+func (s *Service) login(rw http.ResponseWriter, r *http.Request, provider federated.Provider, subject string, providerUsername string, redirect string) {
+	u, err := s.findOrMapUser(provider, subject, providerUsername)
+
+	if err != nil {
+		renderTemplate(rw, http.StatusUnauthorized, templateVars{
+			Target: "/login",
+			Errors: []error{err},
+		})
+		return
+	}
+
+	if !u.IsActive() {
+		inactiveErr := fmt.Errorf("your account is waiting for approval by an admin")
+		if u.IsDisabled() {
+			inactiveErr = fmt.Errorf("your account has been disabled")
+		}
+
+		renderTemplate(rw, http.StatusForbidden, templateVars{
+			Target: "/login",
+			Errors: []error{inactiveErr},
+		})
+		return
+	}
+
+	totpCredential, err := database.FindTotpCredential(s.db, *u)
+
+	if err != nil {
+		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+			Target: "/login",
+			Errors: []error{fmt.Errorf("error running database query: %w", err)},
+		})
+		return
+	}
+
+	if totpCredential != nil && totpCredential.IsConfirmed() {
+		if err := session.SetPendingSecondFactorSession(rw, r, s.store, s.domains, *u); err != nil {
+			renderTemplate(rw, http.StatusInternalServerError, templateVars{
+				Target: "/login",
+				Errors: []error{fmt.Errorf("could not save user session: %w", err)},
+			})
+			return
+		}
+
+		renderTemplate(rw, http.StatusOK, templateVars{
+			Target: "/login?" + url.Values{"step": {"secondFactor"}, "redirect": {redirect}}.Encode(),
+		})
+		return
+	}
+
+	if err := session.SetUserSession(rw, r, s.store, s.domains, s.lifetime, *u, false); err != nil {
+		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+			Target: "/login",
+			Errors: []error{fmt.Errorf("could not save user session: %w", err)},
+		})
+		return
+	}
+
+	// A redirect would arrive as part of the cross-site navigation from the
+	// provider, without the new SameSite=Strict session cookie. Continuing from
+	// a page of our own makes the browser send it.
+	renderTemplate(rw, http.StatusOK, templateVars{
+		Target: redirect,
+	})
+}
+
+// Returns the user subject is linked to, applying the mapping policy of
+// provider if it is not linked yet.
+func (s *Service) findOrMapUser(provider federated.Provider, subject string, providerUsername string) (*user.User, error) {
+	identity, err := database.FindFederatedIdentity(s.db, provider, subject)
+
+	if err != nil {
+		return nil, fmt.Errorf("error running database query: %w", err)
+	}
+
+	var u *user.User
+
+	if identity != nil {
+		u, err = database.FindUserById(s.db, identity.UserId)
+
+		if err == nil && u == nil {
+			err = fmt.Errorf("user %d does not exist", identity.UserId)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := database.TouchFederatedIdentity(s.db, *identity, providerUsername); err != nil {
+			log.Printf("Error recording login with %s for %s: %v", provider.Name, u.Username, err)
+		}
+
+		return u, nil
+	}
+
+	username := utils.NormalizeUsername(providerUsername)
+
+	switch provider.Mapping {
+	case federated.MappingUsername:
+		if len(username) > 0 {
+			u, err = database.FindUserByUsername(s.db, username)
+		}
+
+		if err == nil && u == nil {
+			err = fmt.Errorf("there is no user matching your %s account", provider.Name)
+		}
+	case federated.MappingCreate:
+		if len(username) == 0 {
+			err = fmt.Errorf("%s did not send the %s claim", provider.Name, provider.UsernameClaim)
+		} else {
+			u, err = database.CreatePendingUser(s.db, username)
+		}
+	default:
+		err = fmt.Errorf("your %s account is not linked to a user. Log in with your password and link it on your account page", provider.Name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.LinkFederatedIdentity(s.db, provider, subject, providerUsername, *u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (s *Service) startAuthorization(rw http.ResponseWriter, r *http.Request, provider federated.Provider, redirect string, linkUserId int64) {
+	randomValues := make([]string, 3)
+	for i := range randomValues {
+		randomValues[i] = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(randomValueBytes))
+	}
+
+	stateValue, nonce, codeVerifier := randomValues[0], randomValues[1], randomValues[2]
+
+	// Ignoring error on purpose, an old state cookie might be invalid
+	state, _ := s.stateStore.Get(r, StateCookieName)
+	state.Values = map[interface{}]interface{}{
+		stateKey:        stateValue,
+		nonceKey:        nonce,
+		codeVerifierKey: codeVerifier,
+		providerKey:     provider.Name,
+		redirectKey:     redirect,
+		linkUserIdKey:   linkUserId,
+	}
+
+	if err := state.Save(r, rw); err != nil {
+		http.Error(rw, fmt.Sprintf("could not save login state: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(challenge[:])
+
+	http.Redirect(rw, r, provider.AuthorizationRequestUrl(s.callbackUrl(r), stateValue, nonce, codeChallenge), http.StatusFound)
+}
+
+// The redirect URI to register with providers. Based on --base-url when it is
+// an absolute URL, and on the request otherwise.
+func (s *Service) callbackUrl(r *http.Request) string {
+	callbackUrl := *s.baseUrl
+	callbackUrl.Path = path.Join(s.baseUrl.Path, CallbackPath)
+	callbackUrl.RawQuery = ""
+
+	if len(callbackUrl.Host) == 0 {
+		callbackUrl.Host = r.Host
+		callbackUrl.Scheme = "http"
+
+		if s.secure {
+			callbackUrl.Scheme = "https"
+		}
+	}
+
+	return callbackUrl.String()
+}
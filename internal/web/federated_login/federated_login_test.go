@@ -0,0 +1,291 @@
+package federated_login
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/federated"
+	"authfish/internal/oidc"
+	"authfish/internal/user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	testClientId = "authfish"
+	testCode     = "code-from-provider"
+	testSubject  = "subject-1"
+	testPassword = "correct horse battery staple"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// A stand-in OpenID Connect provider, which logs everyone in as testSubject
+// with the username alice.
+type testProvider struct {
+	server     *httptest.Server
+	signingKey *oidc.SigningKey
+	nonce      string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	signingKey, err := oidc.LoadOrCreateSigningKey(filepath.Join(t.TempDir(), "signing_key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{signingKey: signingKey}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != testCode {
+			rw.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		idToken, err := p.signingKey.Sign("JWT", oidc.Claims{
+			"iss":                p.server.URL,
+			"aud":                testClientId,
+			"sub":                testSubject,
+			"preferred_username": "alice",
+			"nonce":              p.nonce,
+			"iat":                time.Now().Unix(),
+			"exp":                time.Now().Add(time.Minute).Unix(),
+		})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		json.NewEncoder(rw).Encode(map[string]string{"access_token": "access-token", "id_token": idToken})
+	})
+
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(p.signingKey.Jwks())
+	})
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+type testService struct {
+	*Service
+	db       *sqlx.DB
+	provider *federated.Provider
+	idp      *testProvider
+}
+
+func newTestService(t *testing.T, mapping string) *testService {
+	db := database.OpenTestDB(t)
+
+	idp := newTestProvider(t)
+
+	provider, err := database.CreateIdentityProvider(db, federated.Provider{
+		Name:             "test",
+		Issuer:           idp.server.URL,
+		ClientId:         testClientId,
+		ClientSecret:     "secret",
+		AuthorizationUrl: idp.server.URL + "/authorize",
+		TokenUrl:         idp.server.URL + "/token",
+		JwksUrl:          idp.server.URL + "/jwks",
+		Mapping:          mapping,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseUrl, _ := url.Parse("https://auth.example.com/")
+	lifetime := session.Lifetime{Absolute: time.Hour, Idle: time.Hour}
+	service := New(session.NewSqliteStore(db, testKey), sessions.NewCookieStore(testKey), db, nil, lifetime, baseUrl, true)
+
+	return &testService{Service: service, db: db, provider: provider, idp: idp}
+}
+
+// Starts a login the way the login page does, and returns the state the
+// provider should send back and the state cookie.
+func (s *testService) start(t *testing.T) (string, *http.Cookie) {
+	rw := httptest.NewRecorder()
+	s.Start(rw, httptest.NewRequest(http.MethodGet, StartPath+"?provider=test&redirect=/me", nil))
+
+	location, err := url.Parse(rw.Header().Get("Location"))
+
+	if rw.Code != http.StatusFound || err != nil {
+		t.Fatalf("start returned status %d and location %q", rw.Code, rw.Header().Get("Location"))
+	}
+
+	s.idp.nonce = location.Query().Get("nonce")
+
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == StateCookieName {
+			return location.Query().Get("state"), cookie
+		}
+	}
+
+	t.Fatal("start did not set the state cookie")
+	return "", nil
+}
+
+// Returns the response to the provider sending the user back with state,
+// and whether the user got a session.
+func (s *testService) callback(stateCookie *http.Cookie, state string) (*httptest.ResponseRecorder, bool) {
+	query := url.Values{"code": {testCode}, "state": {state}}
+	r := httptest.NewRequest(http.MethodGet, CallbackPath+"?"+query.Encode(), nil)
+
+	if stateCookie != nil {
+		r.AddCookie(stateCookie)
+	}
+
+	rw := httptest.NewRecorder()
+	s.Callback(rw, r)
+
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == session.SessionName && len(cookie.Value) > 0 {
+			return rw, true
+		}
+	}
+
+	return rw, false
+}
+
+func TestCallbackState(t *testing.T) {
+	tests := []struct {
+		name        string
+		state       string // Empty sends the state from the login
+		stateCookie bool
+	}{
+		{name: "state mismatch", state: "state-of-another-login", stateCookie: true},
+		{name: "no state cookie", stateCookie: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t, federated.MappingUsername)
+			database.CreateTestUser(t, s.db, "alice", testPassword)
+			state, stateCookie := s.start(t)
+
+			if len(test.state) > 0 {
+				state = test.state
+			}
+
+			if !test.stateCookie {
+				stateCookie = nil
+			}
+
+			rw, loggedIn := s.callback(stateCookie, state)
+
+			if rw.Code != http.StatusBadRequest || loggedIn {
+				t.Errorf("got status %d and logged in %v, want %d without a session", rw.Code, loggedIn, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestCallbackMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping string
+		// Runs before the login, with the provider of the service
+		setup       func(t *testing.T, s *testService)
+		wantStatus  int
+		wantSession bool
+		// Status of the user alice after the login, empty if there should be
+		// none
+		wantUserStatus string
+	}{
+		{
+			name:       "link refuses unlinked identities",
+			mapping:    federated.MappingLink,
+			setup:      func(t *testing.T, s *testService) { database.CreateTestUser(t, s.db, "alice", testPassword) },
+			wantStatus: http.StatusUnauthorized,
+			// The user exists, but the identity is not linked to it
+			wantUserStatus: user.StatusActive,
+		},
+		{
+			name:    "link logs in linked identities",
+			mapping: federated.MappingLink,
+			setup: func(t *testing.T, s *testService) {
+				u := database.CreateTestUser(t, s.db, "bob", testPassword)
+
+				if err := database.LinkFederatedIdentity(s.db, *s.provider, testSubject, "alice", *u); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus:  http.StatusOK,
+			wantSession: true,
+		},
+		{
+			name:           "username logs in the user with the same name",
+			mapping:        federated.MappingUsername,
+			setup:          func(t *testing.T, s *testService) { database.CreateTestUser(t, s.db, "alice", testPassword) },
+			wantStatus:     http.StatusOK,
+			wantSession:    true,
+			wantUserStatus: user.StatusActive,
+		},
+		{
+			name:       "username refuses unknown usernames",
+			mapping:    federated.MappingUsername,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "create adds a user waiting for approval",
+			mapping:        federated.MappingCreate,
+			wantStatus:     http.StatusForbidden,
+			wantUserStatus: user.StatusPending,
+		},
+		{
+			name:           "create does not take over existing users",
+			mapping:        federated.MappingCreate,
+			setup:          func(t *testing.T, s *testService) { database.CreateTestUser(t, s.db, "alice", testPassword) },
+			wantStatus:     http.StatusUnauthorized,
+			wantUserStatus: user.StatusActive,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t, test.mapping)
+
+			if test.setup != nil {
+				test.setup(t, s)
+			}
+
+			state, stateCookie := s.start(t)
+			rw, loggedIn := s.callback(stateCookie, state)
+
+			if rw.Code != test.wantStatus || loggedIn != test.wantSession {
+				t.Errorf("got status %d and logged in %v, want %d and %v", rw.Code, loggedIn, test.wantStatus, test.wantSession)
+			}
+
+			u, err := database.FindUserByUsername(s.db, "alice")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(test.wantUserStatus) == 0 {
+				if u != nil {
+					t.Errorf("user alice was created")
+				}
+
+				return
+			}
+
+			if u == nil || u.Status != test.wantUserStatus {
+				t.Errorf("user alice is %v, want status %s", u, test.wantUserStatus)
+			}
+		})
+	}
+}
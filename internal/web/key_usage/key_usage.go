@@ -0,0 +1,74 @@
+package key_usage
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"authfish/internal/api_key"
+	"authfish/internal/database"
+	"authfish/internal/web/client_ip"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type usage struct {
+	count    int64
+	lastSeen time.Time
+	lastIp   string
+}
+
+// Collects API key usage in memory and writes it to the database in the
+// background, so that requests authenticated with an API key don't wait on a
+// database write. Usage since the last flush is lost if the server stops.
+type Recorder struct {
+	db                 *sqlx.DB
+	trustedProxyHeader string
+
+	mu      sync.Mutex
+	pending map[int64]usage
+}
+
+// Creates a Recorder which flushes every interval until the process exits.
+func New(db *sqlx.DB, trustedProxyHeader string, interval time.Duration) *Recorder {
+	recorder := &Recorder{
+		db:                 db,
+		trustedProxyHeader: trustedProxyHeader,
+		pending:            map[int64]usage{},
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			recorder.Flush()
+		}
+	}()
+
+	return recorder
+}
+
+func (rec *Recorder) Record(apiKey api_key.ApiKey, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	u := rec.pending[apiKey.Id]
+	u.count++
+	u.lastSeen = time.Now()
+	u.lastIp = client_ip.ClientIp(r, rec.trustedProxyHeader)
+	rec.pending[apiKey.Id] = u
+}
+
+func (rec *Recorder) Flush() {
+	rec.mu.Lock()
+	pending := rec.pending
+	rec.pending = map[int64]usage{}
+	rec.mu.Unlock()
+
+	for id, u := range pending {
+		err := database.RecordApiKeyUsage(rec.db, id, u.count, u.lastSeen, u.lastIp)
+
+		if err != nil {
+			log.Printf("Error recording usage of api key %d: %v", id, err)
+		}
+	}
+}
@@ -4,18 +4,25 @@ import (
 	_ "embed"
 	"fmt"
 	"html/template"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 
+	"authfish/internal/authenticator"
 	"authfish/internal/database"
-	"authfish/internal/user"
+	"authfish/internal/lockout"
 	"authfish/internal/utils"
+	"authfish/internal/web/client_ip"
+	"authfish/internal/web/csrf"
 	"authfish/internal/web/current_user"
 	"authfish/internal/web/session"
+	"authfish/internal/web/two_factor"
 
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -25,29 +32,78 @@ var (
 )
 
 type templateVars struct {
-	Username  string
-	Password  string
-	Redirect  string
-	Loginpath string
-	Errors    []error
+	Username     string
+	Password     string
+	Redirect     string
+	Loginpath    string
+	Remember     bool
+	SecondFactor bool
+	Providers    []providerLink
+	Errors       []error
+	CsrfToken    string
 }
 
-func renderTemplate(rw http.ResponseWriter, status int, vars templateVars) {
+// A "Sign in with" link to an external identity provider.
+type providerLink struct {
+	Name string
+	Url  string
+}
+
+func (s *Service) renderTemplate(rw http.ResponseWriter, r *http.Request, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
+
+	if !vars.SecondFactor {
+		vars.Providers = s.providerLinks(vars.Redirect)
+	}
+
 	rw.WriteHeader(status)
 	parsedTemplate.Execute(rw, vars)
 }
 
+// Links always go to --base-url, since the state of the login is kept in a
+// cookie for the host the provider sends the user back to.
+func (s *Service) providerLinks(redirect string) []providerLink {
+	providers, err := database.ListIdentityProviders(s.db)
+
+	if err != nil {
+		log.Printf("Error listing identity providers: %v", err)
+		return nil
+	}
+
+	links := make([]providerLink, 0, len(providers))
+
+	for _, provider := range providers {
+		startUrl := *s.baseUrl
+		startUrl.Path = path.Join(s.baseUrl.Path, "login/federated")
+		startUrl.RawQuery = url.Values{"provider": {provider.Name}, "redirect": {redirect}}.Encode()
+
+		links = append(links, providerLink{Name: provider.Name, Url: startUrl.String()})
+	}
+
+	return links
+}
+
 type Service struct {
-	store   sessions.Store
-	db      *sqlx.DB
-	domains []string
+	store    sessions.Store
+	db       *sqlx.DB
+	domains  []string
+	lifetime session.Lifetime
+	baseUrl  *url.URL
+
+	authenticator      authenticator.Authenticator
+	trustedProxyHeader string
 }
 
-func New(store sessions.Store, db *sqlx.DB, domains []string) *Service {
+func New(store sessions.Store, db *sqlx.DB, domains []string, lifetime session.Lifetime, trustedProxyHeader string, baseUrl *url.URL, authenticator authenticator.Authenticator) *Service {
 	return &Service{
-		store:   store,
-		db:      db,
-		domains: domains,
+		store:    store,
+		db:       db,
+		domains:  domains,
+		lifetime: lifetime,
+		baseUrl:  baseUrl,
+
+		authenticator:      authenticator,
+		trustedProxyHeader: trustedProxyHeader,
 	}
 }
 
@@ -56,15 +112,19 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	originalUrl := r.Header.Get("X-Original-URL")
 
+	// Pages of authfish itself which need a login, like the OpenID Connect
+	// authorization endpoint, pass where to go back to in the query instead.
+	if len(originalUrl) == 0 {
+		originalUrl = r.URL.Query().Get("redirect")
+	}
+
 	parsedURL, err := url.ParseRequestURI(originalUrl)
 
 	if err == nil && parsedURL.RequestURI() == r.URL.RequestURI() {
-		originalUrl = "/"
+		originalUrl = defaultRedirect
 	}
 
-	if len(originalUrl) == 0 {
-		originalUrl = "/"
-	}
+	originalUrl = SafeRedirect(originalUrl, r.Host, s.domains)
 
 	loginpath := r.Header.Get("X-Authfish-Login-Path")
 	if len(loginpath) == 0 {
@@ -77,9 +137,14 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodGet {
-		renderTemplate(rw, http.StatusOK, templateVars{
-			Redirect:  originalUrl,
-			Loginpath: loginpath,
+		// Logins with an external identity provider continue here when the
+		// user has two-factor authentication enabled.
+		_, pendingErr := session.GetPendingSecondFactorUserId(rw, r, s.store)
+
+		s.renderTemplate(rw, r, http.StatusOK, templateVars{
+			Redirect:     originalUrl,
+			Loginpath:    loginpath,
+			SecondFactor: r.URL.Query().Get("step") == "secondFactor" && pendingErr == nil,
 		})
 		return
 	}
@@ -90,53 +155,254 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.FormValue("step") == "secondFactor" {
+		s.handleSecondFactor(rw, r)
+		return
+	}
+
 	username := utils.NormalizeUsername(r.FormValue("username"))
 	password := r.FormValue("password")
-	redirect := r.FormValue("redirect")
+	redirect := SafeRedirect(r.FormValue("redirect"), r.Host, s.domains)
 	loginpath = r.FormValue("loginpath")
+	remember := r.FormValue("remember") == "on"
+	ip := client_ip.ClientIp(r, s.trustedProxyHeader)
+
+	activeLockout, err := authenticator.FindActiveLockout(s.db, username, ip)
 
-	currentUser, err = checkLogin(s.db, username, password)
+	if err != nil {
+		s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			Username:  username,
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{fmt.Errorf("error running database query: %w", err)},
+		})
+		return
+	}
+
+	if activeLockout != nil {
+		retryAfter := int(math.Ceil(activeLockout.Remaining().Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+		s.renderTemplate(rw, r, http.StatusTooManyRequests, templateVars{
+			Username:  username,
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{activeLockout},
+		})
+		return
+	}
+
+	currentUser, err = s.authenticator.Authenticate(username, password)
 
 	if err != nil {
-		renderTemplate(rw, http.StatusUnauthorized, templateVars{
+		errs := []error{err}
+
+		if newLockout := authenticator.RecordFailure(s.db, username, ip); newLockout != nil {
+			errs = append(errs, newLockout)
+		}
+
+		s.renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
 			Username:  username,
 			Password:  password,
 			Redirect:  redirect,
 			Loginpath: loginpath,
-			Errors:    []error{err},
+			Remember:  remember,
+			Errors:    errs,
 		})
 		return
 	}
 
-	if err := session.SetUserSession(rw, r, s.store, s.domains, *currentUser); err != nil {
-		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+	if !currentUser.IsActive() {
+		inactiveErr := fmt.Errorf("your account is waiting for approval by an admin")
+		if currentUser.IsDisabled() {
+			inactiveErr = fmt.Errorf("your account has been disabled")
+		}
+
+		s.renderTemplate(rw, r, http.StatusForbidden, templateVars{
+			Username:  username,
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{inactiveErr},
+		})
+		return
+	}
+
+	totpCredential, err := database.FindTotpCredential(s.db, *currentUser)
+
+	if err != nil {
+		s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			Username:  username,
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{fmt.Errorf("error running database query: %w", err)},
+		})
+		return
+	}
+
+	if totpCredential != nil && totpCredential.IsConfirmed() {
+		if err := session.SetPendingSecondFactorSession(rw, r, s.store, s.domains, *currentUser); err != nil {
+			s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+				Username:  username,
+				Redirect:  redirect,
+				Loginpath: loginpath,
+				Remember:  remember,
+				Errors:    []error{fmt.Errorf("could not save user session: %w", err)},
+			})
+			return
+		}
+
+		s.renderTemplate(rw, r, http.StatusOK, templateVars{
+			Redirect:     redirect,
+			Loginpath:    loginpath,
+			Remember:     remember,
+			SecondFactor: true,
+		})
+		return
+	}
+
+	if err := session.SetUserSession(rw, r, s.store, s.domains, s.lifetime, *currentUser, remember); err != nil {
+		s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
 			Username:  username,
 			Password:  password,
 			Redirect:  redirect,
 			Loginpath: loginpath,
+			Remember:  remember,
 			Errors:    []error{fmt.Errorf("could not save user session: %w", err)},
 		})
 		return
 	}
 
+	s.clearLockout(username)
+
 	http.Redirect(rw, r, redirect, http.StatusFound)
 }
 
-func checkLogin(db *sqlx.DB, username string, password string) (*user.User, error) {
-	u, err := database.FindUserByUsername(db, username)
+// Second step of the login form, for users with two-factor authentication
+// enabled. The pending session proves the password was already checked.
+// Wrong codes count towards the same lockouts as wrong passwords, since the
+// password alone must not allow unlimited guesses.
+func (s *Service) handleSecondFactor(rw http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	redirect := SafeRedirect(r.FormValue("redirect"), r.Host, s.domains)
+	loginpath := r.FormValue("loginpath")
+	remember := r.FormValue("remember") == "on"
+	ip := client_ip.ClientIp(r, s.trustedProxyHeader)
+
+	userId, err := session.GetPendingSecondFactorUserId(rw, r, s.store)
 
 	if err != nil {
-		return nil, fmt.Errorf("error running database query: %w", err)
+		session.DeleteSession(rw, r, s.store)
+		s.renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{fmt.Errorf("login expired, please log in again")},
+		})
+		return
 	}
 
-	if u == nil {
-		return nil, fmt.Errorf("username not registered: %s", username)
+	currentUser, err := database.FindUserById(s.db, userId)
+
+	if err == nil && currentUser == nil {
+		err = fmt.Errorf("user %d does not exist", userId)
 	}
 
-	err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password))
 	if err != nil {
-		return nil, fmt.Errorf("invalid password for %s", username)
+		session.DeleteSession(rw, r, s.store)
+		s.renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{err},
+		})
+		return
 	}
 
-	return u, nil
+	activeLockout, err := authenticator.FindActiveLockout(s.db, currentUser.Username, ip)
+
+	if err != nil {
+		s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			Redirect:     redirect,
+			Loginpath:    loginpath,
+			Remember:     remember,
+			SecondFactor: true,
+			Errors:       []error{fmt.Errorf("error running database query: %w", err)},
+		})
+		return
+	}
+
+	if activeLockout != nil {
+		retryAfter := int(math.Ceil(activeLockout.Remaining().Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		session.DeleteSession(rw, r, s.store)
+
+		s.renderTemplate(rw, r, http.StatusTooManyRequests, templateVars{
+			Redirect:  redirect,
+			Loginpath: loginpath,
+			Remember:  remember,
+			Errors:    []error{activeLockout},
+		})
+		return
+	}
+
+	if err := two_factor.Verify(s.db, *currentUser, code); err != nil {
+		errs := []error{err}
+		attemptsRemaining, _ := session.RecordFailedSecondFactorAttempt(rw, r, s.store)
+		newLockout := authenticator.RecordFailure(s.db, currentUser.Username, ip)
+
+		if newLockout != nil {
+			errs = append(errs, newLockout)
+		}
+
+		if attemptsRemaining <= 0 || newLockout != nil {
+			if newLockout == nil {
+				errs = append(errs, fmt.Errorf("too many attempts, please log in again"))
+			}
+
+			session.DeleteSession(rw, r, s.store)
+			s.renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+				Redirect:  redirect,
+				Loginpath: loginpath,
+				Remember:  remember,
+				Errors:    errs,
+			})
+			return
+		}
+
+		s.renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			Redirect:     redirect,
+			Loginpath:    loginpath,
+			Remember:     remember,
+			SecondFactor: true,
+			Errors:       []error{err},
+		})
+		return
+	}
+
+	if err := session.SetUserSession(rw, r, s.store, s.domains, s.lifetime, *currentUser, remember); err != nil {
+		s.renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			Redirect:     redirect,
+			Loginpath:    loginpath,
+			Remember:     remember,
+			SecondFactor: true,
+			Errors:       []error{fmt.Errorf("could not save user session: %w", err)},
+		})
+		return
+	}
+
+	s.clearLockout(currentUser.Username)
+
+	http.Redirect(rw, r, redirect, http.StatusFound)
+}
+
+// Forgets the failed logins of username once a login has fully succeeded.
+// Failures of the client IP are kept, since they may be for other usernames.
+func (s *Service) clearLockout(username string) {
+	if err := database.ClearLockout(s.db, lockout.KindUsername, username); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", username, err)
+	}
 }
@@ -0,0 +1,82 @@
+package login
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"authfish/internal/web/session"
+)
+
+// Where to go after logging in when no redirect was given, or the redirect
+// was not safe.
+const defaultRedirect = "/"
+
+// Returns target if it is safe to send the user there after logging in, and
+// defaultRedirect otherwise. Safe targets are absolute paths, and http(s) URLs
+// for loginHost or a host covered by one of domains. Anything a browser might
+// interpret differently than url.Parse does is rejected outright.
+func SafeRedirect(target string, loginHost string, domains []string) string {
+	if len(target) == 0 || strings.ContainsAny(target, "\\") || containsControlOrSpace(target) {
+		return defaultRedirect
+	}
+
+	parsedUrl, err := url.Parse(target)
+
+	if err != nil || parsedUrl.User != nil || len(parsedUrl.Opaque) > 0 {
+		return defaultRedirect
+	}
+
+	// A plain path on the current host. Scheme-relative URLs like
+	// //evil.example have a host, so they are checked below.
+	if len(parsedUrl.Scheme) == 0 && len(parsedUrl.Host) == 0 {
+		if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+			return target
+		}
+
+		return defaultRedirect
+	}
+
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return defaultRedirect
+	}
+
+	host := strings.ToLower(parsedUrl.Hostname())
+
+	// Percent encoded hosts are decoded differently by different browsers
+	if len(host) == 0 || strings.Contains(parsedUrl.Host, "%") {
+		return defaultRedirect
+	}
+
+	if host == hostname(loginHost) {
+		return target
+	}
+
+	for _, domain := range domains {
+		if session.DomainMatches(host, domain) {
+			return target
+		}
+	}
+
+	return defaultRedirect
+}
+
+func hostname(hostAndPort string) string {
+	host, _, err := net.SplitHostPort(hostAndPort)
+
+	if err != nil {
+		host = hostAndPort
+	}
+
+	return strings.ToLower(host)
+}
+
+func containsControlOrSpace(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c == 0x7f {
+			return true
+		}
+	}
+
+	return false
+}
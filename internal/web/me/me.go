@@ -3,9 +3,15 @@ package me
 import (
 	"authfish/internal/api_key"
 	"authfish/internal/database"
+	"authfish/internal/federated"
+	"authfish/internal/group"
 	"authfish/internal/user"
+	"authfish/internal/user_session"
+	"authfish/internal/web/api_keys"
+	"authfish/internal/web/csrf"
 	"authfish/internal/web/current_user"
 	"authfish/internal/web/session"
+	"authfish/internal/webauthn"
 
 	_ "embed"
 	"html/template"
@@ -22,11 +28,25 @@ var (
 )
 
 type templateVars struct {
-	User    *user.User
-	ApiKeys []api_key.ApiKey
+	User             *user.User
+	Groups           []group.Group
+	ApiKeys          []api_key.ApiKey
+	Passkeys         []webauthn.Credential
+	TwoFactorEnabled bool
+	Sessions         []sessionVars
+	Identities       []federated.Identity
+	Providers        []federated.Provider
+	NewApiKey        string
+	CsrfToken        string
 }
 
-func renderTemplate(rw http.ResponseWriter, status int, vars templateVars) {
+type sessionVars struct {
+	user_session.UserSession
+	Current bool
+}
+
+func renderTemplate(rw http.ResponseWriter, r *http.Request, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
 	rw.WriteHeader(status)
 	parsedTemplate.Execute(rw, vars)
 }
@@ -51,10 +71,35 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	groups, _ := database.ListGroupsForUser(s.db, *currentUser)
 	apiKeys, _ := database.ListApiKeys(s.db, *currentUser)
+	passkeys, _ := database.ListWebauthnCredentials(s.db, *currentUser)
+	totpCredential, _ := database.FindTotpCredential(s.db, *currentUser)
+	userSessions, _ := database.ListUserSessionsForUser(s.db, *currentUser)
+	identities, _ := database.ListFederatedIdentitiesForUser(s.db, *currentUser)
+	providers, _ := database.ListIdentityProviders(s.db)
+
+	currentTokenHash := session.CurrentTokenHash(r, s.store)
+	activeSessions := make([]sessionVars, 0, len(userSessions))
+	for _, userSession := range userSessions {
+		activeSessions = append(activeSessions, sessionVars{
+			UserSession: userSession,
+			Current:     userSession.TokenHash == currentTokenHash,
+		})
+	}
+
+	// Shown only once, right after it was created
+	newApiKey, _ := session.PopFlash(rw, r, s.store, api_keys.NewApiKeyFlashKey)
 
-	renderTemplate(rw, http.StatusOK, templateVars{
-		User:    currentUser,
-		ApiKeys: apiKeys,
+	renderTemplate(rw, r, http.StatusOK, templateVars{
+		User:             currentUser,
+		Groups:           groups,
+		ApiKeys:          apiKeys,
+		Passkeys:         passkeys,
+		TwoFactorEnabled: totpCredential != nil && totpCredential.IsConfirmed(),
+		Sessions:         activeSessions,
+		Identities:       identities,
+		Providers:        providers,
+		NewApiKey:        newApiKey,
 	})
 }
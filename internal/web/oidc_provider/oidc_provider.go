@@ -0,0 +1,420 @@
+package oidc_provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/oidc"
+	"authfish/internal/user"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/same_site"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+// Paths of the endpoints, relative to the issuer.
+const (
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	JwksPath          = "/oidc/jwks"
+	AuthorizationPath = "/oidc/authorize"
+	TokenPath         = "/oidc/token"
+	UserinfoPath      = "/oidc/userinfo"
+)
+
+// Lets apps which speak OpenID Connect log users in with authfish, using the
+// authorization code flow.
+type Service struct {
+	store      sessions.Store
+	db         *sqlx.DB
+	issuer     string
+	signingKey *oidc.SigningKey
+}
+
+func New(store sessions.Store, db *sqlx.DB, issuer string, signingKey *oidc.SigningKey) *Service {
+	return &Service{
+		store:      store,
+		db:         db,
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		signingKey: signingKey,
+	}
+}
+
+func (s *Service) Discovery(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + AuthorizationPath,
+		"token_endpoint":                        s.issuer + TokenPath,
+		"userinfo_endpoint":                     s.issuer + UserinfoPath,
+		"jwks_uri":                              s.issuer + JwksPath,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      oidc.SupportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{oidc.CodeChallengeMethodS256},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "name", "groups"},
+	})
+}
+
+func (s *Service) Jwks(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, s.signingKey.Jwks())
+}
+
+// Sends users who are not logged in to the login page, and then back to the
+// client with an authorization code. Errors are only sent back to the client
+// once its redirect URI is known to be registered.
+func (s *Service) Authorize(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	client, err := database.FindOidcClient(s.db, query.Get("client_id"))
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if client == nil {
+		http.Error(rw, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+
+	redirectUri := query.Get("redirect_uri")
+
+	if !client.AllowsRedirectUri(redirectUri) {
+		http.Error(rw, "redirect_uri is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	state := query.Get("state")
+
+	if query.Get("response_type") != "code" {
+		redirectWithError(rw, r, redirectUri, state, "unsupported_response_type", "only the code response type is supported")
+		return
+	}
+
+	scope, ok := supportedScope(query.Get("scope"))
+
+	if !ok {
+		redirectWithError(rw, r, redirectUri, state, "invalid_scope", "the openid scope is required")
+		return
+	}
+
+	codeChallenge := query.Get("code_challenge")
+	codeChallengeMethod := query.Get("code_challenge_method")
+
+	if len(codeChallenge) > 0 && len(codeChallengeMethod) == 0 {
+		codeChallengeMethod = oidc.CodeChallengeMethodPlain
+	}
+
+	if len(codeChallenge) > 0 && codeChallengeMethod != oidc.CodeChallengeMethodS256 && codeChallengeMethod != oidc.CodeChallengeMethodPlain {
+		redirectWithError(rw, r, redirectUri, state, "invalid_request", "unsupported code_challenge_method")
+		return
+	}
+
+	// Anyone can redeem the codes of public clients, so a challenge which can
+	// be read off the authorization request is no protection. Confidential
+	// clients may still use plain, the default of RFC 7636.
+	if client.IsPublic() && (len(codeChallenge) == 0 || codeChallengeMethod != oidc.CodeChallengeMethodS256) {
+		redirectWithError(rw, r, redirectUri, state, "invalid_request", "public clients must use PKCE with S256")
+		return
+	}
+
+	currentUser, _ := current_user.CurrentUser(r.Context())
+
+	if currentUser == nil || current_user.CurrentAuthMethod(r.Context()) != current_user.AuthMethodSession {
+		if same_site.NeedsContinue(r) {
+			same_site.Continue(rw, AuthorizationPath, query)
+			return
+		}
+
+		if query.Get("prompt") == "none" {
+			redirectWithError(rw, r, redirectUri, state, "login_required", "the user is not logged in")
+			return
+		}
+
+		http.Redirect(rw, r, "/login?"+url.Values{"redirect": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+		return
+	}
+
+	authTime, err := session.GetAuthenticatedAt(r, s.store)
+
+	if err != nil {
+		log.Printf("Error reading login time for OpenID Connect: %v", err)
+		authTime = time.Now()
+	}
+
+	code, err := database.CreateOidcAuthorizationCode(s.db, oidc.AuthorizationCode{
+		ClientId:            client.ClientId,
+		UserId:              currentUser.Id,
+		RedirectUri:         redirectUri,
+		Scope:               scope,
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+		AuthTime:            authTime.UTC(),
+		ExpiresAt:           time.Now().Add(oidc.AuthorizationCodeLifetime).UTC(),
+	})
+
+	if err != nil {
+		redirectWithError(rw, r, redirectUri, state, "server_error", "could not create authorization code")
+		return
+	}
+
+	redirectWithParams(rw, r, redirectUri, url.Values{"code": {code}, "state": {state}})
+}
+
+// Exchanges an authorization code for an ID token and an access token.
+func (s *Service) Token(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.FormValue("grant_type") != "authorization_code" {
+		writeError(rw, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant type is supported")
+		return
+	}
+
+	client, err := s.authenticateClient(r)
+
+	if err != nil {
+		writeError(rw, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+
+	code, err := database.ConsumeOidcAuthorizationCode(s.db, r.FormValue("code"), client.ClientId)
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "server_error", "error querying database")
+		return
+	}
+
+	if code == nil || code.IsExpired() || code.RedirectUri != r.FormValue("redirect_uri") {
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "authorization code is invalid or has expired")
+		return
+	}
+
+	if !code.VerifyCodeVerifier(r.FormValue("code_verifier")) {
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+
+	u, err := database.FindUserById(s.db, code.UserId)
+
+	if err != nil || u == nil || !u.IsActive() {
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "user can not log in")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(oidc.TokenLifetime)
+
+	idTokenClaims := s.userClaims(*u, code.Scope)
+	idTokenClaims["iss"] = s.issuer
+	idTokenClaims["aud"] = client.ClientId
+	idTokenClaims["iat"] = now.Unix()
+	idTokenClaims["exp"] = expiresAt.Unix()
+	idTokenClaims["auth_time"] = code.AuthTime.Unix()
+
+	if len(code.Nonce) > 0 {
+		idTokenClaims["nonce"] = code.Nonce
+	}
+
+	idToken, err := s.signingKey.Sign("JWT", idTokenClaims)
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "server_error", "could not sign id token")
+		return
+	}
+
+	accessToken, err := s.signingKey.Sign(oidc.AccessTokenType, oidc.Claims{
+		"iss":       s.issuer,
+		"sub":       strconv.FormatInt(u.Id, 10),
+		"aud":       s.issuer + UserinfoPath,
+		"client_id": client.ClientId,
+		"scope":     code.Scope,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+	})
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "server_error", "could not sign access token")
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidc.TokenLifetime.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+}
+
+// Returns the claims about the user an access token was issued for.
+func (s *Service) Userinfo(rw http.ResponseWriter, r *http.Request) {
+	tokenParts := strings.SplitN(strings.TrimSpace(r.Header.Get("Authorization")), " ", 2)
+
+	if len(tokenParts) != 2 || !strings.EqualFold(tokenParts[0], "Bearer") {
+		rw.Header().Set("WWW-Authenticate", `Bearer`)
+		writeError(rw, http.StatusUnauthorized, "invalid_token", "access token is missing")
+		return
+	}
+
+	claims, err := s.signingKey.Verify(strings.TrimSpace(tokenParts[1]), oidc.AccessTokenType)
+
+	if err == nil && claims["iss"] != s.issuer {
+		err = fmt.Errorf("token was not issued by authfish")
+	}
+
+	if err != nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(rw, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+
+	sub, _ := claims["sub"].(string)
+	userId, _ := strconv.ParseInt(sub, 10, 64)
+	u, err := database.FindUserById(s.db, userId)
+
+	if err != nil || u == nil || !u.IsActive() {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(rw, http.StatusUnauthorized, "invalid_token", "user can not log in")
+		return
+	}
+
+	scope, _ := claims["scope"].(string)
+
+	writeJSON(rw, http.StatusOK, s.userClaims(*u, scope))
+}
+
+// Client credentials may be sent with HTTP basic auth or in the form.
+func (s *Service) authenticateClient(r *http.Request) (*oidc.Client, error) {
+	clientId, clientSecret, ok := r.BasicAuth()
+
+	if ok {
+		// Basic auth credentials are form encoded first (RFC 6749 2.3.1)
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId = r.FormValue("client_id")
+		clientSecret = r.FormValue("client_secret")
+	}
+
+	client, err := database.FindOidcClient(s.db, clientId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database")
+	}
+
+	if client == nil {
+		return nil, fmt.Errorf("unknown client")
+	}
+
+	if !client.IsPublic() && !client.SecretMatches(clientSecret) {
+		return nil, fmt.Errorf("invalid client secret")
+	}
+
+	return client, nil
+}
+
+// Claims about u which the space separated scopes allow.
+func (s *Service) userClaims(u user.User, scopes string) oidc.Claims {
+	claims := oidc.Claims{"sub": strconv.FormatInt(u.Id, 10)}
+
+	if oidc.HasScope(scopes, "profile") {
+		claims["preferred_username"] = u.Username
+		claims["name"] = u.Username
+	}
+
+	if oidc.HasScope(scopes, "groups") {
+		groupNames := []string{}
+		groups, err := database.ListGroupsForUser(s.db, u)
+
+		if err != nil {
+			log.Printf("Error listing groups of %s for OpenID Connect: %v", u.Username, err)
+		}
+
+		for _, g := range groups {
+			groupNames = append(groupNames, g.Name)
+		}
+
+		claims["groups"] = groupNames
+	}
+
+	return claims
+}
+
+// Drops scopes authfish does not know about. Returns false if the openid scope
+// is missing.
+func supportedScope(requested string) (string, bool) {
+	scopes := []string{}
+	hasOpenid := false
+
+	for _, scope := range strings.Fields(requested) {
+		for _, supported := range oidc.SupportedScopes {
+			if scope == supported {
+				scopes = append(scopes, scope)
+			}
+		}
+
+		if scope == "openid" {
+			hasOpenid = true
+		}
+	}
+
+	return strings.Join(scopes, " "), hasOpenid
+}
+
+func redirectWithError(rw http.ResponseWriter, r *http.Request, redirectUri string, state string, code string, description string) {
+	redirectWithParams(rw, r, redirectUri, url.Values{
+		"error":             {code},
+		"error_description": {description},
+		"state":             {state},
+	})
+}
+
+func redirectWithParams(rw http.ResponseWriter, r *http.Request, redirectUri string, params url.Values) {
+	target, err := url.Parse(redirectUri)
+
+	if err != nil {
+		http.Error(rw, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+
+	for key, values := range params {
+		if len(values) > 0 && len(values[0]) > 0 {
+			query.Set(key, values[0])
+		}
+	}
+
+	target.RawQuery = query.Encode()
+
+	http.Redirect(rw, r, target.String(), http.StatusFound)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+func writeError(rw http.ResponseWriter, status int, code string, description string) {
+	writeJSON(rw, status, map[string]interface{}{"error": code, "error_description": description})
+}
@@ -0,0 +1,199 @@
+package oidc_provider
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/oidc"
+	"authfish/internal/web/session"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	testRedirectUri = "https://app.example.com/callback"
+	testVerifier    = "verifier-of-the-app-which-is-long-enough-for-pkce"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestService(t *testing.T) (*Service, *sqlx.DB) {
+	db := database.OpenTestDB(t)
+
+	signingKey, err := oidc.LoadOrCreateSigningKey(filepath.Join(t.TempDir(), "signing_key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(session.NewSqliteStore(db, testKey), db, "https://auth.example.com", signingKey), db
+}
+
+func createTestClient(t *testing.T, db *sqlx.DB, name string, public bool) *oidc.Client {
+	client, err := database.CreateOidcClient(db, name, []string{testRedirectUri}, public)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestAuthorizePkce(t *testing.T) {
+	tests := []struct {
+		name                string
+		public              bool
+		codeChallenge       string
+		codeChallengeMethod string
+		wantErr             bool
+	}{
+		{name: "public with S256", public: true, codeChallenge: s256(testVerifier), codeChallengeMethod: oidc.CodeChallengeMethodS256},
+		{name: "public without PKCE", public: true, wantErr: true},
+		{name: "public with plain", public: true, codeChallenge: testVerifier, codeChallengeMethod: oidc.CodeChallengeMethodPlain, wantErr: true},
+		{name: "public without a method", public: true, codeChallenge: testVerifier, wantErr: true},
+		{name: "public with a method but no challenge", public: true, codeChallengeMethod: oidc.CodeChallengeMethodS256, wantErr: true},
+		{name: "public with an unknown method", public: true, codeChallenge: testVerifier, codeChallengeMethod: "S512", wantErr: true},
+		{name: "confidential without PKCE"},
+		{name: "confidential with plain", codeChallenge: testVerifier, codeChallengeMethod: oidc.CodeChallengeMethodPlain},
+		{name: "confidential with S256", codeChallenge: s256(testVerifier), codeChallengeMethod: oidc.CodeChallengeMethodS256},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			client := createTestClient(t, db, "app", test.public)
+
+			query := url.Values{
+				"client_id":             {client.ClientId},
+				"redirect_uri":          {testRedirectUri},
+				"response_type":         {"code"},
+				"scope":                 {"openid"},
+				"code_challenge":        {test.codeChallenge},
+				"code_challenge_method": {test.codeChallengeMethod},
+			}
+
+			rw := httptest.NewRecorder()
+			s.Authorize(rw, httptest.NewRequest(http.MethodGet, AuthorizationPath+"?"+query.Encode(), nil))
+
+			// Accepted requests go on to the login
+			location, _ := url.Parse(rw.Header().Get("Location"))
+			gotErr := location.Query().Get("error")
+
+			if test.wantErr && gotErr != "invalid_request" {
+				t.Errorf("got status %d and error %q, want invalid_request", rw.Code, gotErr)
+			}
+
+			if !test.wantErr && len(gotErr) > 0 {
+				t.Errorf("got error %q: %s", gotErr, location.Query().Get("error_description"))
+			}
+		})
+	}
+}
+
+// Issues an authorization code to client for a new user, and returns it.
+func createTestCode(t *testing.T, db *sqlx.DB, client *oidc.Client) string {
+	u := database.CreateTestUser(t, db, "alice", "correct horse battery staple")
+
+	code, err := database.CreateOidcAuthorizationCode(db, oidc.AuthorizationCode{
+		ClientId:            client.ClientId,
+		UserId:              u.Id,
+		RedirectUri:         testRedirectUri,
+		Scope:               "openid",
+		CodeChallenge:       s256(testVerifier),
+		CodeChallengeMethod: oidc.CodeChallengeMethodS256,
+		AuthTime:            time.Now().UTC(),
+		ExpiresAt:           time.Now().Add(oidc.AuthorizationCodeLifetime).UTC(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func redeem(s *Service, client *oidc.Client, code string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ClientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {testVerifier},
+	}
+
+	r := httptest.NewRequest(http.MethodPost, TokenPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rw := httptest.NewRecorder()
+	s.Token(rw, r)
+
+	return rw
+}
+
+func TestTokenRejectsCodesOfOtherClients(t *testing.T) {
+	s, db := newTestService(t)
+	app := createTestClient(t, db, "app", true)
+	other := createTestClient(t, db, "other", true)
+
+	code := createTestCode(t, db, app)
+
+	if rw := redeem(s, other, code); rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "invalid_grant") {
+		t.Errorf("another client redeemed the code: %d %s", rw.Code, rw.Body.String())
+	}
+
+	// The code still works for the client it was issued to, but only once
+	if rw := redeem(s, app, code); rw.Code != http.StatusOK {
+		t.Errorf("got status %d for the client of the code: %s", rw.Code, rw.Body.String())
+	}
+
+	if rw := redeem(s, app, code); rw.Code != http.StatusBadRequest {
+		t.Errorf("got status %d when redeeming the code again", rw.Code)
+	}
+}
+
+func TestTokenRedeemsConcurrentCodesOnce(t *testing.T) {
+	s, db := newTestService(t)
+	app := createTestClient(t, db, "app", true)
+	code := createTestCode(t, db, app)
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			statuses <- redeem(s, app, code).Code
+		}()
+	}
+
+	wg.Wait()
+	close(statuses)
+
+	redeemed := 0
+
+	for status := range statuses {
+		if status == http.StatusOK {
+			redeemed++
+		}
+	}
+
+	if redeemed != 1 {
+		t.Errorf("code was redeemed %d times", redeemed)
+	}
+}
@@ -0,0 +1,300 @@
+package passkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+	"authfish/internal/webauthn"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	relyingPartyName   = "authfish"
+	defaultPasskeyName = "Passkey"
+)
+
+type Service struct {
+	store    sessions.Store
+	db       *sqlx.DB
+	domains  []string
+	secure   bool
+	lifetime session.Lifetime
+}
+
+func New(store sessions.Store, db *sqlx.DB, domains []string, secure bool, lifetime session.Lifetime) *Service {
+	return &Service{
+		store:    store,
+		db:       db,
+		domains:  domains,
+		secure:   secure,
+		lifetime: lifetime,
+	}
+}
+
+// Handles the passkey management form on /me. Registration itself happens in
+// BeginRegistration and FinishRegistration.
+func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	if err != nil {
+		http.Error(rw, "Invalid passkey id", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.DeleteWebauthnCredential(s.db, *currentUser, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(rw, r, "/me", http.StatusFound)
+}
+
+func (s *Service) BeginRegistration(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		writeError(rw, http.StatusUnauthorized, fmt.Errorf("not logged in"))
+		return
+	}
+
+	existing, err := database.ListWebauthnCredentials(s.db, *currentUser)
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("error querying database: %w", err))
+		return
+	}
+
+	challenge, err := s.createChallenge(&currentUser.Id)
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	rp := s.relyingParty(r)
+	writeJSON(rw, http.StatusOK, rp.CreationOptions(challenge, currentUser.Id, currentUser.Username, existing))
+}
+
+func (s *Service) FinishRegistration(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		writeError(rw, http.StatusUnauthorized, fmt.Errorf("not logged in"))
+		return
+	}
+
+	response := webauthn.RegistrationResponse{}
+
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err))
+		return
+	}
+
+	response.Name = strings.TrimSpace(response.Name)
+	if len(response.Name) == 0 {
+		response.Name = defaultPasskeyName
+	}
+
+	challenge, err := s.consumeChallenge(response.ClientDataJSON, &currentUser.Id)
+
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	credential, err := s.relyingParty(r).VerifyRegistration(response, challenge)
+
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := database.CreateWebauthnCredential(s.db, *currentUser, *credential); err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Service) BeginLogin(rw http.ResponseWriter, r *http.Request) {
+	challenge, err := s.createChallenge(nil)
+
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, s.relyingParty(r).RequestOptions(challenge))
+}
+
+func (s *Service) FinishLogin(rw http.ResponseWriter, r *http.Request) {
+	response := webauthn.AssertionResponse{}
+
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err))
+		return
+	}
+
+	challenge, err := s.consumeChallenge(response.ClientDataJSON, nil)
+
+	if err != nil {
+		writeError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	u, err := s.verifyAssertion(r, response, challenge)
+
+	if err != nil {
+		log.Printf("Passkey login failed: %v", err)
+		writeError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err := session.SetUserSession(rw, r, s.store, s.domains, s.lifetime, *u, response.Remember); err != nil {
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("could not save user session: %w", err))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Service) verifyAssertion(r *http.Request, response webauthn.AssertionResponse, challenge []byte) (*user.User, error) {
+	credentialId, err := webauthn.Decode(response.Id)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey id")
+	}
+
+	credential, err := database.FindWebauthnCredentialByCredentialId(s.db, credentialId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if credential == nil {
+		return nil, fmt.Errorf("passkey not registered")
+	}
+
+	signCount, err := s.relyingParty(r).VerifyAssertion(response, challenge, *credential)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.UpdateWebauthnCredentialUsage(s.db, *credential, signCount); err != nil {
+		return nil, fmt.Errorf("error updating passkey: %w", err)
+	}
+
+	u, err := database.FindUserById(s.db, credential.UserId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if u == nil {
+		return nil, fmt.Errorf("user %d does not exist", credential.UserId)
+	}
+
+	if !u.IsActive() {
+		inactiveErr := fmt.Errorf("your account is waiting for approval by an admin")
+		if u.IsDisabled() {
+			inactiveErr = fmt.Errorf("your account has been disabled")
+		}
+
+		return nil, inactiveErr
+	}
+
+	return u, nil
+}
+
+func (s *Service) createChallenge(userId *int64) ([]byte, error) {
+	challenge, err := webauthn.GenerateChallenge()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.CreateWebauthnChallenge(s.db, challenge, userId); err != nil {
+		return nil, fmt.Errorf("could not save challenge: %w", err)
+	}
+
+	return challenge, nil
+}
+
+func (s *Service) consumeChallenge(clientDataJSON string, userId *int64) ([]byte, error) {
+	challenge, err := webauthn.ChallengeFromClientData(clientDataJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	consumed, err := database.ConsumeWebauthnChallenge(s.db, challenge, userId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+
+	if !consumed {
+		return nil, fmt.Errorf("challenge is invalid or has expired")
+	}
+
+	return challenge, nil
+}
+
+// Passkeys are registered against the configured cookie domain when there is
+// one, so that a passkey created on the login host also works on the login
+// pages of every protected host.
+func (s *Service) relyingParty(r *http.Request) webauthn.RelyingParty {
+	requestUrl := &url.URL{Host: r.Host}
+
+	if parsedUrl, err := url.ParseRequestURI(r.Header.Get("X-Original-URL")); err == nil {
+		requestUrl = parsedUrl
+	}
+
+	id := requestUrl.Hostname()
+
+	if domain := session.GetMatchingDomain(s.domains, r); domain != nil {
+		id = strings.TrimPrefix(*domain, ".")
+	}
+
+	return webauthn.RelyingParty{
+		Id:                   strings.ToLower(id),
+		Name:                 relyingPartyName,
+		AllowInsecureOrigins: !s.secure,
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]interface{}{"error": err.Error()})
+}
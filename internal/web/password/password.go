@@ -0,0 +1,166 @@
+package password
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"authfish/internal/authenticator"
+	"authfish/internal/database"
+	"authfish/internal/lockout"
+	"authfish/internal/user"
+	"authfish/internal/web/client_ip"
+	"authfish/internal/web/csrf"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/register"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	//go:embed password.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("password").Parse(templateString))
+)
+
+type templateVars struct {
+	User      *user.User
+	Changed   bool
+	Errors    []error
+	CsrfToken string
+}
+
+func renderTemplate(rw http.ResponseWriter, r *http.Request, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
+	rw.WriteHeader(status)
+	parsedTemplate.Execute(rw, vars)
+}
+
+type Service struct {
+	store              sessions.Store
+	db                 *sqlx.DB
+	trustedProxyHeader string
+}
+
+func New(store sessions.Store, db *sqlx.DB, trustedProxyHeader string) *Service {
+	return &Service{
+		store:              store,
+		db:                 db,
+		trustedProxyHeader: trustedProxyHeader,
+	}
+}
+
+func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderTemplate(rw, r, http.StatusOK, templateVars{User: currentUser})
+		return
+	}
+
+	if !currentUser.HasLocalPassword() {
+		http.Error(rw, fmt.Sprintf("Your password is managed by %s", currentUser.Source), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try GET or POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.handleChange(rw, r, *currentUser)
+}
+
+func (s *Service) handleChange(rw http.ResponseWriter, r *http.Request, u user.User) {
+	currentPassword := r.FormValue("currentPassword")
+	newPassword := r.FormValue("newPassword")
+	confirmPassword := r.FormValue("confirmPassword")
+
+	ip := client_ip.ClientIp(r, s.trustedProxyHeader)
+
+	// Someone with a stolen session could otherwise guess the password here,
+	// without the limits of the login page.
+	activeLockout, err := authenticator.FindActiveLockout(s.db, u.Username, ip)
+
+	if err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			User:   &u,
+			Errors: []error{fmt.Errorf("error running database query: %w", err)},
+		})
+		return
+	}
+
+	if activeLockout != nil {
+		retryAfter := int(math.Ceil(activeLockout.Remaining().Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+		renderTemplate(rw, r, http.StatusTooManyRequests, templateVars{
+			User:   &u,
+			Errors: []error{activeLockout},
+		})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(currentPassword)); err != nil {
+		errs := []error{fmt.Errorf("current password is not correct")}
+
+		if newLockout := authenticator.RecordFailure(s.db, u.Username, ip); newLockout != nil {
+			errs = append(errs, newLockout)
+		}
+
+		renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			User:   &u,
+			Errors: errs,
+		})
+		return
+	}
+
+	if err := database.ClearLockout(s.db, lockout.KindUsername, u.Username); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", u.Username, err)
+	}
+
+	if errors := register.ValidatePasswords(newPassword, confirmPassword); len(errors) > 0 {
+		renderTemplate(rw, r, http.StatusBadRequest, templateVars{
+			User:   &u,
+			Errors: errors,
+		})
+		return
+	}
+
+	if err := database.ChangePassword(s.db, u, newPassword); err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			User:   &u,
+			Errors: []error{fmt.Errorf("could not change password: %w", err)},
+		})
+		return
+	}
+
+	// Anyone who knew the old password should not stay logged in
+	err = database.RevokeOtherUserSessionsForUser(s.db, u, session.CurrentTokenHash(r, s.store))
+
+	if err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			User:   &u,
+			Errors: []error{fmt.Errorf("password changed, but could not log out other sessions: %w", err)},
+		})
+		return
+	}
+
+	renderTemplate(rw, r, http.StatusOK, templateVars{
+		User:    &u,
+		Changed: true,
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"authfish/internal/database"
+	"authfish/internal/web/csrf"
 	"authfish/internal/web/session"
 
 	"github.com/gorilla/sessions"
@@ -24,15 +25,21 @@ const (
 	MinimumPasswordLength = 6
 )
 
+var errRegistrationTokenExpired = fmt.Errorf("this registration link has expired, ask an admin for a new one")
+
 type templateVars struct {
 	Username          string
 	Password          string
 	ConfirmPassword   string
 	RegistrationToken string
+	SignUp            bool
+	AwaitingApproval  bool
 	Errors            []error
+	CsrfToken         string
 }
 
-func renderTemplate(rw http.ResponseWriter, status int, vars templateVars) {
+func renderTemplate(rw http.ResponseWriter, r *http.Request, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
 	rw.WriteHeader(status)
 	parsedTemplate.Execute(rw, vars)
 }
@@ -41,13 +48,18 @@ type Service struct {
 	store   sessions.Store
 	db      *sqlx.DB
 	domains []string
+
+	// Let anyone sign up without a registration token. Their account is
+	// pending until an admin approves it.
+	openRegistration bool
 }
 
-func New(store sessions.Store, db *sqlx.DB, domains []string) *Service {
+func New(store sessions.Store, db *sqlx.DB, domains []string, openRegistration bool) *Service {
 	return &Service{
-		store:   store,
-		db:      db,
-		domains: domains,
+		store:            store,
+		db:               db,
+		domains:          domains,
+		openRegistration: openRegistration,
 	}
 }
 
@@ -58,7 +70,7 @@ func (s *Service) showRegistration(rw http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
 			RegistrationToken: registrationToken,
 			Errors:            []error{fmt.Errorf("error querying database: %w", err)},
 		})
@@ -67,14 +79,22 @@ func (s *Service) showRegistration(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if user == nil {
-		renderTemplate(rw, http.StatusUnauthorized, templateVars{
+		renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
 			RegistrationToken: registrationToken,
 			Errors:            []error{fmt.Errorf("registration token not valid")},
 		})
 		return
 	}
 
-	renderTemplate(rw, http.StatusOK, templateVars{
+	if user.RegistrationTokenExpired() {
+		renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			RegistrationToken: registrationToken,
+			Errors:            []error{errRegistrationTokenExpired},
+		})
+		return
+	}
+
+	renderTemplate(rw, r, http.StatusOK, templateVars{
 		Username:          user.Username,
 		RegistrationToken: registrationToken,
 	})
@@ -89,7 +109,7 @@ func (s *Service) handleRegistration(rw http.ResponseWriter, r *http.Request) {
 	user, err := database.FindUserByRegistrationToken(s.db, registrationToken)
 
 	if err != nil {
-		renderTemplate(rw, http.StatusBadRequest, templateVars{
+		renderTemplate(rw, r, http.StatusBadRequest, templateVars{
 			Username:          usernameFromForm,
 			Password:          password,
 			ConfirmPassword:   confirmPassword,
@@ -99,7 +119,7 @@ func (s *Service) handleRegistration(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if user == nil {
-		renderTemplate(rw, http.StatusUnauthorized, templateVars{
+		renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
 			Username:          usernameFromForm,
 			Password:          password,
 			ConfirmPassword:   confirmPassword,
@@ -109,9 +129,20 @@ func (s *Service) handleRegistration(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordErrors := validatePasswords(password, confirmPassword)
+	if user.RegistrationTokenExpired() {
+		renderTemplate(rw, r, http.StatusUnauthorized, templateVars{
+			Username:          usernameFromForm,
+			Password:          password,
+			ConfirmPassword:   confirmPassword,
+			RegistrationToken: registrationToken,
+			Errors:            []error{errRegistrationTokenExpired},
+		})
+		return
+	}
+
+	passwordErrors := ValidatePasswords(password, confirmPassword)
 	if len(passwordErrors) > 0 {
-		renderTemplate(rw, http.StatusBadRequest, templateVars{
+		renderTemplate(rw, r, http.StatusBadRequest, templateVars{
 			Username:          user.Username,
 			Password:          password,
 			ConfirmPassword:   confirmPassword,
@@ -124,7 +155,7 @@ func (s *Service) handleRegistration(rw http.ResponseWriter, r *http.Request) {
 	err = database.CompleteRegistration(s.db, user.Id, registrationToken, password)
 
 	if err != nil {
-		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
 			Username:          user.Username,
 			Password:          password,
 			ConfirmPassword:   confirmPassword,
@@ -134,22 +165,52 @@ func (s *Service) handleRegistration(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := session.SetUserSession(rw, r, s.store, s.domains, *user); err != nil {
-		renderTemplate(rw, http.StatusInternalServerError, templateVars{
+	// When resetting a password, log out any sessions using the old password
+	if _, err := database.RevokeAllUserSessionsForUser(s.db, *user); err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			Username:          user.Username,
+			RegistrationToken: registrationToken,
+			Errors:            []error{fmt.Errorf("could not revoke sessions: %w", err)},
+		})
+		return
+	}
+
+	totpCredential, err := database.FindTotpCredential(s.db, *user)
+
+	if err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
 			Username:          user.Username,
-			Password:          password,
-			ConfirmPassword:   confirmPassword,
 			RegistrationToken: registrationToken,
-			Errors:            []error{fmt.Errorf("could not save user session: %w", err)},
+			Errors:            []error{fmt.Errorf("error running database query: %w", err)},
 		})
 		return
 	}
 
-	http.Redirect(rw, r, "/me", http.StatusFound)
+	// A registration token replaces the password, not the second factor
+	if totpCredential != nil && totpCredential.IsConfirmed() {
+		if err := session.SetPendingSecondFactorSession(rw, r, s.store, s.domains, *user); err != nil {
+			renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+				Username:          user.Username,
+				RegistrationToken: registrationToken,
+				Errors:            []error{fmt.Errorf("could not save user session: %w", err)},
+			})
+			return
+		}
+
+		http.Redirect(rw, r, "/login?step=secondFactor", http.StatusFound)
+		return
+	}
+
+	http.Redirect(rw, r, "/login", http.StatusFound)
 }
 
 func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
+		if s.openRegistration && len(strings.TrimSpace(r.URL.Query().Get("registrationToken"))) == 0 {
+			s.showSignUp(rw, r)
+			return
+		}
+
 		s.showRegistration(rw, r)
 		return
 	}
@@ -160,10 +221,16 @@ func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.openRegistration && len(r.FormValue("registrationToken")) == 0 {
+		s.handleSignUp(rw, r)
+		return
+	}
+
 	s.handleRegistration(rw, r)
 }
 
-func validatePasswords(password string, confirmPassword string) []error {
+// Checks a new password and its confirmation. Also used when changing passwords.
+func ValidatePasswords(password string, confirmPassword string) []error {
 	errors := []error{}
 
 	if err := checkPasswordsMatch(password, confirmPassword); err != nil {
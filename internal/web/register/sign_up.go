@@ -0,0 +1,55 @@
+package register
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"authfish/internal/database"
+	"authfish/internal/utils"
+)
+
+func (s *Service) showSignUp(rw http.ResponseWriter, r *http.Request) {
+	renderTemplate(rw, r, http.StatusOK, templateVars{SignUp: true})
+}
+
+func (s *Service) handleSignUp(rw http.ResponseWriter, r *http.Request) {
+	username := utils.NormalizeUsername(r.FormValue("username"))
+	password := r.FormValue("password")
+	confirmPassword := r.FormValue("confirmPassword")
+
+	errors := []error{}
+
+	if len(username) == 0 || strings.ContainsAny(username, " \t\r\n") {
+		errors = append(errors, fmt.Errorf("username must not be empty or contain spaces"))
+	}
+
+	errors = append(errors, ValidatePasswords(password, confirmPassword)...)
+
+	if len(errors) > 0 {
+		renderTemplate(rw, r, http.StatusBadRequest, templateVars{
+			Username:        username,
+			Password:        password,
+			ConfirmPassword: confirmPassword,
+			SignUp:          true,
+			Errors:          errors,
+		})
+		return
+	}
+
+	if _, err := database.SignUpUser(s.db, username, password); err != nil {
+		renderTemplate(rw, r, http.StatusBadRequest, templateVars{
+			Username:        username,
+			Password:        password,
+			ConfirmPassword: confirmPassword,
+			SignUp:          true,
+			Errors:          []error{err},
+		})
+		return
+	}
+
+	renderTemplate(rw, r, http.StatusOK, templateVars{
+		Username:         username,
+		AwaitingApproval: true,
+	})
+}
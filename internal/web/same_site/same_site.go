@@ -0,0 +1,48 @@
+package same_site
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"authfish/internal/web/session"
+)
+
+// Marks requests which already went through Continue, so that users who
+// really are logged out don't go round in circles.
+const ContinuedParam = "authfishContinued"
+
+var (
+	//go:embed continue.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("continue").Parse(templateString))
+)
+
+type templateVars struct {
+	Target string
+}
+
+// Returns true if r arrived without the session cookie and hasn't been
+// continued yet. The session cookie is SameSite=Strict, so browsers leave it
+// out when another site sends the user here, even if they are logged in.
+func NeedsContinue(r *http.Request) bool {
+	if _, err := r.Cookie(session.SessionName); err == nil {
+		return false
+	}
+
+	return len(r.URL.Query().Get(ContinuedParam)) == 0
+}
+
+// Sends the user on to path with params, from a page of authfish itself. The
+// browser then treats the request as same-site and sends the session cookie.
+func Continue(rw http.ResponseWriter, path string, params url.Values) {
+	continued := url.Values{ContinuedParam: {"1"}}
+
+	for key, values := range params {
+		continued[key] = values
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	parsedTemplate.Execute(rw, templateVars{Target: path + "?" + continued.Encode()})
+}
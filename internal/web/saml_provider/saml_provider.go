@@ -0,0 +1,283 @@
+package saml_provider
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/saml"
+	"authfish/internal/user"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/same_site"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+// Paths of the endpoints, relative to the public URL of authfish.
+const (
+	MetadataPath     = "/saml/metadata"
+	SingleSignOnPath = "/saml/sso"
+)
+
+var (
+	//go:embed post.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("post").Parse(templateString))
+)
+
+type templateVars struct {
+	AcsUrl       string
+	SamlResponse string
+	RelayState   string
+}
+
+// Lets apps which speak SAML 2.0 log users in with authfish. Requests come in
+// with the HTTP-Redirect or HTTP-POST binding, and responses are always
+// posted back.
+type Service struct {
+	store           sessions.Store
+	db              *sqlx.DB
+	entityId        string
+	singleSignOnUrl string
+	keyPair         *saml.KeyPair
+}
+
+// The entity ID of authfish is the URL of its metadata, as is customary.
+func New(store sessions.Store, db *sqlx.DB, idpUrl string, keyPair *saml.KeyPair) *Service {
+	idpUrl = strings.TrimSuffix(idpUrl, "/")
+
+	return &Service{
+		store:           store,
+		db:              db,
+		entityId:        idpUrl + MetadataPath,
+		singleSignOnUrl: idpUrl + SingleSignOnPath,
+		keyPair:         keyPair,
+	}
+}
+
+func (s *Service) Metadata(rw http.ResponseWriter, r *http.Request) {
+	metadata, err := s.keyPair.Metadata(s.entityId, s.singleSignOnUrl)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/samlmetadata+xml")
+	rw.Write(metadata)
+}
+
+// Sends users who are not logged in to the login page, and then back to the
+// service provider with a signed assertion. Errors are only sent back to the
+// service provider once its assertion consumer service URL is known to be
+// registered.
+func (s *Service) SingleSignOn(rw http.ResponseWriter, r *http.Request) {
+	// Only the HTTP-Redirect binding deflates requests
+	request, err := saml.DecodeRequest(r.FormValue("SAMLRequest"), r.Method == http.MethodGet)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	authnRequest, err := saml.ParseAuthnRequest(request)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sp, err := database.FindSamlServiceProvider(s.db, authnRequest.Issuer)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if sp == nil {
+		http.Error(rw, "Unknown service provider "+authnRequest.Issuer, http.StatusBadRequest)
+		return
+	}
+
+	acsUrl, ok := sp.AcsUrl(authnRequest.AssertionConsumerServiceUrl)
+
+	if !ok {
+		http.Error(rw, "AssertionConsumerServiceURL is not registered for this service provider", http.StatusBadRequest)
+		return
+	}
+
+	relayState := r.FormValue("RelayState")
+	currentUser, _ := current_user.CurrentUser(r.Context())
+
+	if currentUser == nil || current_user.CurrentAuthMethod(r.Context()) != current_user.AuthMethodSession {
+		if same_site.NeedsContinue(r) {
+			s.continueSameSite(rw, request, relayState)
+			return
+		}
+
+		if authnRequest.IsPassive {
+			s.postError(rw, acsUrl, authnRequest.Id, relayState, saml.StatusNoPassive, "the user is not logged in")
+			return
+		}
+
+		s.redirectToLogin(rw, r, request, relayState)
+		return
+	}
+
+	authnInstant, err := session.GetAuthenticatedAt(r, s.store)
+
+	if err != nil {
+		log.Printf("Error reading login time for SAML: %v", err)
+		authnInstant = time.Now()
+	}
+
+	nameId, err := s.fieldValues(*currentUser, sp.NameIdField)
+
+	if err != nil || len(nameId) != 1 {
+		s.postError(rw, acsUrl, authnRequest.Id, relayState, "", "could not look up the NameID")
+		return
+	}
+
+	attributes := []saml.Attribute{}
+
+	for _, mapping := range sp.AttributeMappings() {
+		values, err := s.fieldValues(*currentUser, mapping.Field)
+
+		if err != nil {
+			s.postError(rw, acsUrl, authnRequest.Id, relayState, "", "could not look up attribute "+mapping.Name)
+			return
+		}
+
+		attributes = append(attributes, saml.Attribute{Name: mapping.Name, Values: values})
+	}
+
+	response, err := s.keyPair.SignedResponse(saml.Assertion{
+		Issuer:       s.entityId,
+		Audience:     sp.EntityId,
+		Destination:  acsUrl,
+		InResponseTo: authnRequest.Id,
+		NameId:       nameId[0],
+		AuthnInstant: authnInstant,
+		Attributes:   attributes,
+	})
+
+	if err != nil {
+		log.Printf("Error signing SAML response for %s: %v", sp.EntityId, err)
+		http.Error(rw, "Could not sign response", http.StatusInternalServerError)
+		return
+	}
+
+	post(rw, acsUrl, response, relayState)
+}
+
+// Requests sent with the HTTP-POST binding are turned into HTTP-Redirect ones,
+// so that the login page can send the user back here with a GET.
+func (s *Service) redirectToLogin(rw http.ResponseWriter, r *http.Request, request []byte, relayState string) {
+	params, err := redirectParams(request, relayState)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirect := SingleSignOnPath + "?" + params.Encode()
+
+	http.Redirect(rw, r, "/login?"+url.Values{"redirect": {redirect}}.Encode(), http.StatusFound)
+}
+
+// Service providers on other sites send the user here without the session
+// cookie, so the request is repeated from a page of authfish before deciding
+// that the user is logged out.
+func (s *Service) continueSameSite(rw http.ResponseWriter, request []byte, relayState string) {
+	params, err := redirectParams(request, relayState)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	same_site.Continue(rw, SingleSignOnPath, params)
+}
+
+// Returns the query parameters of request with the HTTP-Redirect binding.
+func redirectParams(request []byte, relayState string) (url.Values, error) {
+	encodedRequest, err := saml.EncodeRedirectRequest(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{"SAMLRequest": {encodedRequest}}
+
+	if len(relayState) > 0 {
+		params.Set("RelayState", relayState)
+	}
+
+	return params, nil
+}
+
+// Returns the values of a user field, as strings. Only groups can have more
+// than one value.
+func (s *Service) fieldValues(u user.User, field string) ([]string, error) {
+	switch field {
+	case saml.FieldId:
+		return []string{strconv.FormatInt(u.Id, 10)}, nil
+	case saml.FieldUsername:
+		return []string{u.Username}, nil
+	case saml.FieldIsAdmin:
+		return []string{strconv.FormatBool(u.IsAdmin)}, nil
+	case saml.FieldSource:
+		return []string{u.Source}, nil
+	case saml.FieldCreatedAt:
+		return []string{u.CreatedAt.UTC().Format(time.RFC3339)}, nil
+	case saml.FieldGroups:
+		groups, err := database.ListGroupsForUser(s.db, u)
+
+		if err != nil {
+			log.Printf("Error listing groups of %s for SAML: %v", u.Username, err)
+			return nil, err
+		}
+
+		groupNames := []string{}
+
+		for _, g := range groups {
+			groupNames = append(groupNames, g.Name)
+		}
+
+		return groupNames, nil
+	default:
+		return nil, saml.ValidateField(field)
+	}
+}
+
+// Tells the service provider the user could not be logged in. statusCode is
+// an optional second level status code, like NoPassive.
+func (s *Service) postError(rw http.ResponseWriter, acsUrl string, inResponseTo string, relayState string, statusCode string, message string) {
+	response, err := saml.ErrorResponse(s.entityId, acsUrl, inResponseTo, statusCode, message)
+
+	if err != nil {
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	post(rw, acsUrl, response, relayState)
+}
+
+// Posts response to the service provider with a form which submits itself.
+func post(rw http.ResponseWriter, acsUrl string, response []byte, relayState string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	parsedTemplate.Execute(rw, templateVars{
+		AcsUrl:       acsUrl,
+		SamlResponse: saml.EncodeResponse(response),
+		RelayState:   relayState,
+	})
+}
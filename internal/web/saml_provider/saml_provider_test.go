@@ -0,0 +1,114 @@
+package saml_provider
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/saml"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/key_usage"
+	"authfish/internal/web/session"
+)
+
+const (
+	testSpEntityId = "https://app.example.com/saml/metadata"
+	testAcsUrl     = "https://app.example.com/saml/acs"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func authnRequest(acsUrl string) []byte {
+	acsAttr := ""
+
+	if len(acsUrl) > 0 {
+		acsAttr = ` AssertionConsumerServiceURL="` + acsUrl + `"`
+	}
+
+	return []byte(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_request-1" Version="2.0"` + acsAttr + `>` +
+		`<saml:Issuer>` + testSpEntityId + `</saml:Issuer>` +
+		`</samlp:AuthnRequest>`)
+}
+
+func TestSingleSignOnAcsUrl(t *testing.T) {
+	tests := []struct {
+		name       string
+		acsUrl     string
+		wantStatus int
+	}{
+		{name: "registered", acsUrl: testAcsUrl, wantStatus: http.StatusOK},
+		{name: "default", wantStatus: http.StatusOK},
+		{name: "unregistered", acsUrl: "https://evil.example.org/saml/acs", wantStatus: http.StatusBadRequest},
+		{name: "registered as a prefix", acsUrl: testAcsUrl + "/../evil", wantStatus: http.StatusBadRequest},
+		{name: "registered with a query", acsUrl: testAcsUrl + "?next=https://evil.example.org", wantStatus: http.StatusBadRequest},
+	}
+
+	db := database.OpenTestDB(t)
+	store := session.NewSqliteStore(db, testKey)
+	lifetime := session.Lifetime{Absolute: time.Hour, Idle: time.Hour}
+	u := database.CreateTestUser(t, db, "alice", "correct horse battery staple")
+
+	keyPair, err := saml.LoadOrCreateKeyPair(filepath.Join(t.TempDir(), "saml_signing_key.pem"), filepath.Join(t.TempDir(), "saml_certificate.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.CreateSamlServiceProvider(db, testSpEntityId, []string{testAcsUrl}, saml.FieldUsername, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(store, db, "https://auth.example.com", keyPair)
+	handler := current_user.AddCurrentUserToRequestContext(db, store, lifetime, key_usage.New(db, "", time.Hour), http.HandlerFunc(service.SingleSignOn))
+
+	loginRecorder := httptest.NewRecorder()
+	if err := session.SetUserSession(loginRecorder, httptest.NewRequest(http.MethodPost, "/login", nil), store, nil, lifetime, *u, false); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionCookie := loginRecorder.Result().Cookies()[0]
+
+	for _, test := range tests {
+		for _, binding := range []string{saml.BindingHttpRedirect, saml.BindingHttpPost} {
+			t.Run(test.name+" with "+binding, func(t *testing.T) {
+				var r *http.Request
+
+				if binding == saml.BindingHttpRedirect {
+					encoded, err := saml.EncodeRedirectRequest(authnRequest(test.acsUrl))
+
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					r = httptest.NewRequest(http.MethodGet, SingleSignOnPath+"?"+url.Values{"SAMLRequest": {encoded}}.Encode(), nil)
+				} else {
+					form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(authnRequest(test.acsUrl))}}
+					r = httptest.NewRequest(http.MethodPost, SingleSignOnPath, strings.NewReader(form.Encode()))
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+
+				r.AddCookie(sessionCookie)
+
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, r)
+
+				body := rw.Body.String()
+				postsResponse := strings.Contains(body, "SAMLResponse")
+
+				if rw.Code != test.wantStatus || postsResponse != (test.wantStatus == http.StatusOK) {
+					t.Fatalf("got status %d and posted a response %v: %s", rw.Code, postsResponse, body)
+				}
+
+				if postsResponse && !strings.Contains(body, `action="`+testAcsUrl+`"`) {
+					t.Errorf("response is not posted to %s: %s", testAcsUrl, body)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	CsrfTokenKey       = "csrfToken"
+	CsrfTokenFormField = "csrfToken"
+	CsrfTokenHeader    = "X-CSRF-Token"
+
+	csrfTokenSize = 32
+)
+
+// Returns the CSRF token for the session in r, creating one if the session
+// does not have one yet. Forms which change anything must include it in the
+// CsrfTokenFormField field, or the CsrfTokenHeader header.
+func GetCsrfToken(rw http.ResponseWriter, r *http.Request, store sessions.Store, domains []string) (string, error) {
+	// Ignoring error on purpose, existing session might be invalid
+	session, _ := store.Get(r, SessionName)
+
+	if token, ok := session.Values[CsrfTokenKey].(string); ok && len(token) > 0 {
+		return token, nil
+	}
+
+	token := hex.EncodeToString(securecookie.GenerateRandomKey(csrfTokenSize))
+	session.Values[CsrfTokenKey] = token
+
+	// Use the same cookie as the session the user will log in to, otherwise
+	// the browser ends up with two cookies of the same name.
+	domain := GetMatchingDomain(domains, r)
+
+	if domain != nil {
+		session.Options.Domain = *domain
+	}
+
+	return token, session.Save(r, rw)
+}
+
+// Checks that the form or fetch() request in r contains the CSRF token of its
+// session.
+func VerifyCsrfToken(r *http.Request, store sessions.Store) error {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return err
+	}
+
+	token, ok := session.Values[CsrfTokenKey].(string)
+
+	if !ok || len(token) == 0 {
+		return fmt.Errorf("session does not have a CSRF token")
+	}
+
+	submitted := r.Header.Get(CsrfTokenHeader)
+
+	if len(submitted) == 0 {
+		submitted = r.FormValue(CsrfTokenFormField)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+		return fmt.Errorf("invalid CSRF token")
+	}
+
+	return nil
+}
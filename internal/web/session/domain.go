@@ -0,0 +1,97 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Checks a --domain entry at startup and returns it in lower case. Cookies can
+// not be set for IP addresses or public suffixes like .com or .co.uk, and
+// browsers would silently drop them. Single label names like localhost or an
+// intranet host are allowed, as long as they aren't top level domains.
+func ValidateDomain(domain string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(domain))
+	bare := strings.TrimPrefix(normalized, ".")
+
+	if len(bare) == 0 {
+		return "", fmt.Errorf("domain must not be empty")
+	}
+
+	if strings.ContainsAny(bare, ":/@ ") {
+		return "", fmt.Errorf("domain %q must be a plain domain name, without scheme, port or path", domain)
+	}
+
+	if net.ParseIP(bare) != nil {
+		return "", fmt.Errorf("domain %q is an IP address, cookies can only be shared between domain names", domain)
+	}
+
+	for _, label := range strings.Split(bare, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("domain %q has an invalid label %q", domain, label)
+		}
+	}
+
+	if !strings.Contains(bare, ".") {
+		if _, icann := publicsuffix.PublicSuffix(bare); icann {
+			return "", fmt.Errorf("domain %q is a top level domain, browsers will not accept cookies for it", domain)
+		}
+
+		return normalized, nil
+	}
+
+	if _, err := publicsuffix.EffectiveTLDPlusOne(bare); err != nil {
+		return "", fmt.Errorf("domain %q is a public suffix, browsers will not accept cookies for it", domain)
+	}
+
+	return normalized, nil
+}
+
+// Whether a cookie for domain would be sent to host. Both example.com and
+// .example.com cover example.com and all of its subdomains. Matching happens
+// on whole labels, so example.com does not cover badexample.com or
+// example.com.evil.net.
+func DomainMatches(host string, domain string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+
+	if len(domain) == 0 {
+		return false
+	}
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Find the first configured cookie domain covering the host in
+// X-Original-URL, if any. Hosts outside every domain get a cookie for just
+// that host, the server warns about known ones at startup.
+func GetMatchingDomain(targetDomains []string, request *http.Request) *string {
+	originalUrl := request.Header.Get("X-Original-URL")
+
+	if len(originalUrl) == 0 {
+		return nil
+	}
+
+	parsedUrl, err := url.ParseRequestURI(originalUrl)
+
+	if err != nil {
+		return nil
+	}
+
+	return MatchingDomain(targetDomains, parsedUrl.Hostname())
+}
+
+// Find the first configured cookie domain covering host, if any.
+func MatchingDomain(targetDomains []string, host string) *string {
+	for _, domain := range targetDomains {
+		if DomainMatches(host, domain) {
+			return &domain
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDomainMatches(t *testing.T) {
+	tests := []struct {
+		host   string
+		domain string
+		want   bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", ".example.com", true},
+		{"wiki.example.com", "example.com", true},
+		{"wiki.example.com", ".example.com", true},
+		{"a.b.example.com", ".example.com", true},
+		{"WIKI.Example.COM", "example.com", true},
+		{"wiki.example.com.", "example.com", true},
+		{"localhost", "localhost", true},
+		{"app.localhost", ".localhost", true},
+
+		// Only whole labels match
+		{"badexample.com", "example.com", false},
+		{"badexample.com", ".example.com", false},
+		{"wiki.badexample.com", ".example.com", false},
+		{"example.com.evil.net", "example.com", false},
+		{"example.com-evil.net", "example.com", false},
+		{"xample.com", "example.com", false},
+		{"com", "example.com", false},
+		{"example.org", "example.com", false},
+		{"example.com", "wiki.example.com", false},
+		{"mylocalhost", "localhost", false},
+
+		{"example.com", "", false},
+		{"example.com", ".", false},
+	}
+
+	for _, test := range tests {
+		if got := DomainMatches(test.host, test.domain); got != test.want {
+			t.Errorf("DomainMatches(%q, %q) = %v, want %v", test.host, test.domain, got, test.want)
+		}
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{domain: "example.com", want: "example.com"},
+		{domain: ".Example.com", want: ".example.com"},
+		{domain: " wiki.example.co.uk ", want: "wiki.example.co.uk"},
+		{domain: "localhost", want: "localhost"},
+		{domain: ".localhost", want: ".localhost"},
+		{domain: "intranet", want: "intranet"},
+
+		{domain: "", wantErr: true},
+		{domain: ".", wantErr: true},
+		{domain: "com", wantErr: true},
+		{domain: ".com", wantErr: true},
+		{domain: "co.uk", wantErr: true},
+		{domain: "github.io", wantErr: true},
+		{domain: "127.0.0.1", wantErr: true},
+		{domain: "::1", wantErr: true},
+		{domain: "https://example.com", wantErr: true},
+		{domain: "example.com:8080", wantErr: true},
+		{domain: "example..com", wantErr: true},
+		{domain: "-example.com", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ValidateDomain(test.domain)
+
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ValidateDomain(%q) = %q, want an error", test.domain, got)
+			}
+
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("ValidateDomain(%q) = %q, %v, want %q", test.domain, got, err, test.want)
+		}
+	}
+}
+
+func TestGetMatchingDomain(t *testing.T) {
+	domains := []string{".example.com", "example.org"}
+
+	tests := []struct {
+		originalUrl string
+		want        string // Empty if no domain should match
+	}{
+		{"https://wiki.example.com/page", ".example.com"},
+		{"https://example.org:8443/", "example.org"},
+		{"https://wiki.badexample.com/", ""},
+		{"https://example.com.evil.net/", ""},
+		{"https://evil.net/?next=wiki.example.com", ""},
+		{"https://example.com@evil.net/", ""},
+		{"not a url", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/check", nil)
+
+		if len(test.originalUrl) > 0 {
+			r.Header.Set("X-Original-URL", test.originalUrl)
+		}
+
+		got := GetMatchingDomain(domains, r)
+
+		if (got == nil && len(test.want) > 0) || (got != nil && *got != test.want) {
+			t.Errorf("GetMatchingDomain for %q = %v, want %q", test.originalUrl, got, test.want)
+		}
+	}
+}
@@ -3,8 +3,7 @@ package session
 import (
 	"fmt"
 	"net/http"
-	"net/url"
-	"strings"
+	"time"
 
 	"authfish/internal/user"
 
@@ -12,10 +11,53 @@ import (
 )
 
 const (
-	SessionName = "authfishSession"
-	UserIdKey   = "userId"
+	SessionName        = "authfishSession"
+	UserIdKey          = "userId"
+	PendingUserIdKey   = "pendingUserId"
+	PendingSinceKey    = "pendingSince"
+	PendingAttemptsKey = "pendingAttempts"
+	AuthenticatedAtKey = "authenticatedAt"
+	RenewedAtKey       = "renewedAt"
+	RememberKey        = "remember"
+
+	// How long a user has to enter their second factor after entering a
+	// correct password, and how many guesses they get.
+	PendingSecondFactorTimeout     = 5 * time.Minute
+	PendingSecondFactorMaxAttempts = 5
 )
 
+// How long a login lasts. Absolute is measured from when the user logged in,
+// Idle from when the session was last renewed.
+type Lifetime struct {
+	Absolute time.Duration
+	Idle     time.Duration
+}
+
+// Remembered sessions get a cookie which lasts until the session would expire,
+// anything else gets a browser session cookie.
+func (l Lifetime) cookieMaxAge(authenticatedAt time.Time, remember bool) int {
+	if !remember {
+		return 0
+	}
+
+	maxAge := l.Absolute - time.Since(authenticatedAt)
+
+	if l.Idle < maxAge {
+		maxAge = l.Idle
+	}
+
+	// A MaxAge of 0 would turn this into a browser session cookie
+	if maxAge < time.Second {
+		return -1
+	}
+
+	return int(maxAge.Seconds())
+}
+
+func (l Lifetime) hasExpired(authenticatedAt time.Time, renewedAt time.Time) bool {
+	return time.Since(authenticatedAt) > l.Absolute || time.Since(renewedAt) > l.Idle
+}
+
 func DeleteSession(rw http.ResponseWriter, r *http.Request, store sessions.Store) {
 	// Ignoring error on purpose, existing session might be invalid
 	session, _ := store.Get(r, SessionName)
@@ -34,19 +76,96 @@ func DeleteSessionAndRedirectToLogin(rw http.ResponseWriter, r *http.Request, st
 	http.Redirect(rw, r, "/login", http.StatusTemporaryRedirect)
 }
 
-func SetUserSession(rw http.ResponseWriter, r *http.Request, store sessions.Store, domains []string, user user.User) error {
+func SetUserSession(rw http.ResponseWriter, r *http.Request, store sessions.Store, domains []string, lifetime Lifetime, user user.User, remember bool) error {
 	// Ignoring error on purpose, existing session might be invalid
 	session, _ := store.Get(r, SessionName)
 
 	// Clear all data from session
 	session.Values = make(map[interface{}]interface{})
 
+	now := time.Now()
+
 	session.Values[UserIdKey] = user.Id
+	session.Values[AuthenticatedAtKey] = now.Unix()
+	session.Values[RenewedAtKey] = now.Unix()
+	session.Values[RememberKey] = remember
+
+	// Issue a new token on login, so a token obtained before authenticating
+	// can not be used to hijack the session. The store deletes the session of
+	// the old token.
+	session.ID = ""
+
+	session.Options.MaxAge = lifetime.cookieMaxAge(now, remember)
+
+	domain := GetMatchingDomain(domains, r)
+
+	if domain != nil {
+		session.Options.Domain = *domain
+	}
+
+	return session.Save(r, rw)
+}
+
+// Push back the idle timeout of the current user session. To avoid saving the
+// session on every request, this only happens once half of the idle timeout
+// has passed.
+func RenewUserSession(rw http.ResponseWriter, r *http.Request, store sessions.Store, domains []string, lifetime Lifetime) error {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return err
+	}
+
+	authenticatedAt, ok := session.Values[AuthenticatedAtKey].(int64)
+
+	if !ok {
+		return fmt.Errorf("could not access login time in session using key '%s'", AuthenticatedAtKey)
+	}
+
+	renewedAt, _ := session.Values[RenewedAtKey].(int64)
+
+	if time.Since(time.Unix(renewedAt, 0)) < lifetime.Idle/2 {
+		return nil
+	}
+
+	remember, _ := session.Values[RememberKey].(bool)
+
+	session.Values[RenewedAtKey] = time.Now().Unix()
+	session.Options.MaxAge = lifetime.cookieMaxAge(time.Unix(authenticatedAt, 0), remember)
+
+	domain := GetMatchingDomain(domains, r)
+
+	if domain != nil {
+		session.Options.Domain = *domain
+	}
+
+	return session.Save(r, rw)
+}
+
+// Remember that user has entered a correct password, but still needs to
+// provide a second factor. The session does not authenticate the user until
+// SetUserSession is called.
+func SetPendingSecondFactorSession(rw http.ResponseWriter, r *http.Request, store sessions.Store, domains []string, user user.User) error {
+	// Ignoring error on purpose, existing session might be invalid
+	session, _ := store.Get(r, SessionName)
+
+	// Clear all data from session, except for the CSRF token, which the second
+	// factor form rendered by this request uses.
+	csrfToken, hasCsrfToken := session.Values[CsrfTokenKey]
+	session.Values = make(map[interface{}]interface{})
+
+	if hasCsrfToken {
+		session.Values[CsrfTokenKey] = csrfToken
+	}
+
+	session.Values[PendingUserIdKey] = user.Id
+	session.Values[PendingSinceKey] = time.Now().Unix()
+	session.Values[PendingAttemptsKey] = 0
 
-	// 10 year expiration
-	session.Options.MaxAge = 10 * 365 * 24 * 3600
+	// Browser session cookie
+	session.Options.MaxAge = 0
 
-	domain := getMatchingDomain(domains, r)
+	domain := GetMatchingDomain(domains, r)
 
 	if domain != nil {
 		session.Options.Domain = *domain
@@ -55,7 +174,51 @@ func SetUserSession(rw http.ResponseWriter, r *http.Request, store sessions.Stor
 	return session.Save(r, rw)
 }
 
-func GetUserIdFromSession(rw http.ResponseWriter, r *http.Request, store sessions.Store) (int64, error) {
+func GetPendingSecondFactorUserId(rw http.ResponseWriter, r *http.Request, store sessions.Store) (int64, error) {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	userId, ok := session.Values[PendingUserIdKey].(int64)
+
+	if !ok {
+		return 0, fmt.Errorf("could not access pending user ID in session using key '%s'", PendingUserIdKey)
+	}
+
+	pendingSince, ok := session.Values[PendingSinceKey].(int64)
+
+	if !ok || time.Since(time.Unix(pendingSince, 0)) > PendingSecondFactorTimeout {
+		return 0, fmt.Errorf("pending second factor has expired")
+	}
+
+	attempts, ok := session.Values[PendingAttemptsKey].(int)
+
+	if !ok || attempts >= PendingSecondFactorMaxAttempts {
+		return 0, fmt.Errorf("too many second factor attempts")
+	}
+
+	return userId, nil
+}
+
+// Count a wrong second factor against the pending session. Returns the number
+// of attempts remaining.
+func RecordFailedSecondFactorAttempt(rw http.ResponseWriter, r *http.Request, store sessions.Store) (int, error) {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	attempts, _ := session.Values[PendingAttemptsKey].(int)
+	attempts++
+	session.Values[PendingAttemptsKey] = attempts
+
+	return PendingSecondFactorMaxAttempts - attempts, session.Save(r, rw)
+}
+
+func GetUserIdFromSession(rw http.ResponseWriter, r *http.Request, store sessions.Store, lifetime Lifetime) (int64, error) {
 	session, err := store.Get(r, SessionName)
 
 	if err != nil {
@@ -74,32 +237,63 @@ func GetUserIdFromSession(rw http.ResponseWriter, r *http.Request, store session
 		return 0, fmt.Errorf("could not cast raw user id (%#v) to int64", rawUserId)
 	}
 
+	authenticatedAt, _ := session.Values[AuthenticatedAtKey].(int64)
+	renewedAt, _ := session.Values[RenewedAtKey].(int64)
+
+	if lifetime.hasExpired(time.Unix(authenticatedAt, 0), time.Unix(renewedAt, 0)) {
+		return 0, fmt.Errorf("session has expired")
+	}
+
 	return userId, nil
 }
 
-func getMatchingDomain(targetDomains []string, request *http.Request) *string {
-	originalUrl := request.Header.Get("X-Original-URL")
+// Returns when the user of the current session logged in.
+func GetAuthenticatedAt(r *http.Request, store sessions.Store) (time.Time, error) {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return time.Time{}, err
+	}
 
-	if len(originalUrl) == 0 {
-		return nil
+	authenticatedAt, ok := session.Values[AuthenticatedAtKey].(int64)
+
+	if !ok {
+		return time.Time{}, fmt.Errorf("could not access login time in session using key '%s'", AuthenticatedAtKey)
 	}
 
-	parsedUrl, err := url.ParseRequestURI(originalUrl)
+	return time.Unix(authenticatedAt, 0), nil
+}
+
+// Store a value in the session which is only shown once, on the next page
+// that calls PopFlash.
+func AddFlash(rw http.ResponseWriter, r *http.Request, store sessions.Store, key string, value string) error {
+	session, err := store.Get(r, SessionName)
 
 	if err != nil {
-		return nil
+		return err
 	}
 
-	for _, domain := range targetDomains {
-		if strings.Contains(parsedUrl.Host, domain) {
-			return &domain
-		}
+	session.AddFlash(value, key)
 
-		domainWithoutLeadingDot := strings.TrimPrefix(domain, ".")
-		if strings.Contains(parsedUrl.Host, domainWithoutLeadingDot) {
-			return &domain
-		}
+	return session.Save(r, rw)
+}
+
+// Returns and removes the last value stored with AddFlash under key, or an
+// empty string if there is none.
+func PopFlash(rw http.ResponseWriter, r *http.Request, store sessions.Store, key string) (string, error) {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil {
+		return "", err
+	}
+
+	flashes := session.Flashes(key)
+
+	if len(flashes) == 0 {
+		return "", nil
 	}
 
-	return nil
+	value, _ := flashes[len(flashes)-1].(string)
+
+	return value, session.Save(r, rw)
 }
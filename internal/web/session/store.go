@@ -0,0 +1,180 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+
+	"authfish/internal/database"
+	"authfish/internal/utils"
+	"authfish/internal/web/client_ip"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sessionTokenSize = 32
+
+	// Default server side lifetime of sessions whose cookie only lasts as long
+	// as the browser is open.
+	defaultBrowserSessionMaxAge = 24 * 3600
+)
+
+// A sessions.Store which keeps session data in the sessions table. The cookie
+// only holds a signed and encrypted random token, so deleting the row revokes
+// the session. Rows are keyed by a hash of the token, so the contents of the
+// database can not be used to forge a cookie.
+type SqliteStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	// How long to keep sessions with a MaxAge of 0 in the database
+	BrowserSessionMaxAge int
+
+	// Header containing the client IP address, see client_ip.ClientIp
+	TrustedProxyHeader string
+
+	db *sqlx.DB
+}
+
+func NewSqliteStore(db *sqlx.DB, keyPairs ...[]byte) *SqliteStore {
+	store := &SqliteStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		BrowserSessionMaxAge: defaultBrowserSessionMaxAge,
+		db:                   db,
+	}
+
+	// Expiry is enforced by the database instead of the cookie timestamp
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(0)
+		}
+	}
+
+	return store
+}
+
+func (s *SqliteStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// Returns an empty session if the cookie refers to a session which has
+// expired or been revoked.
+func (s *SqliteStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	token, err := s.cookieToken(r, name)
+
+	if err != nil || len(token) == 0 {
+		return session, err
+	}
+
+	userSession, err := database.FindUserSessionByTokenHash(s.db, utils.HashToken(token))
+
+	if err != nil || userSession == nil {
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(userSession.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	err = database.TouchUserSession(s.db, *userSession, client_ip.ClientIp(r, s.TrustedProxyHeader), r.UserAgent())
+
+	return session, err
+}
+
+func (s *SqliteStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if len(session.ID) > 0 {
+			if err := database.DeleteUserSessionByTokenHash(s.db, utils.HashToken(session.ID)); err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if len(session.ID) == 0 {
+		session.ID = hex.EncodeToString(securecookie.GenerateRandomKey(sessionTokenSize))
+
+		// The token was rotated, e.g. on login, so the session of the old
+		// token is replaced by this one.
+		if token, _ := s.cookieToken(r, session.Name()); len(token) > 0 {
+			if err := database.DeleteUserSessionByTokenHash(s.db, utils.HashToken(token)); err != nil {
+				return err
+			}
+		}
+	}
+
+	data := bytes.Buffer{}
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	var userId *int64
+	if id, ok := session.Values[UserIdKey].(int64); ok {
+		userId = &id
+	}
+
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.BrowserSessionMaxAge
+	}
+
+	err := database.SaveUserSession(s.db, utils.HashToken(session.ID), userId, data.Bytes(), client_ip.ClientIp(r, s.TrustedProxyHeader), r.UserAgent(), maxAge)
+
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Returns the token of the session cookie in r, or an empty string if there
+// is none.
+func (s *SqliteStore) cookieToken(r *http.Request, name string) (string, error) {
+	cookie, err := r.Cookie(name)
+
+	if err != nil {
+		return "", nil
+	}
+
+	token := ""
+	err = securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...)
+
+	return token, err
+}
+
+// Identifies the session matching the cookie in r, if any, so that it can be
+// highlighted in a list of sessions.
+func CurrentTokenHash(r *http.Request, store sessions.Store) string {
+	session, err := store.Get(r, SessionName)
+
+	if err != nil || len(session.ID) == 0 {
+		return ""
+	}
+
+	return utils.HashToken(session.ID)
+}
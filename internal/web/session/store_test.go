@@ -0,0 +1,113 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/user"
+	"authfish/internal/utils"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestStore(t *testing.T) (*SqliteStore, *sqlx.DB) {
+	db := database.OpenTestDB(t)
+
+	return NewSqliteStore(db, testKey), db
+}
+
+// Returns a request carrying the session cookie set by rw, if any.
+func requestWithCookie(rw *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == SessionName {
+			r.AddCookie(cookie)
+		}
+	}
+
+	return r
+}
+
+// Returns the token of the session in the request, and whether the store
+// still has a row for it.
+func sessionToken(t *testing.T, store *SqliteStore, db *sqlx.DB, r *http.Request) (string, bool) {
+	token, err := store.cookieToken(r, SessionName)
+
+	if err != nil || len(token) == 0 {
+		t.Fatalf("got token %q and error %v", token, err)
+	}
+
+	userSession, err := database.FindUserSessionByTokenHash(db, utils.HashToken(token))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token, userSession != nil
+}
+
+func TestSetUserSessionRotatesToken(t *testing.T) {
+	lifetime := Lifetime{Absolute: time.Hour, Idle: time.Hour}
+
+	tests := []struct {
+		name string
+		// Sets up the session before the login
+		before func(rw http.ResponseWriter, r *http.Request, store sessions.Store, u user.User) error
+	}{
+		{
+			name: "anonymous session",
+			before: func(rw http.ResponseWriter, r *http.Request, store sessions.Store, u user.User) error {
+				return AddFlash(rw, r, store, "info", "hello")
+			},
+		},
+		{
+			name: "pending second factor",
+			before: func(rw http.ResponseWriter, r *http.Request, store sessions.Store, u user.User) error {
+				return SetPendingSecondFactorSession(rw, r, store, nil, u)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, db := newTestStore(t)
+			u := database.CreateTestUser(t, db, "alice", "correct horse battery staple")
+
+			rw := httptest.NewRecorder()
+			if err := test.before(rw, httptest.NewRequest(http.MethodGet, "/login", nil), store, *u); err != nil {
+				t.Fatal(err)
+			}
+
+			r := requestWithCookie(rw)
+			oldToken, _ := sessionToken(t, store, db, r)
+
+			rw = httptest.NewRecorder()
+			if err := SetUserSession(rw, r, store, nil, lifetime, *u, false); err != nil {
+				t.Fatal(err)
+			}
+
+			newToken, found := sessionToken(t, store, db, requestWithCookie(rw))
+
+			if newToken == oldToken {
+				t.Error("login kept the old token")
+			}
+
+			if !found {
+				t.Error("session of the new token is missing")
+			}
+
+			userSession, err := database.FindUserSessionByTokenHash(db, utils.HashToken(oldToken))
+
+			if err != nil || userSession != nil {
+				t.Errorf("session of the old token is still there: %+v (%v)", userSession, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package two_factor
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"authfish/internal/database"
+	"authfish/internal/totp"
+	"authfish/internal/user"
+	"authfish/internal/web/csrf"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var (
+	//go:embed two_factor.template.html
+	templateString string
+	parsedTemplate *template.Template = template.Must(template.New("two_factor").Parse(templateString))
+)
+
+const (
+	qrCodeSize = 256
+)
+
+type templateVars struct {
+	User                   *user.User
+	Enabled                bool
+	Secret                 string
+	QRCode                 template.URL
+	RecoveryCodes          []string
+	RecoveryCodesRemaining int
+	Errors                 []error
+	CsrfToken              string
+}
+
+func renderTemplate(rw http.ResponseWriter, r *http.Request, status int, vars templateVars) {
+	vars.CsrfToken = csrf.Token(rw, r)
+	rw.WriteHeader(status)
+	parsedTemplate.Execute(rw, vars)
+}
+
+type Service struct {
+	store sessions.Store
+	db    *sqlx.DB
+}
+
+func New(store sessions.Store, db *sqlx.DB) *Service {
+	return &Service{
+		store: store,
+		db:    db,
+	}
+}
+
+func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.showTwoFactor(rw, r, *currentUser, http.StatusOK, nil)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try GET or POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "confirm":
+		s.handleConfirm(rw, r, *currentUser)
+	case "disable":
+		s.handleDisable(rw, r, *currentUser)
+	default:
+		http.Error(rw, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// Show the status page if two-factor authentication is enabled, otherwise the
+// enrollment page. The pending secret is reused across page loads so that
+// refreshing does not invalidate a QR code that was already scanned.
+func (s *Service) showTwoFactor(rw http.ResponseWriter, r *http.Request, u user.User, status int, errors []error) {
+	credential, err := database.FindTotpCredential(s.db, u)
+
+	if err != nil {
+		renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+			User:   &u,
+			Errors: []error{fmt.Errorf("error querying database: %w", err)},
+		})
+		return
+	}
+
+	if credential != nil && credential.IsConfirmed() {
+		remaining, _ := database.CountUnusedRecoveryCodes(s.db, u)
+
+		renderTemplate(rw, r, status, templateVars{
+			User:                   &u,
+			Enabled:                true,
+			RecoveryCodesRemaining: remaining,
+			Errors:                 errors,
+		})
+		return
+	}
+
+	if credential == nil {
+		secret, err := totp.GenerateSecret()
+
+		if err == nil {
+			credential, err = database.CreatePendingTotpCredential(s.db, u, secret)
+		}
+
+		if err != nil {
+			renderTemplate(rw, r, http.StatusInternalServerError, templateVars{
+				User:   &u,
+				Errors: []error{fmt.Errorf("could not generate two-factor secret: %w", err)},
+			})
+			return
+		}
+	}
+
+	qrCode, err := qrcode.Encode(totp.ProvisioningURI(credential.Secret, u.Username), qrcode.Medium, qrCodeSize)
+
+	if err != nil {
+		errors = append(errors, fmt.Errorf("could not render QR code: %w", err))
+	}
+
+	renderTemplate(rw, r, status, templateVars{
+		User:   &u,
+		Secret: credential.Secret,
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode)),
+		Errors: errors,
+	})
+}
+
+func (s *Service) handleConfirm(rw http.ResponseWriter, r *http.Request, u user.User) {
+	credential, err := database.FindTotpCredential(s.db, u)
+
+	if err != nil || credential == nil || credential.IsConfirmed() {
+		http.Redirect(rw, r, "/me/two-factor", http.StatusFound)
+		return
+	}
+
+	step, ok := totp.Validate(credential.Secret, r.FormValue("code"), time.Now(), 0)
+
+	if !ok {
+		s.showTwoFactor(rw, r, u, http.StatusBadRequest, []error{fmt.Errorf("invalid two-factor code")})
+		return
+	}
+
+	recoveryCodes, err := totp.GenerateRecoveryCodes()
+
+	if err == nil {
+		err = database.ConfirmTotpCredential(s.db, u, step, recoveryCodes)
+	}
+
+	if err != nil {
+		s.showTwoFactor(rw, r, u, http.StatusInternalServerError, []error{fmt.Errorf("could not enable two-factor authentication: %w", err)})
+		return
+	}
+
+	// This is the only time the recovery codes are ever shown
+	renderTemplate(rw, r, http.StatusOK, templateVars{
+		User:                   &u,
+		Enabled:                true,
+		RecoveryCodes:          recoveryCodes,
+		RecoveryCodesRemaining: len(recoveryCodes),
+	})
+}
+
+func (s *Service) handleDisable(rw http.ResponseWriter, r *http.Request, u user.User) {
+	if err := Verify(s.db, u, r.FormValue("code")); err != nil {
+		s.showTwoFactor(rw, r, u, http.StatusBadRequest, []error{err})
+		return
+	}
+
+	if err := database.DeleteTotpCredential(s.db, u); err != nil {
+		s.showTwoFactor(rw, r, u, http.StatusInternalServerError, []error{fmt.Errorf("could not disable two-factor authentication: %w", err)})
+		return
+	}
+
+	http.Redirect(rw, r, "/me", http.StatusFound)
+}
+
+// Check a second factor for a user with two-factor authentication enabled.
+// Accepts either a current TOTP code or one of the user's unused recovery
+// codes, which is then used up.
+func Verify(db *sqlx.DB, u user.User, code string) error {
+	credential, err := database.FindTotpCredential(db, u)
+
+	if err != nil {
+		return fmt.Errorf("error running database query: %w", err)
+	}
+
+	if credential == nil || !credential.IsConfirmed() {
+		return fmt.Errorf("two-factor authentication is not enabled for %s", u.Username)
+	}
+
+	if step, ok := totp.Validate(credential.Secret, code, time.Now(), credential.LastUsedStep); ok {
+		return database.UpdateTotpLastUsedStep(db, u, step)
+	}
+
+	consumed, err := database.ConsumeRecoveryCode(db, u, code)
+
+	if err != nil {
+		return fmt.Errorf("error running database query: %w", err)
+	}
+
+	if !consumed {
+		return fmt.Errorf("invalid two-factor code")
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package user_sessions
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"authfish/internal/database"
+	"authfish/internal/web/current_user"
+	"authfish/internal/web/session"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+type Service struct {
+	store sessions.Store
+	db    *sqlx.DB
+}
+
+func New(store sessions.Store, db *sqlx.DB) *Service {
+	return &Service{
+		store: store,
+		db:    db,
+	}
+}
+
+// Handles the "log out" buttons in the list of active sessions on /me.
+func (s *Service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	currentUser, err := current_user.CurrentUser(r.Context())
+
+	if err != nil || currentUser == nil {
+		session.DeleteSessionAndRedirectToLogin(rw, r, s.store)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errMessage := fmt.Sprintf("Method %s is not allowed. Try POST", r.Method)
+		http.Error(rw, errMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	if err != nil {
+		http.Error(rw, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.RevokeUserSessionForUser(s.db, *currentUser, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(rw, r, "/me", http.StatusFound)
+}
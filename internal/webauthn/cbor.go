@@ -0,0 +1,146 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Just enough of a CBOR (RFC 8949) decoder to read attestation objects and
+// COSE keys. Indefinite length items, floats and tags are not supported, as
+// authenticators do not use them in these structures.
+//
+// Decoded values are uint64 or int64 for integers, []byte, string,
+// []interface{}, map[interface{}]interface{}, bool or nil.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of cbor data")
+	}
+
+	majorType := data[0] >> 5
+	additional := data[0] & 0x1f
+	data = data[1:]
+
+	if majorType == 7 {
+		switch additional {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported cbor simple value %d", additional)
+		}
+	}
+
+	argument, data, err := readCBORArgument(additional, data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch majorType {
+	case 0:
+		return argument, data, nil
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor negative integer out of range")
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3:
+		if uint64(len(data)) < argument {
+			return nil, nil, fmt.Errorf("unexpected end of cbor data")
+		}
+		value := data[:argument]
+		if majorType == 3 {
+			return string(value), data[argument:], nil
+		}
+		return append([]byte{}, value...), data[argument:], nil
+	case 4:
+		items := []interface{}{}
+		for i := uint64(0); i < argument; i++ {
+			var item interface{}
+			item, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		items := map[interface{}]interface{}{}
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			key, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case []interface{}, map[interface{}]interface{}, []byte:
+				return nil, nil, fmt.Errorf("unsupported cbor map key type %T", key)
+			}
+			value, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported cbor major type %d", majorType)
+	}
+}
+
+func readCBORArgument(additional byte, data []byte) (uint64, []byte, error) {
+	size := 0
+
+	switch {
+	case additional < 24:
+		return uint64(additional), data, nil
+	case additional == 24:
+		size = 1
+	case additional == 25:
+		size = 2
+	case additional == 26:
+		size = 4
+	case additional == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("unsupported cbor additional information %d", additional)
+	}
+
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("unexpected end of cbor data")
+	}
+
+	padded := make([]byte, 8)
+	copy(padded[8-size:], data[:size])
+
+	return binary.BigEndian.Uint64(padded), data[size:], nil
+}
+
+// Integer map keys can decode as either uint64 or int64 depending on sign.
+func cborMapInt(m map[interface{}]interface{}, key int64) (interface{}, bool) {
+	if key >= 0 {
+		value, ok := m[uint64(key)]
+		return value, ok
+	}
+
+	value, ok := m[key]
+	return value, ok
+}
+
+func cborInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case int64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
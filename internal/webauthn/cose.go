@@ -0,0 +1,140 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers, from the IANA COSE registry
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// Algorithms we accept, in order of preference
+var SupportedAlgorithms []int64 = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+const (
+	coseKeyTypeOKP int64 = 1
+	coseKeyTypeEC2 int64 = 2
+	coseKeyTypeRSA int64 = 3
+
+	coseCurveP256    int64 = 1
+	coseCurveEd25519 int64 = 6
+)
+
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+func parseCOSEKey(data []byte) (*publicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode public key: %w", err)
+	}
+
+	m, ok := decoded.(map[interface{}]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("public key is not a cbor map")
+	}
+
+	rawKeyType, _ := cborMapInt(m, 1)
+	keyType, ok := cborInt(rawKeyType)
+
+	if !ok {
+		return nil, fmt.Errorf("public key has no key type")
+	}
+
+	rawAlgorithm, _ := cborMapInt(m, 3)
+	algorithm, ok := cborInt(rawAlgorithm)
+
+	if !ok {
+		return nil, fmt.Errorf("public key has no algorithm")
+	}
+
+	rawCurve, _ := cborMapInt(m, -1)
+	curve, _ := cborInt(rawCurve)
+	rawX, _ := cborMapInt(m, -2)
+	x, _ := rawX.([]byte)
+	rawY, _ := cborMapInt(m, -3)
+	y, _ := rawY.([]byte)
+
+	switch {
+	case keyType == coseKeyTypeEC2 && algorithm == AlgES256:
+		if curve != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("unsupported ES256 public key")
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("ES256 public key is not on the curve")
+		}
+
+		return &publicKey{algorithm: algorithm, key: key}, nil
+
+	case keyType == coseKeyTypeOKP && algorithm == AlgEdDSA:
+		if curve != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported EdDSA public key")
+		}
+
+		return &publicKey{algorithm: algorithm, key: ed25519.PublicKey(x)}, nil
+
+	case keyType == coseKeyTypeRSA && algorithm == AlgRS256:
+		// For RSA keys, -1 is the modulus and -2 the exponent
+		rawN, _ := cborMapInt(m, -1)
+		n, _ := rawN.([]byte)
+		e := x
+
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("unsupported RS256 public key")
+		}
+
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+
+		return &publicKey{algorithm: algorithm, key: key}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported public key type %d with algorithm %d", keyType, algorithm)
+	}
+}
+
+func (k *publicKey) verify(message []byte, signature []byte) error {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", k.key)
+	}
+
+	return nil
+}
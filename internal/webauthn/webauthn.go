@@ -0,0 +1,412 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ChallengeSize    = 32
+	ChallengeTimeout = 5 * time.Minute
+
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+var encoding = base64.RawURLEncoding
+
+// A passkey registered by a user
+type Credential struct {
+	Id           int64      `db:"id"`
+	UserId       int64      `db:"user_id"`
+	Name         string     `db:"name"`
+	CredentialId []byte     `db:"credential_id"`
+	PublicKey    []byte     `db:"public_key"`
+	SignCount    int64      `db:"sign_count"`
+	CreatedAt    time.Time  `db:"created_at"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+}
+
+type RelyingParty struct {
+	// Passkeys are scoped to this domain and all of its subdomains
+	Id   string
+	Name string
+
+	// Accept http:// origins, for local testing without TLS
+	AllowInsecureOrigins bool
+}
+
+// Sent by the browser after navigator.credentials.create(). Binary fields are
+// base64url encoded.
+type RegistrationResponse struct {
+	Name              string `json:"name"`
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// Sent by the browser after navigator.credentials.get(). Binary fields are
+// base64url encoded.
+type AssertionResponse struct {
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+	Remember          bool   `json:"remember"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	raw          []byte
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+func GenerateChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("could not generate random bytes: %w", err)
+	}
+
+	return challenge, nil
+}
+
+func EncodeUserHandle(userId int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userId))
+	return handle
+}
+
+func Encode(data []byte) string {
+	return encoding.EncodeToString(data)
+}
+
+func Decode(data string) ([]byte, error) {
+	return encoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// Options for navigator.credentials.create(), with binary values base64url
+// encoded so that they survive the trip through JSON.
+func (rp RelyingParty) CreationOptions(challenge []byte, userId int64, username string, existing []Credential) map[string]interface{} {
+	pubKeyCredParams := []map[string]interface{}{}
+	for _, alg := range SupportedAlgorithms {
+		pubKeyCredParams = append(pubKeyCredParams, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+
+	excludeCredentials := []map[string]interface{}{}
+	for _, credential := range existing {
+		excludeCredentials = append(excludeCredentials, map[string]interface{}{"type": "public-key", "id": Encode(credential.CredentialId)})
+	}
+
+	return map[string]interface{}{
+		"challenge": Encode(challenge),
+		"rp":        map[string]interface{}{"id": rp.Id, "name": rp.Name},
+		"user": map[string]interface{}{
+			"id":          Encode(EncodeUserHandle(userId)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams":   pubKeyCredParams,
+		"excludeCredentials": excludeCredentials,
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+		"attestation": "none",
+		"timeout":     ChallengeTimeout.Milliseconds(),
+	}
+}
+
+// Options for navigator.credentials.get(). No credentials are listed, so the
+// browser offers whichever passkeys it has for this relying party.
+func (rp RelyingParty) RequestOptions(challenge []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"challenge":        Encode(challenge),
+		"rpId":             rp.Id,
+		"userVerification": "required",
+		"timeout":          ChallengeTimeout.Milliseconds(),
+	}
+}
+
+// Extract the challenge the browser signed, so that the caller can check it
+// was issued by us before verifying the rest of the response.
+func ChallengeFromClientData(clientDataJSON string) ([]byte, error) {
+	data, err := parseClientData(clientDataJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(data.Challenge)
+}
+
+// Check a new credential. We request "none" attestation, so the attestation
+// statement is not verified; the returned credential is trusted because the
+// user creating it is already logged in.
+func (rp RelyingParty) VerifyRegistration(response RegistrationResponse, challenge []byte) (*Credential, error) {
+	clientData, err := parseClientData(response.ClientDataJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rp.checkClientData(clientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAttestationObject, err := Decode(response.AttestationObject)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode attestation object: %w", err)
+	}
+
+	decoded, _, err := decodeCBOR(rawAttestationObject)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode attestation object: %w", err)
+	}
+
+	attestationObject, ok := decoded.(map[interface{}]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("attestation object is not a cbor map")
+	}
+
+	rawAuthData, ok := attestationObject["authData"].([]byte)
+
+	if !ok {
+		return nil, fmt.Errorf("attestation object has no authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rp.checkAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return nil, fmt.Errorf("authenticator did not return a credential")
+	}
+
+	if _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		Name:         response.Name,
+		CredentialId: authData.credentialId,
+		PublicKey:    authData.publicKey,
+		SignCount:    int64(authData.signCount),
+	}, nil
+}
+
+// Check a login attempt with a stored credential. Returns the new signature
+// counter, which should be saved.
+func (rp RelyingParty) VerifyAssertion(response AssertionResponse, challenge []byte, credential Credential) (int64, error) {
+	clientData, err := parseClientData(response.ClientDataJSON)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := rp.checkClientData(clientData, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	if len(response.UserHandle) > 0 {
+		userHandle, err := Decode(response.UserHandle)
+
+		if err != nil || !bytes.Equal(userHandle, EncodeUserHandle(credential.UserId)) {
+			return 0, fmt.Errorf("passkey does not belong to this user")
+		}
+	}
+
+	rawAuthData, err := Decode(response.AuthenticatorData)
+
+	if err != nil {
+		return 0, fmt.Errorf("could not decode authenticator data: %w", err)
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := rp.checkAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+
+	key, err := parseCOSEKey(credential.PublicKey)
+
+	if err != nil {
+		return 0, err
+	}
+
+	signature, err := Decode(response.Signature)
+
+	if err != nil {
+		return 0, fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	rawClientData, _ := Decode(response.ClientDataJSON)
+	clientDataHash := sha256.Sum256(rawClientData)
+	signedData := append(append([]byte{}, authData.raw...), clientDataHash[:]...)
+
+	if err := key.verify(signedData, signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators that keep a counter always increase it. A counter that
+	// goes backwards suggests the credential has been cloned.
+	signCount := int64(authData.signCount)
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return 0, fmt.Errorf("passkey signature counter did not increase, it may have been cloned")
+	}
+
+	return signCount, nil
+}
+
+func parseClientData(clientDataJSON string) (*clientData, error) {
+	raw, err := Decode(clientDataJSON)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode client data: %w", err)
+	}
+
+	data := clientData{}
+
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("could not parse client data: %w", err)
+	}
+
+	return &data, nil
+}
+
+func (rp RelyingParty) checkClientData(data *clientData, ceremony string, challenge []byte) error {
+	if data.Type != ceremony {
+		return fmt.Errorf("expected client data type %s, got %s", ceremony, data.Type)
+	}
+
+	signedChallenge, err := Decode(data.Challenge)
+
+	if err != nil || !bytes.Equal(signedChallenge, challenge) {
+		return fmt.Errorf("challenge does not match")
+	}
+
+	return rp.checkOrigin(data.Origin)
+}
+
+// The origin must be the relying party ID itself or one of its subdomains.
+func (rp RelyingParty) checkOrigin(origin string) error {
+	parsedOrigin, err := url.Parse(origin)
+
+	if err != nil {
+		return fmt.Errorf("invalid origin %s", origin)
+	}
+
+	if parsedOrigin.Scheme != "https" && !(rp.AllowInsecureOrigins && parsedOrigin.Scheme == "http") {
+		return fmt.Errorf("origin %s is not secure", origin)
+	}
+
+	host := strings.ToLower(parsedOrigin.Hostname())
+	rpId := strings.ToLower(rp.Id)
+
+	if host != rpId && !strings.HasSuffix(host, "."+rpId) {
+		return fmt.Errorf("origin %s does not belong to %s", origin, rp.Id)
+	}
+
+	return nil
+}
+
+func (rp RelyingParty) checkAuthenticatorData(authData *authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+
+	if !bytes.Equal(authData.rpIdHash, rpIdHash[:]) {
+		return fmt.Errorf("passkey is for a different site")
+	}
+
+	if authData.flags&flagUserPresent == 0 {
+		return fmt.Errorf("user was not present")
+	}
+
+	// A passkey login replaces both the password and the second factor, so
+	// touching a security key is not enough. It must also check a PIN or
+	// biometric.
+	if authData.flags&flagUserVerified == 0 {
+		return fmt.Errorf("passkey did not verify the user with a PIN or biometric")
+	}
+
+	return nil
+}
+
+// Layout is described in section 6.1 of the WebAuthn spec
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data is too short")
+	}
+
+	authData := &authenticatorData{
+		raw:       data,
+		rpIdHash:  data[0:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return authData, nil
+	}
+
+	// 16 byte AAGUID, then a 2 byte credential ID length
+	rest := data[37:]
+
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data is too short")
+	}
+
+	credentialIdLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if len(rest) < credentialIdLength {
+		return nil, fmt.Errorf("attested credential data is too short")
+	}
+
+	authData.credentialId = rest[:credentialIdLength]
+	rest = rest[credentialIdLength:]
+
+	// The public key is followed by optional extension data, so decode it to
+	// find out where it ends.
+	_, remaining, err := decodeCBOR(rest)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode public key: %w", err)
+	}
+
+	authData.publicKey = rest[:len(rest)-len(remaining)]
+
+	return authData, nil
+}
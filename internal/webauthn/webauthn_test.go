@@ -0,0 +1,352 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "https://auth.example.com"
+
+var testRelyingParty = RelyingParty{Id: "example.com", Name: "authfish"}
+
+// A software authenticator holding a single ES256 passkey.
+type softwareAuthenticator struct {
+	privateKey   *ecdsa.PrivateKey
+	credentialId []byte
+	rpId         string
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareAuthenticator{
+		privateKey:   privateKey,
+		credentialId: []byte("test-credential"),
+		rpId:         testRelyingParty.Id,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *softwareAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.privateKey.X.FillBytes(x)
+	a.privateKey.Y.FillBytes(y)
+
+	return encodeTestCBOR(cborPairs{
+		{int64(1), coseKeyTypeEC2},
+		{int64(3), AlgES256},
+		{int64(-1), coseCurveP256},
+		{int64(-2), x},
+		{int64(-3), y},
+	})
+}
+
+func (a *softwareAuthenticator) authenticatorData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	flags := a.flags
+
+	if attested {
+		flags |= flagAttestedCredentialData
+	}
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialId)))
+		data = append(data, a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *softwareAuthenticator) register(t *testing.T, challenge []byte) RegistrationResponse {
+	attestationObject := encodeTestCBOR(cborPairs{
+		{"fmt", "none"},
+		{"attStmt", cborPairs{}},
+		{"authData", a.authenticatorData(true)},
+	})
+
+	return RegistrationResponse{
+		Name:              "test",
+		Id:                Encode(a.credentialId),
+		ClientDataJSON:    testClientData(t, "webauthn.create", challenge, testOrigin),
+		AttestationObject: Encode(attestationObject),
+	}
+}
+
+func (a *softwareAuthenticator) assert(t *testing.T, challenge []byte, origin string) AssertionResponse {
+	a.signCount++
+
+	clientDataJSON := testClientData(t, "webauthn.get", challenge, origin)
+	rawClientData, _ := Decode(clientDataJSON)
+	clientDataHash := sha256.Sum256(rawClientData)
+	authData := a.authenticatorData(false)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.privateKey, digest[:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return AssertionResponse{
+		Id:                Encode(a.credentialId),
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: Encode(authData),
+		Signature:         Encode(signature),
+		UserHandle:        Encode(EncodeUserHandle(1)),
+	}
+}
+
+func testClientData(t *testing.T, ceremony string, challenge []byte, origin string) string {
+	data, err := json.Marshal(clientData{Type: ceremony, Challenge: Encode(challenge), Origin: origin})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Encode(data)
+}
+
+func testChallenge(t *testing.T) []byte {
+	challenge, err := GenerateChallenge()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge
+}
+
+// Registers a passkey with a fresh authenticator, as the /me page does.
+func registeredCredential(t *testing.T, authenticator *softwareAuthenticator) Credential {
+	challenge := testChallenge(t)
+	credential, err := testRelyingParty.VerifyRegistration(authenticator.register(t, challenge), challenge)
+
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	credential.UserId = 1
+
+	return *credential
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	authenticator := newSoftwareAuthenticator(t)
+	credential := registeredCredential(t, authenticator)
+
+	if string(credential.CredentialId) != string(authenticator.credentialId) {
+		t.Errorf("credential ID is %q, want %q", credential.CredentialId, authenticator.credentialId)
+	}
+
+	authenticator.flags = flagUserPresent
+	challenge := testChallenge(t)
+
+	if _, err := testRelyingParty.VerifyRegistration(authenticator.register(t, challenge), challenge); err == nil {
+		t.Error("registration without user verification was accepted")
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the authenticator or the response before it is verified
+		tamper         func(a *softwareAuthenticator, credential *Credential)
+		origin         string
+		wrongChallenge bool
+		wantErr        string
+	}{
+		{
+			name:   "valid assertion",
+			origin: testOrigin,
+		},
+		{
+			name:   "valid assertion from a subdomain",
+			origin: "https://wiki.example.com",
+		},
+		{
+			name:           "wrong challenge",
+			origin:         testOrigin,
+			wrongChallenge: true,
+			wantErr:        "challenge does not match",
+		},
+		{
+			name:    "wrong origin",
+			origin:  "https://example.org",
+			wantErr: "does not belong to",
+		},
+		{
+			name:    "look-alike origin",
+			origin:  "https://evilexample.com",
+			wantErr: "does not belong to",
+		},
+		{
+			name:    "insecure origin",
+			origin:  "http://auth.example.com",
+			wantErr: "is not secure",
+		},
+		{
+			name:    "wrong relying party ID",
+			origin:  testOrigin,
+			tamper:  func(a *softwareAuthenticator, credential *Credential) { a.rpId = "example.org" },
+			wantErr: "different site",
+		},
+		{
+			name:    "signature counter goes backwards",
+			origin:  testOrigin,
+			tamper:  func(a *softwareAuthenticator, credential *Credential) { credential.SignCount = 10 },
+			wantErr: "signature counter",
+		},
+		{
+			name:    "user present but not verified",
+			origin:  testOrigin,
+			tamper:  func(a *softwareAuthenticator, credential *Credential) { a.flags = flagUserPresent },
+			wantErr: "did not verify the user",
+		},
+		{
+			name:    "user not present",
+			origin:  testOrigin,
+			tamper:  func(a *softwareAuthenticator, credential *Credential) { a.flags = flagUserVerified },
+			wantErr: "not present",
+		},
+		{
+			name:    "passkey of another user",
+			origin:  testOrigin,
+			tamper:  func(a *softwareAuthenticator, credential *Credential) { credential.UserId = 2 },
+			wantErr: "does not belong to this user",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := newSoftwareAuthenticator(t)
+			credential := registeredCredential(t, authenticator)
+
+			if test.tamper != nil {
+				test.tamper(authenticator, &credential)
+			}
+
+			challenge := testChallenge(t)
+			signedChallenge := challenge
+
+			if test.wrongChallenge {
+				signedChallenge = testChallenge(t)
+			}
+
+			response := authenticator.assert(t, signedChallenge, test.origin)
+			signCount, err := testRelyingParty.VerifyAssertion(response, challenge, credential)
+
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if signCount != int64(authenticator.signCount) {
+					t.Errorf("sign count is %d, want %d", signCount, authenticator.signCount)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejectsReplayedCounter(t *testing.T) {
+	authenticator := newSoftwareAuthenticator(t)
+	credential := registeredCredential(t, authenticator)
+
+	challenge := testChallenge(t)
+	signCount, err := testRelyingParty.VerifyAssertion(authenticator.assert(t, challenge, testOrigin), challenge, credential)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	credential.SignCount = signCount
+
+	// A clone of the authenticator still has the old counter
+	authenticator.signCount--
+	challenge = testChallenge(t)
+
+	if _, err := testRelyingParty.VerifyAssertion(authenticator.assert(t, challenge, testOrigin), challenge, credential); err == nil {
+		t.Error("assertion with a repeated signature counter was accepted")
+	}
+}
+
+func TestOptionsRequireUserVerification(t *testing.T) {
+	creationOptions := testRelyingParty.CreationOptions([]byte("challenge"), 1, "alice", nil)
+	authenticatorSelection := creationOptions["authenticatorSelection"].(map[string]interface{})
+
+	if authenticatorSelection["userVerification"] != "required" {
+		t.Errorf("creation options ask for userVerification %v", authenticatorSelection["userVerification"])
+	}
+
+	requestOptions := testRelyingParty.RequestOptions([]byte("challenge"))
+
+	if requestOptions["userVerification"] != "required" {
+		t.Errorf("request options ask for userVerification %v", requestOptions["userVerification"])
+	}
+}
+
+// Map entries in the order they are encoded.
+type cborPairs [][2]interface{}
+
+// Encodes the few CBOR types the software authenticator needs.
+func encodeTestCBOR(value interface{}) []byte {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return cborHeader(1, uint64(-1-v))
+		}
+
+		return cborHeader(0, uint64(v))
+	case []byte:
+		return append(cborHeader(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHeader(3, uint64(len(v))), v...)
+	case cborPairs:
+		encoded := cborHeader(5, uint64(len(v)))
+
+		for _, pair := range v {
+			encoded = append(encoded, encodeTestCBOR(pair[0])...)
+			encoded = append(encoded, encodeTestCBOR(pair[1])...)
+		}
+
+		return encoded
+	default:
+		panic("unsupported cbor value")
+	}
+}
+
+func cborHeader(majorType byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{majorType<<5 | byte(argument)}
+	case argument < 1<<8:
+		return []byte{majorType<<5 | 24, byte(argument)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{majorType<<5 | 25}, uint16(argument))
+	}
+}
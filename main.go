@@ -1,7 +1,13 @@
 package main
 
 import (
+	"authfish/internal/cmd/client"
+	"authfish/internal/cmd/group"
+	"authfish/internal/cmd/policy"
+	"authfish/internal/cmd/provider"
 	"authfish/internal/cmd/server"
+	"authfish/internal/cmd/service_provider"
+	"authfish/internal/cmd/session"
 	"authfish/internal/cmd/user"
 	"authfish/internal/context"
 	"authfish/internal/database"
@@ -14,10 +20,16 @@ import (
 )
 
 type CLI struct {
-	User    user.UserCmd     `cmd:""`
-	Server  server.ServerCmd `cmd:""`
-	BaseURL string
-	DataDir string `help:"Path to the authfish data files. Default: ~/.authfish/"`
+	User            user.UserCmd                        `cmd:""`
+	Server          server.ServerCmd                    `cmd:""`
+	Group           group.GroupCmd                      `cmd:""`
+	Policy          policy.PolicyCmd                    `cmd:""`
+	Session         session.SessionCmd                  `cmd:""`
+	Client          client.ClientCmd                    `cmd:""`
+	Provider        provider.ProviderCmd                `cmd:""`
+	ServiceProvider service_provider.ServiceProviderCmd `cmd:"" aliases:"sp"`
+	BaseURL         string
+	DataDir         string `help:"Path to the authfish data files. Default: ~/.authfish/"`
 }
 
 func main() {
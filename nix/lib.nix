@@ -5,6 +5,10 @@
       newExtraConfig = ''
         auth_request /auth_request;
         error_page 401 /authfish_login;
+
+        # Pass on renewed session cookies from /check
+        auth_request_set $authfish_cookie $upstream_http_set_cookie;
+        add_header Set-Cookie $authfish_cookie;
       '';
       combinedExtraConfig = newExtraConfig + originalExtraConfig;
 
@@ -17,6 +21,7 @@
           extraConfig = ''
             internal;
             proxy_set_header X-Original-URL $scheme://$http_host$request_uri;
+            proxy_set_header X-Original-Method $request_method;
           '';
         };
 